@@ -1,8 +1,10 @@
 #!/usr/bin/env sh
 set -eu
 
-# Create a zip file containing just the code required for the cloud function
+# Create a zip file containing just the code required for the cloud function.
+# go.mod replaces this repository's module with the packages in it, so they are
+# vendored into the zip.
 
 mkdir -p dist
 rm -f dist/buildkite-agent-metrics.zip
-( cd cloud_function && zip ../dist/buildkite-agent-metrics.zip main.go go.mod go.sum )
+( cd cloud_function && go mod vendor && zip -r ../dist/buildkite-agent-metrics.zip main.go go.mod go.sum vendor && rm -rf vendor )
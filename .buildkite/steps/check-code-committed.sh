@@ -4,6 +4,7 @@ set -euf
 
 echo --- :go: Checking go mod tidyness
 go mod tidy
+( cd cloud_function && go mod tidy )
 if ! git diff --no-ext-diff --exit-code; then
   echo ^^^ +++
   echo "The go.mod or go.sum files are out of sync with the source code"
@@ -0,0 +1,392 @@
+// Package admin provides an HTTP server for operating the daemon, with health,
+// readiness and status endpoints, and endpoints to control collection and
+// publishing.
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-metrics/v5/collector"
+)
+
+// DefaultReadyIntervals is the default number of intervals within which each
+// token's last collection must have succeeded for the daemon to be ready.
+const DefaultReadyIntervals = 3
+
+// Server keeps track of the collections for each token, and serves:
+//
+//   - /healthz, which responds 200 OK while the process is alive,
+//   - /readyz, which responds 200 OK if the last collection for every token
+//     succeeded within ReadyIntervals intervals, and 503 otherwise, and
+//   - /status, which responds with the state of each token as JSON,
+//
+// and the control endpoints:
+//
+//   - POST /collect, which triggers a collection for every token, or the one
+//     named by the token parameter, as soon as its poll duration allows,
+//   - POST /pause, which stops results being published to backends, and
+//   - POST /resume, which starts publishing them again.
+type Server struct {
+	// Interval is how often tokens are polled. A token that is polled less
+	// often, because of the poll duration the Agent API asks for, is allowed
+	// as many of its own intervals instead.
+	Interval time.Duration
+
+	// ReadyIntervals is the number of intervals within which the last
+	// collection for each token must have succeeded. Values below 1 are
+	// treated as DefaultReadyIntervals.
+	ReadyIntervals int
+
+	// now is time.Now, except in tests.
+	now func() time.Time
+
+	mu       sync.Mutex
+	tokens   []*tokenState
+	stopping bool
+	paused   bool
+}
+
+// tokenState is what is known about the collections for one token.
+type tokenState struct {
+	name          string
+	result        *collector.Result
+	lastSuccess   time.Time
+	lastError     error
+	lastErrorTime time.Time
+	pollDuration  time.Duration
+	nextPoll      time.Time
+
+	// earliest is the soonest the token may be polled on demand, and
+	// trigger is sent to when it should be.
+	earliest time.Time
+	trigger  chan struct{}
+}
+
+// Token adds a token to keep track of, by name, and returns the Tracker to
+// record its collections with.
+func (s *Server) Token(name string) *Tracker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := &tokenState{name: name, trigger: make(chan struct{}, 1)}
+	s.tokens = append(s.tokens, state)
+	return &Tracker{s: s, state: state}
+}
+
+// Stopping marks the daemon as shutting down, so that it is no longer ready.
+func (s *Server) Stopping() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopping = true
+}
+
+// Paused reports whether publishing to backends has been paused.
+func (s *Server) Paused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.paused
+}
+
+// Tracker records the collections for one token. A nil Tracker records
+// nothing and is never triggered or paused, so that it can be used whether or
+// not there is a Server.
+type Tracker struct {
+	s     *Server
+	state *tokenState
+}
+
+// Succeeded records a successful collection of r at t.
+func (tr *Tracker) Succeeded(r *collector.Result, t time.Time) {
+	if tr == nil {
+		return
+	}
+	tr.s.mu.Lock()
+	defer tr.s.mu.Unlock()
+
+	tr.state.result = r
+	tr.state.lastSuccess = t
+	tr.state.pollDuration = r.PollDuration
+}
+
+// Failed records a failed collection at t.
+func (tr *Tracker) Failed(err error, t time.Time) {
+	if tr == nil {
+		return
+	}
+	tr.s.mu.Lock()
+	defer tr.s.mu.Unlock()
+
+	tr.state.lastError = err
+	tr.state.lastErrorTime = t
+}
+
+// Scheduled records when the token will next be polled, and the soonest it
+// may be polled on demand, given the poll duration the Agent API asked for.
+func (tr *Tracker) Scheduled(next, earliest time.Time) {
+	if tr == nil {
+		return
+	}
+	tr.s.mu.Lock()
+	defer tr.s.mu.Unlock()
+
+	tr.state.nextPoll = next
+	tr.state.earliest = earliest
+}
+
+// Triggered returns a channel that receives when a collection for the token
+// has been requested through /collect. Whoever receives from it should wait
+// until the earliest time given to Scheduled before collecting.
+func (tr *Tracker) Triggered() <-chan struct{} {
+	if tr == nil {
+		return nil
+	}
+	return tr.state.trigger
+}
+
+// Remove stops keeping track of the token, such as when it has been removed
+// from the config.
+func (tr *Tracker) Remove() {
+	if tr == nil {
+		return
+	}
+	tr.s.mu.Lock()
+	defer tr.s.mu.Unlock()
+
+	tr.s.tokens = slices.DeleteFunc(tr.s.tokens, func(t *tokenState) bool {
+		return t == tr.state
+	})
+}
+
+// Paused reports whether publishing to backends has been paused.
+func (tr *Tracker) Paused() bool {
+	if tr == nil {
+		return false
+	}
+	return tr.s.Paused()
+}
+
+// Handler returns the handler for the server's endpoints.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", s.healthz)
+	mux.HandleFunc("GET /readyz", s.readyz)
+	mux.HandleFunc("GET /status", s.status)
+	mux.HandleFunc("POST /collect", s.collect)
+	mux.HandleFunc("POST /pause", s.pause)
+	mux.HandleFunc("POST /resume", s.resume)
+	return mux
+}
+
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	if problems := s.notReady(); len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, p := range problems {
+			fmt.Fprintln(w, p)
+		}
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// notReady returns why the daemon isn't ready, if it isn't.
+func (s *Server) notReady() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopping {
+		return []string{"shutting down"}
+	}
+
+	intervals := s.ReadyIntervals
+	if intervals < 1 {
+		intervals = DefaultReadyIntervals
+	}
+	now := s.clock()
+
+	var problems []string
+	for _, t := range s.tokens {
+		interval := max(s.Interval, t.pollDuration)
+		switch {
+		case t.lastSuccess.IsZero():
+			problems = append(problems, fmt.Sprintf("%s: no successful collection yet", t.name))
+		case now.Sub(t.lastSuccess) > time.Duration(intervals)*interval:
+			problems = append(problems, fmt.Sprintf("%s: last successful collection was %v ago", t.name, now.Sub(t.lastSuccess).Round(time.Second)))
+		}
+	}
+	return problems
+}
+
+// TokenStatus is the state of a token, as returned by /status.
+type TokenStatus struct {
+	Name                string     `json:"name"`
+	Result              *Result    `json:"result,omitempty"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastErrorTime       *time.Time `json:"last_error_time,omitempty"`
+	PollDurationSeconds float64    `json:"poll_duration_seconds"`
+	NextPoll            *time.Time `json:"next_poll,omitempty"`
+}
+
+// Result is a collector.Result as returned by /status, in the same form that
+// collector.ReaderSource reads them.
+type Result struct {
+	Org                 string                    `json:"org"`
+	Cluster             string                    `json:"cluster,omitempty"`
+	PollDurationSeconds float64                   `json:"poll_duration_seconds"`
+	Totals              map[string]int            `json:"totals"`
+	Queues              map[string]map[string]int `json:"queues"`
+	QueueErrors         map[string]string         `json:"queue_errors,omitempty"`
+	SelfMetrics         map[string]int            `json:"self_metrics,omitempty"`
+	Stale               bool                      `json:"stale,omitempty"`
+}
+
+func newResult(r *collector.Result) *Result {
+	if r == nil {
+		return nil
+	}
+	res := &Result{
+		Org:                 r.Org,
+		Cluster:             r.Cluster,
+		PollDurationSeconds: r.PollDuration.Seconds(),
+		Totals:              r.Totals,
+		Queues:              r.Queues,
+		SelfMetrics:         r.SelfMetrics,
+		Stale:               r.Stale,
+	}
+	for queue, err := range r.QueueErrors {
+		if res.QueueErrors == nil {
+			res.QueueErrors = make(map[string]string)
+		}
+		res.QueueErrors[queue] = err.Error()
+	}
+	return res
+}
+
+// Status returns the state of each token, in the order they were added.
+func (s *Server) Status() []TokenStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	timePtr := func(t time.Time) *time.Time {
+		if t.IsZero() {
+			return nil
+		}
+		return &t
+	}
+
+	statuses := make([]TokenStatus, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		status := TokenStatus{
+			Name:                t.name,
+			Result:              newResult(t.result),
+			LastSuccess:         timePtr(t.lastSuccess),
+			LastErrorTime:       timePtr(t.lastErrorTime),
+			PollDurationSeconds: t.pollDuration.Seconds(),
+			NextPoll:            timePtr(t.nextPoll),
+		}
+		if t.lastError != nil {
+			status.LastError = t.lastError.Error()
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func (s *Server) status(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, struct {
+		Paused bool          `json:"paused"`
+		Tokens []TokenStatus `json:"tokens"`
+	}{s.Paused(), s.Status()})
+}
+
+// Triggered is a token that a collection was triggered for, as returned by
+// /collect.
+type Triggered struct {
+	Name string `json:"name"`
+
+	// CollectAt is when the collection will happen, which is after any poll
+	// duration the Agent API asked for has passed.
+	CollectAt time.Time `json:"collect_at"`
+}
+
+// Collect triggers a collection for the token with the given name, or every
+// token if name is empty. It returns false if there is no such token.
+func (s *Server) Collect(name string) ([]Triggered, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock()
+	var triggered []Triggered
+	for _, t := range s.tokens {
+		if name != "" && t.name != name {
+			continue
+		}
+		// A collection that is already triggered covers this one too
+		select {
+		case t.trigger <- struct{}{}:
+		default:
+		}
+		at := now
+		if t.earliest.After(now) {
+			at = t.earliest
+		}
+		triggered = append(triggered, Triggered{Name: t.name, CollectAt: at})
+	}
+	return triggered, len(triggered) > 0
+}
+
+func (s *Server) collect(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("token")
+	triggered, ok := s.Collect(name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no token is named %q", name), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, struct {
+		Tokens []Triggered `json:"tokens"`
+	}{triggered})
+}
+
+// SetPaused pauses or resumes publishing to backends.
+func (s *Server) SetPaused(paused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.paused = paused
+}
+
+func (s *Server) pause(w http.ResponseWriter, r *http.Request) {
+	s.SetPaused(true)
+	fmt.Fprintln(w, "paused")
+}
+
+func (s *Server) resume(w http.ResponseWriter, r *http.Request) {
+	s.SetPaused(false)
+	fmt.Fprintln(w, "resumed")
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func (s *Server) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
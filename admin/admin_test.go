@@ -0,0 +1,213 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-metrics/v5/collector"
+	"github.com/google/go-cmp/cmp"
+)
+
+func get(t *testing.T, h http.Handler, path string) (int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	body, _ := io.ReadAll(rec.Body)
+	return rec.Code, string(body)
+}
+
+func TestServerReadiness(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := &Server{Interval: time.Minute, ReadyIntervals: 2, now: func() time.Time { return now }}
+	h := s.Handler()
+
+	a := s.Token("a")
+	b := s.Token("b")
+
+	if code, _ := get(t, h, "/healthz"); code != http.StatusOK {
+		t.Errorf("GET /healthz = %d, want %d", code, http.StatusOK)
+	}
+
+	code, body := get(t, h, "/readyz")
+	if code != http.StatusServiceUnavailable || !strings.Contains(body, "a: no successful collection yet") {
+		t.Errorf("GET /readyz before collecting = %d %q, want %d and a not collected", code, body, http.StatusServiceUnavailable)
+	}
+
+	a.Succeeded(&collector.Result{Org: "test"}, now)
+	b.Succeeded(&collector.Result{Org: "test", PollDuration: 5 * time.Minute}, now)
+	if code, body := get(t, h, "/readyz"); code != http.StatusOK {
+		t.Errorf("GET /readyz after collecting = %d %q, want %d", code, body, http.StatusOK)
+	}
+
+	// b is polled every 5 minutes, so it is allowed 10 minutes
+	now = now.Add(3 * time.Minute)
+	code, body = get(t, h, "/readyz")
+	if code != http.StatusServiceUnavailable || !strings.Contains(body, "a: last successful collection was 3m0s ago") || strings.Contains(body, "b:") {
+		t.Errorf("GET /readyz after 3m = %d %q, want %d and only a too old", code, body, http.StatusServiceUnavailable)
+	}
+
+	a.Succeeded(&collector.Result{Org: "test"}, now)
+	s.Stopping()
+	if code, body := get(t, h, "/readyz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "shutting down") {
+		t.Errorf("GET /readyz while stopping = %d %q, want %d", code, body, http.StatusServiceUnavailable)
+	}
+}
+
+func TestServerStatus(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := &Server{Interval: time.Minute}
+
+	a := s.Token("a")
+	a.Succeeded(&collector.Result{
+		Org:          "test",
+		Cluster:      "default",
+		PollDuration: 30 * time.Second,
+		Totals:       map[string]int{collector.ScheduledJobsCount: 3},
+		Queues:       map[string]map[string]int{"deploy": {collector.ScheduledJobsCount: 3}},
+		QueueErrors:  map[string]error{"missing": errors.New("not found")},
+	}, now)
+	a.Failed(errors.New("unavailable"), now.Add(time.Minute))
+	a.Scheduled(now.Add(2*time.Minute), now.Add(30*time.Second))
+	s.Token("b")
+	s.Token("c").Remove()
+
+	code, body := get(t, s.Handler(), "/status")
+	if code != http.StatusOK {
+		t.Fatalf("GET /status = %d, want %d", code, http.StatusOK)
+	}
+
+	var got struct {
+		Tokens []TokenStatus `json:"tokens"`
+	}
+	if err := json.Unmarshal([]byte(body), &got); err != nil {
+		t.Fatalf("json.Unmarshal(GET /status) = %v", err)
+	}
+
+	lastError, nextPoll := now.Add(time.Minute), now.Add(2*time.Minute)
+	want := []TokenStatus{
+		{
+			Name: "a",
+			Result: &Result{
+				Org:                 "test",
+				Cluster:             "default",
+				PollDurationSeconds: 30,
+				Totals:              map[string]int{collector.ScheduledJobsCount: 3},
+				Queues:              map[string]map[string]int{"deploy": {collector.ScheduledJobsCount: 3}},
+				QueueErrors:         map[string]string{"missing": "not found"},
+			},
+			LastSuccess:         &now,
+			LastError:           "unavailable",
+			LastErrorTime:       &lastError,
+			PollDurationSeconds: 30,
+			NextPoll:            &nextPoll,
+		},
+		{Name: "b"},
+	}
+	if diff := cmp.Diff(got.Tokens, want); diff != "" {
+		t.Errorf("GET /status tokens diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestNilTracker(t *testing.T) {
+	var tr *Tracker
+	tr.Succeeded(&collector.Result{}, time.Now())
+	tr.Failed(errors.New("failed"), time.Now())
+	tr.Scheduled(time.Now(), time.Now())
+	tr.Remove()
+	if tr.Triggered() != nil {
+		t.Errorf("nil Tracker Triggered() = non-nil, want nil")
+	}
+	if tr.Paused() {
+		t.Errorf("nil Tracker Paused() = true, want false")
+	}
+}
+
+func post(t *testing.T, h http.Handler, path string) (int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, nil))
+	body, _ := io.ReadAll(rec.Body)
+	return rec.Code, string(body)
+}
+
+func triggered(tr *Tracker) bool {
+	select {
+	case <-tr.Triggered():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestServerCollect(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := &Server{Interval: time.Minute, now: func() time.Time { return now }}
+	h := s.Handler()
+
+	a := s.Token("a")
+	b := s.Token("b")
+	b.Scheduled(now.Add(time.Minute), now.Add(20*time.Second))
+
+	code, body := post(t, h, "/collect?token=b")
+	if code != http.StatusAccepted {
+		t.Fatalf("POST /collect?token=b = %d %q, want %d", code, body, http.StatusAccepted)
+	}
+	var got struct {
+		Tokens []Triggered `json:"tokens"`
+	}
+	if err := json.Unmarshal([]byte(body), &got); err != nil {
+		t.Fatalf("json.Unmarshal(POST /collect?token=b) = %v", err)
+	}
+	want := []Triggered{{Name: "b", CollectAt: now.Add(20 * time.Second)}}
+	if diff := cmp.Diff(got.Tokens, want); diff != "" {
+		t.Errorf("POST /collect?token=b tokens diff (-got +want):\n%s", diff)
+	}
+	if triggered(a) || !triggered(b) {
+		t.Errorf("after POST /collect?token=b, a and b triggered = %t, %t, want false, true", triggered(a), triggered(b))
+	}
+
+	// Triggering twice before the token collects only collects once
+	post(t, h, "/collect")
+	post(t, h, "/collect")
+	if !triggered(a) || !triggered(b) || triggered(a) || triggered(b) {
+		t.Errorf("after POST /collect twice, a and b weren't each triggered once")
+	}
+
+	if code, _ := post(t, h, "/collect?token=c"); code != http.StatusNotFound {
+		t.Errorf("POST /collect?token=c = %d, want %d", code, http.StatusNotFound)
+	}
+	if code, _ := get(t, h, "/collect"); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /collect = %d, want %d", code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestServerPause(t *testing.T) {
+	s := &Server{Interval: time.Minute}
+	h := s.Handler()
+	a := s.Token("a")
+
+	if a.Paused() {
+		t.Errorf("a.Paused() before POST /pause = true, want false")
+	}
+	if code, _ := post(t, h, "/pause"); code != http.StatusOK {
+		t.Errorf("POST /pause = %d, want %d", code, http.StatusOK)
+	}
+	if !a.Paused() {
+		t.Errorf("a.Paused() after POST /pause = false, want true")
+	}
+	if _, body := get(t, h, "/status"); !strings.Contains(body, `"paused": true`) {
+		t.Errorf("GET /status after POST /pause = %q, want paused", body)
+	}
+	if code, _ := post(t, h, "/resume"); code != http.StatusOK {
+		t.Errorf("POST /resume = %d, want %d", code, http.StatusOK)
+	}
+	if a.Paused() {
+		t.Errorf("a.Paused() after POST /resume = true, want false")
+	}
+}
@@ -1,13 +1,44 @@
 package backend
 
-import "github.com/buildkite/buildkite-agent-metrics/v5/collector"
+import (
+	"context"
+	"log/slog"
+
+	"github.com/buildkite/buildkite-agent-metrics/v5/collector"
+	"github.com/buildkite/buildkite-agent-metrics/v5/logging"
+)
+
+// logger returns the logger for the named kind of backend.
+func logger(backend string) *slog.Logger {
+	return slog.Default().With(logging.BackendKey, backend)
+}
 
 // Backend is a receiver of metrics
 type Backend interface {
 	Collect(r *collector.Result) error
 }
 
+// ContextBackend is a Backend whose collection can be bound to a context, so
+// that cancellation or a deadline aborts any in-flight calls it makes.
+type ContextBackend interface {
+	Backend
+	CollectContext(ctx context.Context, r *collector.Result) error
+}
+
 // Closer is an interface for backends that need to dispose of resources
 type Closer interface {
 	Close() error
 }
+
+// CollectContext sends a result to a backend, passing ctx through if the
+// backend implements ContextBackend. Backends that do not accept a context are
+// only called if ctx is not already done.
+func CollectContext(ctx context.Context, b Backend, r *collector.Result) error {
+	if cb, ok := b.(ContextBackend); ok {
+		return cb.CollectContext(ctx, r)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.Collect(r)
+}
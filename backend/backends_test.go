@@ -0,0 +1,39 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/buildkite/buildkite-agent-metrics/v5/collector"
+)
+
+type recordingBackend struct {
+	results []*collector.Result
+}
+
+func (b *recordingBackend) Collect(r *collector.Result) error {
+	b.results = append(b.results, r)
+	return nil
+}
+
+func TestCollectContextFallsBackToCollect(t *testing.T) {
+	b := &recordingBackend{}
+	r := &collector.Result{Org: "test"}
+
+	if err := CollectContext(context.Background(), b, r); err != nil {
+		t.Fatalf("CollectContext() = %v", err)
+	}
+	if got, want := len(b.results), 1; got != want {
+		t.Fatalf("len(b.results) = %d, want %d", got, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := CollectContext(ctx, b, r); !errors.Is(err, context.Canceled) {
+		t.Errorf("CollectContext(cancelled ctx) = %v, want %v", err, context.Canceled)
+	}
+	if got, want := len(b.results), 1; got != want {
+		t.Errorf("len(b.results) = %d, want %d (backend called after cancellation)", got, want)
+	}
+}
@@ -3,7 +3,6 @@ package backend
 import (
 	"context"
 	"fmt"
-	"log"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -59,7 +58,11 @@ func NewCloudWatchBackend(region string, dimensions []CloudWatchDimension, inter
 }
 
 func (cb *CloudWatchBackend) Collect(r *collector.Result) error {
-	ctx := context.TODO()
+	return cb.CollectContext(context.Background(), r)
+}
+
+// CollectContext implements the ContextBackend interface
+func (cb *CloudWatchBackend) CollectContext(ctx context.Context, r *collector.Result) error {
 	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(cb.region))
 	if err != nil {
 		return err
@@ -86,7 +89,7 @@ func (cb *CloudWatchBackend) Collect(r *collector.Result) error {
 
 	// Add custom dimension if provided
 	for _, d := range cb.dimensions {
-		log.Printf("Using custom Cloudwatch dimension of [ %s = %s ]", d.Key, d.Value)
+		logger("cloudwatch").Debug("Using custom dimension", "dimension", d.Key, "value", d.Value)
 
 		dimensions = append(dimensions, types.Dimension{
 			Name: aws.String(d.Key), Value: aws.String(d.Value),
@@ -96,23 +99,31 @@ func (cb *CloudWatchBackend) Collect(r *collector.Result) error {
 	// Add total metrics
 	metrics = append(metrics, cb.cloudwatchMetrics(r.Totals, nil)...)
 
-	for name, c := range r.Queues {
-		queueDimensions := append([]types.Dimension(nil), dimensions...)
+	// Add self metrics, under the org dimensions so that each token's
+	// collector can be told apart
+	metrics = append(metrics, cb.cloudwatchMetrics(r.SelfMetrics, dimensions)...)
 
-		// Add an queue dimension
-		queueDimensions = append(queueDimensions,
-			types.Dimension{Name: aws.String("Queue"), Value: aws.String(name)},
-		)
+	// Every queue has a QueueCollectionFailed metric, which is all that
+	// queues whose metrics could not be collected have
+	for _, queues := range []map[string]map[string]int{r.Queues, r.QueueCollectionStatus()} {
+		for name, c := range queues {
+			queueDimensions := append([]types.Dimension(nil), dimensions...)
 
-		// Add per-queue metrics
-		metrics = append(metrics, cb.cloudwatchMetrics(c, queueDimensions)...)
+			// Add an queue dimension
+			queueDimensions = append(queueDimensions,
+				types.Dimension{Name: aws.String("Queue"), Value: aws.String(name)},
+			)
+
+			// Add per-queue metrics
+			metrics = append(metrics, cb.cloudwatchMetrics(c, queueDimensions)...)
+		}
 	}
 
-	log.Printf("Extracted %d cloudwatch metrics from results", len(metrics))
+	logger("cloudwatch").Debug("Extracted metrics from results", "count", len(metrics))
 
 	// Chunk into batches of 10 metrics
 	for _, chunk := range chunkCloudwatchMetrics(10, metrics) {
-		log.Printf("Submitting chunk of %d metrics to Cloudwatch", len(chunk))
+		logger("cloudwatch").Debug("Submitting chunk of metrics", "count", len(chunk))
 		_, err := svc.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{
 			MetricData: chunk,
 			Namespace:  aws.String("Buildkite"),
@@ -142,7 +153,7 @@ func (cb *CloudWatchBackend) cloudwatchMetrics(counts map[string]int, dimensions
 			MetricName:        aws.String(k),
 			Dimensions:        dimensions,
 			Value:             aws.Float64(float64(v)),
-			Unit:              types.StandardUnitCount,
+			Unit:              cloudwatchUnit(metricInfo(k).Unit),
 			StorageResolution: aws.Int32(duration),
 		})
 	}
@@ -150,6 +161,20 @@ func (cb *CloudWatchBackend) cloudwatchMetrics(counts map[string]int, dimensions
 	return m
 }
 
+// cloudwatchUnit returns the CloudWatch unit for a metric unit.
+func cloudwatchUnit(u collector.Unit) types.StandardUnit {
+	switch u {
+	case collector.UnitPercent:
+		return types.StandardUnitPercent
+	case collector.UnitSeconds:
+		return types.StandardUnitSeconds
+	case collector.UnitMilliseconds:
+		return types.StandardUnitMilliseconds
+	default:
+		return types.StandardUnitCount
+	}
+}
+
 func chunkCloudwatchMetrics(size int, data []types.MetricDatum) [][]types.MetricDatum {
 	var chunks = [][]types.MetricDatum{}
 	for i := 0; i < len(data); i += size {
@@ -3,6 +3,10 @@ package backend
 import (
 	"reflect"
 	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/buildkite/buildkite-agent-metrics/v5/collector"
 )
 
 func TestParseCloudWatchDimensions(t *testing.T) {
@@ -28,3 +32,27 @@ func TestParseCloudWatchDimensions(t *testing.T) {
 		})
 	}
 }
+
+func TestCloudWatchMetricsUnits(t *testing.T) {
+	cb := NewCloudWatchBackend("us-east-1", nil, 60, false)
+
+	counts := map[string]int{
+		collector.BusyAgentPercentage: 50,
+		collector.BusyAgentCount:      2,
+		"AssignedJobsCount":           1, // not registered
+	}
+
+	got := make(map[string]types.StandardUnit)
+	for _, m := range cb.cloudwatchMetrics(counts, nil) {
+		got[aws.ToString(m.MetricName)] = m.Unit
+	}
+
+	want := map[string]types.StandardUnit{
+		collector.BusyAgentPercentage: types.StandardUnitPercent,
+		collector.BusyAgentCount:      types.StandardUnitCount,
+		"AssignedJobsCount":           types.StandardUnitCount,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("units = %v, want %v", got, want)
+	}
+}
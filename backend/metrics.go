@@ -0,0 +1,114 @@
+package backend
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-metrics/v5/collector"
+)
+
+// metricInfo returns the registered information about the named metric. Metrics
+// that aren't registered, such as those passed through from the Agent API, are
+// described as gauges counting things, with names derived from theirs.
+func metricInfo(name string) collector.MetricInfo {
+	if info, ok := collector.LookupMetric(name); ok {
+		return info
+	}
+	return collector.MetricInfo{
+		Name:              name,
+		Description:       "Buildkite metric: " + name,
+		Unit:              collector.UnitCount,
+		Kind:              collector.KindGauge,
+		PrometheusName:    camelToUnderscore(name),
+		OpenTelemetryName: otelMetricName(name),
+	}
+}
+
+// otelMetricName returns the OpenTelemetry name for a metric that isn't
+// registered, following the buildkite.jobs.* and buildkite.agents.* names of
+// the registered ones where the metric's name allows.
+func otelMetricName(name string) string {
+	if prefix, ok := strings.CutSuffix(name, "JobsCount"); ok && prefix != "" {
+		return "buildkite.jobs." + camelToUnderscore(prefix)
+	}
+	if prefix, ok := strings.CutSuffix(name, "AgentCount"); ok && prefix != "" {
+		return "buildkite.agents." + camelToUnderscore(prefix)
+	}
+	return "buildkite." + camelToUnderscore(name)
+}
+
+// counterDeltas turns the running totals of counter metrics into increments,
+// for backends whose counters can only be added to. Each series is identified
+// by a key, which should include the metric name and any labels.
+type counterDeltas struct {
+	mu   sync.Mutex
+	last map[string]int
+}
+
+// delta returns how much the series identified by key has increased since the
+// last call. The first value seen for a series counts in full, as does a value
+// lower than the last one, which means whatever reported it restarted.
+func (c *counterDeltas) delta(key string, value int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.last == nil {
+		c.last = make(map[string]int)
+	}
+
+	last, seen := c.last[key]
+	c.last[key] = value
+	if !seen || value < last {
+		return value
+	}
+	return value - last
+}
+
+// forget forgets the series identified by key, so that its next value counts
+// in full.
+func (c *counterDeltas) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.last, key)
+}
+
+// counterStarts tracks when each series of a counter metric started counting,
+// for backends that are sent running totals along with the time they count
+// from. Each series is identified by a key, which should include the metric
+// name and any labels.
+type counterStarts struct {
+	mu     sync.Mutex
+	series map[string]counterSeries
+}
+
+type counterSeries struct {
+	start, last time.Time
+	value       int
+}
+
+// start returns when the series identified by key started counting, given its
+// value at now. A series starts at created, such as when the backend was
+// created, unless its value goes down, which means whatever reported it
+// restarted, sometime after its last value. It then starts again just after
+// the last value.
+func (c *counterStarts) start(key string, value int, created, now time.Time) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.series == nil {
+		c.series = make(map[string]counterSeries)
+	}
+
+	s, seen := c.series[key]
+	switch {
+	case !seen:
+		s.start = created
+	case value < s.value:
+		s.start = s.last.Add(time.Millisecond)
+	}
+	s.last, s.value = now, value
+	c.series[key] = s
+	return s.start
+}
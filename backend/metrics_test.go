@@ -0,0 +1,83 @@
+package backend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-metrics/v5/collector"
+)
+
+// registerTestMetric registers info for the rest of the test, so that it isn't
+// seen by backends created in other tests.
+func registerTestMetric(t *testing.T, info collector.MetricInfo) {
+	t.Helper()
+	collector.RegisterMetric(info)
+	t.Cleanup(func() { collector.UnregisterMetric(info.Name) })
+}
+
+func TestCounterDeltas(t *testing.T) {
+	var d counterDeltas
+
+	steps := []struct {
+		key   string
+		value int
+		want  int
+	}{
+		{"a", 5, 5}, // first value counts in full
+		{"a", 8, 3},
+		{"b", 2, 2}, // keys are independent
+		{"a", 8, 0},
+		{"a", 1, 1}, // reset
+		{"a", 4, 3},
+	}
+
+	for _, s := range steps {
+		if got := d.delta(s.key, s.value); got != s.want {
+			t.Errorf("d.delta(%q, %d) = %d, want %d", s.key, s.value, got, s.want)
+		}
+	}
+}
+
+func TestCounterStarts(t *testing.T) {
+	var c counterStarts
+	created := time.Unix(1000, 0)
+	at := func(s int64) time.Time { return time.Unix(s, 0) }
+
+	steps := []struct {
+		key   string
+		value int
+		now   time.Time
+		want  time.Time
+	}{
+		{"a", 5, at(1060), created}, // first value counts from creation
+		{"a", 8, at(1120), created},
+		{"b", 2, at(1120), created},                        // keys are independent
+		{"a", 1, at(1180), at(1120).Add(time.Millisecond)}, // reset
+		{"a", 4, at(1240), at(1120).Add(time.Millisecond)},
+		{"b", 2, at(1240), created},
+	}
+
+	for _, s := range steps {
+		if got := c.start(s.key, s.value, created, s.now); !got.Equal(s.want) {
+			t.Errorf("c.start(%q, %d, created, %v) = %v, want %v", s.key, s.value, s.now.Unix(), got, s.want)
+		}
+	}
+}
+
+func TestMetricInfo(t *testing.T) {
+	if got, want := metricInfo(collector.BusyAgentPercentage).Unit, collector.UnitPercent; got != want {
+		t.Errorf("metricInfo(BusyAgentPercentage).Unit = %q, want %q", got, want)
+	}
+
+	// Metrics that aren't registered get names derived from theirs.
+	info := metricInfo("StaleConnectedAgentCount")
+	if got, want := info.PrometheusName, "stale_connected_agent_count"; got != want {
+		t.Errorf("PrometheusName = %q, want %q", got, want)
+	}
+	if got, want := info.OpenTelemetryName, "buildkite.agents.stale_connected"; got != want {
+		t.Errorf("OpenTelemetryName = %q, want %q", got, want)
+	}
+	if got, want := info.Kind, collector.KindGauge; got != want {
+		t.Errorf("Kind = %v, want %v", got, want)
+	}
+}
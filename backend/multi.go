@@ -0,0 +1,113 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-metrics/v5/collector"
+)
+
+// MultiTarget is one of the backends a Multi sends results to.
+type MultiTarget struct {
+	// Name identifies the backend in errors.
+	Name    string
+	Backend Backend
+
+	// Timeout limits how long sending a result to the backend can take.
+	// Zero means no limit beyond the context's.
+	Timeout time.Duration
+}
+
+// Multi is a Backend that sends each result to several backends at once, such
+// as to migrate from one to another. The backends are isolated from each
+// other: one that fails, panics or times out doesn't stop the others from
+// being sent the result. A backend that is still being sent an earlier result,
+// after timing out, is skipped until that has returned.
+type Multi struct {
+	targets []MultiTarget
+
+	// inFlight is whether each target is still being sent a result.
+	inFlight []atomic.Bool
+}
+
+// NewMulti returns a Multi that sends results to targets.
+func NewMulti(targets ...MultiTarget) *Multi {
+	return &Multi{targets: targets, inFlight: make([]atomic.Bool, len(targets))}
+}
+
+// Collect sends r to each backend, returning the errors of any that failed.
+func (m *Multi) Collect(r *collector.Result) error {
+	return m.CollectContext(context.Background(), r)
+}
+
+// CollectContext sends r to each backend concurrently, passing ctx through,
+// and returns the errors of any that failed once all of them have finished or
+// timed out.
+func (m *Multi) CollectContext(ctx context.Context, r *collector.Result) error {
+	errs := make([]error, len(m.targets))
+
+	var wg sync.WaitGroup
+	for i, t := range m.targets {
+		if !m.inFlight[i].CompareAndSwap(false, true) {
+			logger(t.Name).Warn("Skipping backend, it is still being sent an earlier result")
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := collectTarget(ctx, t, r, &m.inFlight[i]); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", t.Name, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// collectTarget sends r to t.Backend, giving up once t.Timeout has passed.
+// Backends that don't stop when their context is done are left to finish in
+// the background, and inFlight is cleared once they have.
+func collectTarget(ctx context.Context, t MultiTarget, r *collector.Result, inFlight *atomic.Bool) error {
+	if t.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.Timeout)
+		defer cancel()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer inFlight.Store(false)
+		defer func() {
+			if p := recover(); p != nil {
+				done <- fmt.Errorf("panic: %v", p)
+			}
+		}()
+		done <- CollectContext(ctx, t.Backend, r)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close closes each backend that is a Closer, returning the errors of any
+// that failed.
+func (m *Multi) Close() error {
+	var errs []error
+	for _, t := range m.targets {
+		if c, ok := t.Backend.(Closer); ok {
+			if err := c.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", t.Name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
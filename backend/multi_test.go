@@ -0,0 +1,125 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-metrics/v5/collector"
+)
+
+type funcBackend func(r *collector.Result) error
+
+func (f funcBackend) Collect(r *collector.Result) error {
+	return f(r)
+}
+
+type closingBackend struct {
+	recordingBackend
+	closed bool
+	err    error
+}
+
+func (b *closingBackend) Close() error {
+	b.closed = true
+	return b.err
+}
+
+func TestMultiIsolatesBackends(t *testing.T) {
+	ok := &recordingBackend{}
+	errFailed := errors.New("unavailable")
+	block := make(chan struct{})
+	defer close(block)
+
+	m := NewMulti(
+		MultiTarget{Name: "ok", Backend: ok},
+		MultiTarget{Name: "failing", Backend: funcBackend(func(*collector.Result) error {
+			return errFailed
+		})},
+		MultiTarget{Name: "panicking", Backend: funcBackend(func(*collector.Result) error {
+			panic("oops")
+		})},
+		MultiTarget{Name: "slow", Timeout: 10 * time.Millisecond, Backend: funcBackend(func(*collector.Result) error {
+			<-block
+			return nil
+		})},
+	)
+
+	err := m.CollectContext(context.Background(), &collector.Result{Org: "test"})
+	if got, want := len(ok.results), 1; got != want {
+		t.Errorf("len(ok.results) = %d, want %d", got, want)
+	}
+	if !errors.Is(err, errFailed) {
+		t.Errorf("m.CollectContext() = %v, want it to wrap %v", err, errFailed)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("m.CollectContext() = %v, want it to wrap %v", err, context.DeadlineExceeded)
+	}
+	for _, want := range []string{"failing: unavailable", "panicking: panic: oops", "slow: context deadline exceeded"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("m.CollectContext() = %q, want it to contain %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "ok:") {
+		t.Errorf("m.CollectContext() = %q, want no error for the ok backend", err)
+	}
+}
+
+func TestMultiSkipsBackendStillInFlight(t *testing.T) {
+	block := make(chan struct{})
+	returned := make(chan struct{})
+	var calls atomic.Int32
+	m := NewMulti(MultiTarget{Name: "hanging", Timeout: 10 * time.Millisecond, Backend: funcBackend(func(*collector.Result) error {
+		defer func() { returned <- struct{}{} }()
+		calls.Add(1)
+		<-block
+		return nil
+	})})
+
+	if err := m.CollectContext(context.Background(), &collector.Result{Org: "test"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("m.CollectContext() = %v, want it to wrap %v", err, context.DeadlineExceeded)
+	}
+
+	// While the first call hangs, the backend isn't called again
+	if err := m.CollectContext(context.Background(), &collector.Result{Org: "test"}); err != nil {
+		t.Errorf("m.CollectContext() while in flight = %v, want nil", err)
+	}
+	if got, want := calls.Load(), int32(1); got != want {
+		t.Errorf("calls while in flight = %d, want %d", got, want)
+	}
+
+	// Once it has returned, the backend is called again
+	block <- struct{}{}
+	<-returned
+	for m.inFlight[0].Load() {
+		time.Sleep(time.Millisecond)
+	}
+	close(block)
+	_ = m.CollectContext(context.Background(), &collector.Result{Org: "test"})
+	<-returned
+	if got, want := calls.Load(), int32(2); got != want {
+		t.Errorf("calls after returning = %d, want %d", got, want)
+	}
+}
+
+func TestMultiClose(t *testing.T) {
+	errClose := errors.New("close failed")
+	a := &closingBackend{}
+	b := &closingBackend{err: errClose}
+
+	m := NewMulti(
+		MultiTarget{Name: "a", Backend: a},
+		MultiTarget{Name: "b", Backend: b},
+		MultiTarget{Name: "not a closer", Backend: &recordingBackend{}},
+	)
+
+	if err := m.Close(); !errors.Is(err, errClose) {
+		t.Errorf("m.Close() = %v, want it to wrap %v", err, errClose)
+	}
+	if !a.closed || !b.closed {
+		t.Errorf("a.closed, b.closed = %t, %t, want both closed", a.closed, b.closed)
+	}
+}
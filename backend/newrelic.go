@@ -1,7 +1,6 @@
 package backend
 
 import (
-	"log"
 	"time"
 
 	"github.com/buildkite/buildkite-agent-metrics/v5/collector"
@@ -48,9 +47,36 @@ func (nr *NewRelicBackend) Collect(r *collector.Result) error {
 		nr.client.RecordCustomEvent("queue_agent_metrics", data)
 	}
 
+	// Publish event for each queue whose metrics could not be collected
+	for queue, metrics := range r.FailedQueues() {
+		data := toCustomEvent(r.Cluster, queue, metrics)
+		nr.client.RecordCustomEvent("BuildkiteQueueMetrics", data)
+		nr.client.RecordCustomEvent("queue_agent_metrics", data)
+	}
+
+	// Publish an event with the metrics about the collector itself
+	if len(r.SelfMetrics) > 0 {
+		nr.client.RecordCustomEvent("BuildkiteAgentMetrics", toSelfEvent(r.Cluster, r.SelfMetrics))
+	}
+
 	return nil
 }
 
+// toSelfEvent converts the self metrics of a result to a New Relic event body
+func toSelfEvent(clusterName string, selfMetrics map[string]int) map[string]any {
+	eventData := map[string]any{}
+
+	if clusterName != "" {
+		eventData["Cluster"] = clusterName
+	}
+
+	for k, v := range selfMetrics {
+		eventData[k] = v
+	}
+
+	return eventData
+}
+
 // toCustomEvent converts a map of metrics to a valid New Relic event body
 func toCustomEvent(clusterName, queueName string, queueMetrics map[string]int) map[string]any {
 	eventData := map[string]any{
@@ -71,7 +97,7 @@ func toCustomEvent(clusterName, queueName string, queueMetrics map[string]int) m
 // Close by shutting down NR client
 func (nr *NewRelicBackend) Close() error {
 	nr.client.Shutdown(newRelicConnectionTimeout)
-	log.Printf("Disposed New Relic client")
+	logger("newrelic").Info("Disposed New Relic client")
 
 	return nil
 }
@@ -3,11 +3,12 @@ package backend
 import (
 	"context"
 	"fmt"
-	"log"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/buildkite/buildkite-agent-metrics/v5/collector"
+	"github.com/buildkite/buildkite-agent-metrics/v5/logging"
 	"github.com/buildkite/buildkite-agent-metrics/v5/version"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
@@ -28,16 +29,19 @@ type OpenTelemetryBackend struct {
 	tracer trace.Tracer
 	meter  metric.Meter
 
-	// Metrics instruments
-	scheduledJobsGauge    metric.Int64Gauge
-	runningJobsGauge      metric.Int64Gauge
-	unfinishedJobsGauge   metric.Int64Gauge
-	waitingJobsGauge      metric.Int64Gauge
-	idleAgentsGauge       metric.Int64Gauge
-	busyAgentsGauge       metric.Int64Gauge
-	totalAgentsGauge      metric.Int64Gauge
-	busyAgentPercentGauge metric.Int64Gauge
-	collectionDuration    metric.Float64Histogram
+	// Metrics instruments, by collector metric name. Those for registered
+	// metrics are created up front, and others when first seen.
+	instrumentsMu      sync.Mutex
+	gauges             map[string]metric.Int64ObservableGauge
+	counters           map[string]metric.Int64Counter
+	counterDeltas      counterDeltas
+	collectionDuration metric.Float64Histogram
+
+	// Gauges are observed rather than recorded, so that the values of stale
+	// metrics can be dropped instead of being exported forever. observed
+	// holds the last value of each gauge, by metric name and attributes.
+	observedMu sync.Mutex
+	observed   map[string]map[attribute.Distinct]otelObservation
 
 	shutdown func()
 }
@@ -101,7 +105,7 @@ func NewOpenTelemetryBackend() (*OpenTelemetryBackend, error) {
 	}
 	if err != nil {
 		if shutdownErr := tracerProvider.Shutdown(ctx); shutdownErr != nil {
-			log.Printf("failed to shutdown tracer provider: %v", shutdownErr)
+			logger("opentelemetry").Error("Failed to shut down tracer provider", logging.Err(shutdownErr))
 		}
 		return nil, fmt.Errorf("failed to create metric exporter: %w", err)
 	}
@@ -125,10 +129,10 @@ func NewOpenTelemetryBackend() (*OpenTelemetryBackend, error) {
 		ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
 		defer cancel()
 		if err := tracerProvider.Shutdown(ctx); err != nil {
-			log.Printf("failed to shutdown tracer provider: %v", err)
+			logger("opentelemetry").Error("Failed to shut down tracer provider", logging.Err(err))
 		}
 		if err := meterProvider.Shutdown(ctx); err != nil {
-			log.Printf("failed to shutdown meter provider: %v", err)
+			logger("opentelemetry").Error("Failed to shut down meter provider", logging.Err(err))
 		}
 	}
 
@@ -142,7 +146,7 @@ func NewOpenTelemetryBackend() (*OpenTelemetryBackend, error) {
 	}
 	backend.shutdown = otelShutdown
 
-	log.Println("OpenTelemetry backend initialized successfully")
+	logger("opentelemetry").Info("OpenTelemetry backend initialized successfully")
 	return backend, nil
 }
 
@@ -151,8 +155,11 @@ func NewOpenTelemetryBackend() (*OpenTelemetryBackend, error) {
 // supply an in-memory meter.
 func newOpenTelemetryBackend(tracer trace.Tracer, meter metric.Meter) (*OpenTelemetryBackend, error) {
 	backend := &OpenTelemetryBackend{
-		tracer: tracer,
-		meter:  meter,
+		tracer:   tracer,
+		meter:    meter,
+		gauges:   make(map[string]metric.Int64ObservableGauge),
+		counters: make(map[string]metric.Int64Counter),
+		observed: make(map[string]map[attribute.Distinct]otelObservation),
 	}
 	if err := backend.initializeMetrics(); err != nil {
 		return nil, fmt.Errorf("error initializing metrics: %w", err)
@@ -163,68 +170,10 @@ func newOpenTelemetryBackend(tracer trace.Tracer, meter metric.Meter) (*OpenTele
 func (b *OpenTelemetryBackend) initializeMetrics() error {
 	var err error
 
-	b.scheduledJobsGauge, err = b.meter.Int64Gauge(
-		"buildkite.jobs.scheduled",
-		metric.WithDescription("Number of scheduled jobs"),
-	)
-	if err != nil {
-		return err
-	}
-
-	b.runningJobsGauge, err = b.meter.Int64Gauge(
-		"buildkite.jobs.running",
-		metric.WithDescription("Number of running jobs"),
-	)
-	if err != nil {
-		return err
-	}
-
-	b.unfinishedJobsGauge, err = b.meter.Int64Gauge(
-		"buildkite.jobs.unfinished",
-		metric.WithDescription("Number of unfinished jobs"),
-	)
-	if err != nil {
-		return err
-	}
-
-	b.waitingJobsGauge, err = b.meter.Int64Gauge(
-		"buildkite.jobs.waiting",
-		metric.WithDescription("Number of waiting jobs"),
-	)
-	if err != nil {
-		return err
-	}
-
-	b.idleAgentsGauge, err = b.meter.Int64Gauge(
-		"buildkite.agents.idle",
-		metric.WithDescription("Number of idle agents"),
-	)
-	if err != nil {
-		return err
-	}
-
-	b.busyAgentsGauge, err = b.meter.Int64Gauge(
-		"buildkite.agents.busy",
-		metric.WithDescription("Number of busy agents"),
-	)
-	if err != nil {
-		return err
-	}
-
-	b.totalAgentsGauge, err = b.meter.Int64Gauge(
-		"buildkite.agents.total",
-		metric.WithDescription("Total number of agents"),
-	)
-	if err != nil {
-		return err
-	}
-
-	b.busyAgentPercentGauge, err = b.meter.Int64Gauge(
-		"buildkite.agents.busy_percentage",
-		metric.WithDescription("Percentage of busy agents"),
-	)
-	if err != nil {
-		return err
+	for _, info := range collector.RegisteredMetrics() {
+		if err := b.createInstrument(info); err != nil {
+			return err
+		}
 	}
 
 	b.collectionDuration, err = b.meter.Float64Histogram(
@@ -241,7 +190,11 @@ func (b *OpenTelemetryBackend) initializeMetrics() error {
 
 // Collect implements the Backend interface
 func (b *OpenTelemetryBackend) Collect(r *collector.Result) error {
-	ctx := context.TODO()
+	return b.CollectContext(context.Background(), r)
+}
+
+// CollectContext implements the ContextBackend interface
+func (b *OpenTelemetryBackend) CollectContext(ctx context.Context, r *collector.Result) error {
 	start := time.Now()
 
 	// Start tracing span for this collection
@@ -260,30 +213,21 @@ func (b *OpenTelemetryBackend) Collect(r *collector.Result) error {
 		attribute.String("cluster", r.Cluster),
 	}
 
-	// Record total metrics
-	if val, ok := r.Totals["ScheduledJobsCount"]; ok {
-		b.scheduledJobsGauge.Record(ctx, int64(val), metric.WithAttributes(commonAttrs...))
-	}
-	if val, ok := r.Totals["RunningJobsCount"]; ok {
-		b.runningJobsGauge.Record(ctx, int64(val), metric.WithAttributes(commonAttrs...))
-	}
-	if val, ok := r.Totals["UnfinishedJobsCount"]; ok {
-		b.unfinishedJobsGauge.Record(ctx, int64(val), metric.WithAttributes(commonAttrs...))
-	}
-	if val, ok := r.Totals["WaitingJobsCount"]; ok {
-		b.waitingJobsGauge.Record(ctx, int64(val), metric.WithAttributes(commonAttrs...))
+	// Stale metrics are no longer observed, so they are absent rather than
+	// stuck at their last values
+	if r.Stale {
+		b.dropObserved(r.Org, r.Cluster)
+		span.AddEvent("metrics_stale")
 	}
-	if val, ok := r.Totals["IdleAgentCount"]; ok {
-		b.idleAgentsGauge.Record(ctx, int64(val), metric.WithAttributes(commonAttrs...))
-	}
-	if val, ok := r.Totals["BusyAgentCount"]; ok {
-		b.busyAgentsGauge.Record(ctx, int64(val), metric.WithAttributes(commonAttrs...))
-	}
-	if val, ok := r.Totals["TotalAgentCount"]; ok {
-		b.totalAgentsGauge.Record(ctx, int64(val), metric.WithAttributes(commonAttrs...))
+
+	// Record total metrics
+	for name, val := range r.Totals {
+		b.record(ctx, name, val, commonAttrs)
 	}
-	if val, ok := r.Totals["BusyAgentPercentage"]; ok {
-		b.busyAgentPercentGauge.Record(ctx, int64(val), metric.WithAttributes(commonAttrs...))
+
+	// Record self metrics
+	for name, val := range r.SelfMetrics {
+		b.record(ctx, name, val, commonAttrs)
 	}
 
 	// Record per-queue metrics and collect data for events
@@ -292,48 +236,20 @@ func (b *OpenTelemetryBackend) Collect(r *collector.Result) error {
 	for queueName, queueMetrics := range r.Queues {
 		queueAttrs := append(commonAttrs, attribute.String("queue", queueName))
 
-		// Extract values for logging
-		scheduledJobs := int64(0)
-		runningJobs := int64(0)
-		unfinishedJobs := int64(0)
-		waitingJobs := int64(0)
-		idleAgents := int64(0)
-		busyAgents := int64(0)
-		totalAgents := int64(0)
-		busyPercentage := int64(0)
-
-		if val, ok := queueMetrics["ScheduledJobsCount"]; ok {
-			scheduledJobs = int64(val)
-			b.scheduledJobsGauge.Record(ctx, scheduledJobs, metric.WithAttributes(queueAttrs...))
-		}
-		if val, ok := queueMetrics["RunningJobsCount"]; ok {
-			runningJobs = int64(val)
-			b.runningJobsGauge.Record(ctx, runningJobs, metric.WithAttributes(queueAttrs...))
-		}
-		if val, ok := queueMetrics["UnfinishedJobsCount"]; ok {
-			unfinishedJobs = int64(val)
-			b.unfinishedJobsGauge.Record(ctx, unfinishedJobs, metric.WithAttributes(queueAttrs...))
-		}
-		if val, ok := queueMetrics["WaitingJobsCount"]; ok {
-			waitingJobs = int64(val)
-			b.waitingJobsGauge.Record(ctx, waitingJobs, metric.WithAttributes(queueAttrs...))
-		}
-		if val, ok := queueMetrics["IdleAgentCount"]; ok {
-			idleAgents = int64(val)
-			b.idleAgentsGauge.Record(ctx, idleAgents, metric.WithAttributes(queueAttrs...))
-		}
-		if val, ok := queueMetrics["BusyAgentCount"]; ok {
-			busyAgents = int64(val)
-			b.busyAgentsGauge.Record(ctx, busyAgents, metric.WithAttributes(queueAttrs...))
-		}
-		if val, ok := queueMetrics["TotalAgentCount"]; ok {
-			totalAgents = int64(val)
-			b.totalAgentsGauge.Record(ctx, totalAgents, metric.WithAttributes(queueAttrs...))
-		}
-		if val, ok := queueMetrics["BusyAgentPercentage"]; ok {
-			busyPercentage = int64(val)
-			b.busyAgentPercentGauge.Record(ctx, busyPercentage, metric.WithAttributes(queueAttrs...))
+		for name, val := range queueMetrics {
+			b.record(ctx, name, val, queueAttrs)
 		}
+		b.record(ctx, collector.QueueCollectionFailed, 0, queueAttrs)
+
+		// Extract values for logging
+		scheduledJobs := int64(queueMetrics[collector.ScheduledJobsCount])
+		runningJobs := int64(queueMetrics[collector.RunningJobsCount])
+		unfinishedJobs := int64(queueMetrics[collector.UnfinishedJobsCount])
+		waitingJobs := int64(queueMetrics[collector.WaitingJobsCount])
+		idleAgents := int64(queueMetrics[collector.IdleAgentCount])
+		busyAgents := int64(queueMetrics[collector.BusyAgentCount])
+		totalAgents := int64(queueMetrics[collector.TotalAgentCount])
+		busyPercentage := int64(queueMetrics[collector.BusyAgentPercentage])
 
 		// Store queue data for event logging
 		queueEvents = append(queueEvents, map[string]any{
@@ -348,10 +264,19 @@ func (b *OpenTelemetryBackend) Collect(r *collector.Result) error {
 			"busy_pct":   busyPercentage,
 		})
 
-		// Print to logs for local debugging
-		log.Printf("Queue '%s': Scheduled=%d, Running=%d, Unfinished=%d, Waiting=%d, Idle=%d, Busy=%d, Total=%d, Busy%%=%d",
-			queueName, scheduledJobs, runningJobs, unfinishedJobs, waitingJobs,
-			idleAgents, busyAgents, totalAgents, busyPercentage)
+		// Log for local debugging
+		logger("opentelemetry").Debug("Recorded queue metrics",
+			logging.OrgKey, r.Org, logging.ClusterKey, r.Cluster, logging.QueueKey, queueName,
+			"scheduled", scheduledJobs, "running", runningJobs, "unfinished", unfinishedJobs, "waiting", waitingJobs,
+			"idle", idleAgents, "busy", busyAgents, "total", totalAgents, "busy_pct", busyPercentage)
+	}
+
+	// Flag queues whose metrics could not be collected
+	for queueName, err := range r.QueueErrors {
+		queueAttrs := append(commonAttrs, attribute.String("queue", queueName))
+		b.record(ctx, collector.QueueCollectionFailed, 1, queueAttrs)
+		logger("opentelemetry").Debug("Recorded queue collection failure",
+			logging.OrgKey, r.Org, logging.ClusterKey, r.Cluster, logging.QueueKey, queueName, logging.Err(err))
 	}
 
 	// Record collection duration
@@ -395,6 +320,114 @@ func (b *OpenTelemetryBackend) Collect(r *collector.Result) error {
 	return nil
 }
 
+// createInstrument creates the instrument for a metric, according to its kind.
+func (b *OpenTelemetryBackend) createInstrument(info collector.MetricInfo) error {
+	desc := metric.WithDescription(info.Description)
+	unit := metric.WithUnit(otelUnit(info.Unit))
+
+	switch info.Kind {
+	case collector.KindCounter:
+		counter, err := b.meter.Int64Counter(info.OpenTelemetryName, desc, unit)
+		if err != nil {
+			return err
+		}
+		b.counters[info.Name] = counter
+
+	default:
+		name := info.Name
+		gauge, err := b.meter.Int64ObservableGauge(info.OpenTelemetryName, desc, unit,
+			metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+				b.observedMu.Lock()
+				defer b.observedMu.Unlock()
+				for _, obs := range b.observed[name] {
+					o.Observe(obs.value, metric.WithAttributeSet(obs.attrs))
+				}
+				return nil
+			}),
+		)
+		if err != nil {
+			return err
+		}
+		b.gauges[info.Name] = gauge
+	}
+	return nil
+}
+
+// otelObservation is the last value of a gauge with some attributes.
+type otelObservation struct {
+	attrs attribute.Set
+	value int64
+}
+
+// observe sets the value of the named gauge with attrs, to be reported when
+// metrics are next read.
+func (b *OpenTelemetryBackend) observe(name string, value int, attrs attribute.Set) {
+	b.observedMu.Lock()
+	defer b.observedMu.Unlock()
+
+	if b.observed[name] == nil {
+		b.observed[name] = make(map[attribute.Distinct]otelObservation)
+	}
+	b.observed[name][attrs.Equivalent()] = otelObservation{attrs: attrs, value: int64(value)}
+}
+
+// dropObserved stops reporting the gauges for org and cluster, including those
+// for each queue.
+func (b *OpenTelemetryBackend) dropObserved(org, cluster string) {
+	b.observedMu.Lock()
+	defer b.observedMu.Unlock()
+
+	for _, observations := range b.observed {
+		for key, obs := range observations {
+			gotOrg, _ := obs.attrs.Value("org")
+			gotCluster, _ := obs.attrs.Value("cluster")
+			if gotOrg.AsString() == org && gotCluster.AsString() == cluster {
+				delete(observations, key)
+			}
+		}
+	}
+}
+
+// record records the value of the named metric. Counters are given the
+// increase since the last value recorded with the same attributes.
+func (b *OpenTelemetryBackend) record(ctx context.Context, name string, value int, attrs []attribute.KeyValue) {
+	b.instrumentsMu.Lock()
+	_, isGauge := b.gauges[name]
+	_, isCounter := b.counters[name]
+	if !isGauge && !isCounter {
+		if err := b.createInstrument(metricInfo(name)); err != nil {
+			b.instrumentsMu.Unlock()
+			logger("opentelemetry").Error("Failed to create OpenTelemetry instrument", "metric", name, logging.Err(err))
+			return
+		}
+	}
+	counter, isCounter := b.counters[name]
+	b.instrumentsMu.Unlock()
+
+	set := attribute.NewSet(attrs...)
+	if isCounter {
+		key := name + "\x00" + set.Encoded(attribute.DefaultEncoder())
+		counter.Add(ctx, int64(b.counterDeltas.delta(key, value)), metric.WithAttributeSet(set))
+		return
+	}
+	b.observe(name, value, set)
+}
+
+// otelUnit returns the UCUM unit of a collector unit. Counts have no unit, as
+// they have always been exported without one.
+func otelUnit(u collector.Unit) string {
+	switch u {
+	case collector.UnitPercent:
+		return "%"
+	case collector.UnitSeconds:
+		return "s"
+	case collector.UnitMilliseconds:
+		return "ms"
+	default:
+		return ""
+	}
+}
+
 // Close implements the Closer interface
 func (b *OpenTelemetryBackend) Close() error {
 	if b.shutdown != nil {
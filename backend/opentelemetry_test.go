@@ -158,3 +158,125 @@ func TestOpenTelemetryJobMetricsUseLastValue(t *testing.T) {
 		})
 	}
 }
+
+// TestOpenTelemetryCollectOtherMetrics checks that metrics outside
+// collector.AllMetrics, such as those passed through from the Agent API, are
+// exported under names derived from theirs.
+func TestOpenTelemetryCollectOtherMetrics(t *testing.T) {
+	b, reader := newTestOTelBackend(t)
+	r := &collector.Result{
+		Cluster: "test_cluster",
+		Totals:  map[string]int{"AssignedJobsCount": 2},
+		Queues: map[string]map[string]int{
+			"default": {"AssignedJobsCount": 1, "StaleConnectedAgentCount": 3},
+		},
+	}
+	if err := b.Collect(r); err != nil {
+		t.Fatalf("Collect() = %v", err)
+	}
+
+	assigned := gaugePoints(t, reader, "buildkite.jobs.assigned")
+	if got, want := assigned[""].Value, int64(2); got != want {
+		t.Errorf("buildkite.jobs.assigned total = %d, want %d", got, want)
+	}
+	if got, want := assigned["default"].Value, int64(1); got != want {
+		t.Errorf("buildkite.jobs.assigned for default = %d, want %d", got, want)
+	}
+
+	stale := gaugePoints(t, reader, "buildkite.agents.stale_connected")
+	if got, want := stale["default"].Value, int64(3); got != want {
+		t.Errorf("buildkite.agents.stale_connected for default = %d, want %d", got, want)
+	}
+}
+
+// TestOpenTelemetryCounter checks that counter metrics, whose values are
+// running totals, are exported as monotonic sums that survive a reset.
+func TestOpenTelemetryCounter(t *testing.T) {
+	registerTestMetric(t, collector.MetricInfo{
+		Name:              "OpenTelemetryTestCounter",
+		Description:       "A test counter",
+		Kind:              collector.KindCounter,
+		OpenTelemetryName: "buildkite.test.counter",
+	})
+
+	b, reader := newTestOTelBackend(t)
+	for _, v := range []int{3, 5, 2} {
+		r := &collector.Result{
+			Cluster: "test_cluster",
+			Totals:  map[string]int{"OpenTelemetryTestCounter": v},
+		}
+		if err := b.Collect(r); err != nil {
+			t.Fatalf("Collect() = %v", err)
+		}
+	}
+
+	m := collectMetric(t, reader, "buildkite.test.counter")
+	sum, ok := m.Data.(metricdata.Sum[int64])
+	if !ok || !sum.IsMonotonic {
+		t.Fatalf("metric has data %#v, want a monotonic metricdata.Sum[int64]", m.Data)
+	}
+	if len(sum.DataPoints) != 1 {
+		t.Fatalf("len(sum.DataPoints) = %d, want 1", len(sum.DataPoints))
+	}
+	if got, want := sum.DataPoints[0].Value, int64(7); got != want {
+		t.Errorf("buildkite.test.counter = %d, want %d", got, want)
+	}
+}
+
+// TestOpenTelemetryStale checks that the gauges for a stale result's cluster
+// stop being exported, rather than keeping their last values.
+func TestOpenTelemetryStale(t *testing.T) {
+	b, reader := newTestOTelBackend(t)
+	if err := b.Collect(newTestResult(t)); err != nil {
+		t.Fatalf("Collect() = %v", err)
+	}
+
+	other := &collector.Result{
+		Cluster: "other_cluster",
+		Totals:  map[string]int{collector.IdleAgentCount: 4},
+	}
+	if err := b.Collect(other); err != nil {
+		t.Fatalf("Collect() = %v", err)
+	}
+
+	stale := &collector.Result{
+		Cluster:     "test_cluster",
+		Stale:       true,
+		SelfMetrics: map[string]int{collector.AgentMetricsStale: 1},
+	}
+	if err := b.Collect(stale); err != nil {
+		t.Fatalf("Collect() = %v", err)
+	}
+
+	// Only the other cluster's total is left.
+	m := collectMetric(t, reader, "buildkite.agents.idle")
+	gauge, ok := m.Data.(metricdata.Gauge[int64])
+	if !ok {
+		t.Fatalf("metric has data type %T, want metricdata.Gauge[int64]", m.Data)
+	}
+	if len(gauge.DataPoints) != 1 {
+		t.Fatalf("len(buildkite.agents.idle data points) = %d, want 1", len(gauge.DataPoints))
+	}
+	if cluster, _ := gauge.DataPoints[0].Attributes.Value("cluster"); cluster.AsString() != "other_cluster" {
+		t.Errorf("buildkite.agents.idle cluster = %q, want %q", cluster.AsString(), "other_cluster")
+	}
+
+	if got, want := gaugePoints(t, reader, "buildkite.agent_metrics.stale")[""].Value, int64(1); got != want {
+		t.Errorf("buildkite.agent_metrics.stale = %d, want %d", got, want)
+	}
+}
+
+// TestOpenTelemetryUnits checks that units from the metric registry are used.
+func TestOpenTelemetryUnits(t *testing.T) {
+	b, reader := newTestOTelBackend(t)
+	if err := b.Collect(newTestResult(t)); err != nil {
+		t.Fatalf("Collect() = %v", err)
+	}
+
+	if got, want := collectMetric(t, reader, "buildkite.agents.busy_percentage").Unit, "%"; got != want {
+		t.Errorf("buildkite.agents.busy_percentage unit = %q, want %q", got, want)
+	}
+	if got, want := collectMetric(t, reader, "buildkite.agents.busy").Unit, ""; got != want {
+		t.Errorf("buildkite.agents.busy unit = %q, want %q", got, want)
+	}
+}
@@ -1,13 +1,14 @@
 package backend
 
 import (
-	"log"
 	"net/http"
+	"os"
 	"regexp"
 	"strings"
 	"sync"
 
 	"github.com/buildkite/buildkite-agent-metrics/v5/collector"
+	"github.com/buildkite/buildkite-agent-metrics/v5/logging"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -15,16 +16,81 @@ import (
 
 var camelCaseRE = regexp.MustCompile("(^[^A-Z0-9]*|[A-Z0-9]*)([A-Z0-9][^A-Z]+|$)")
 
-// Prometheus this holds a list of prometheus gauges which have been created,
-// one for each metric that we want to expose. These are created and registered
-// in NewPrometheusBackend.
+// Prometheus this holds a list of prometheus gauges (or counters) which have
+// been created, one for each metric that we want to expose. These are created
+// and registered in NewPrometheusBackend, or on first use for metrics not in
+// collector.AllMetrics, such as those passed through from the Agent API.
 //
 // Note: these metrics are not unique to a cluster / queue, as these labels are
 // added to the value when it is set.
 type Prometheus struct {
-	totals    map[string]*prometheus.GaugeVec
-	queues    map[string]*prometheus.GaugeVec
+	totals    map[string]*promVec
+	queues    map[string]*promVec
+	self      map[string]*promVec            // self metrics, by name
+	failed    *prometheus.GaugeVec           // 1 for queues that could not be collected, 0 otherwise
 	oldQueues map[string]map[string]struct{} // cluster -> set of queues in cluster from last collect
+
+	counterDeltas counterDeltas
+
+	// mu serialises Collect, which registers metrics and tracks queues for
+	// results from every token
+	mu sync.Mutex
+}
+
+// promVec is the gauge or counter vector for a metric, depending on its kind.
+type promVec struct {
+	name    string
+	gauge   *prometheus.GaugeVec
+	counter *prometheus.CounterVec
+}
+
+func newPromVec(info collector.MetricInfo, prefix string, labels []string) *promVec {
+	v := &promVec{name: prefix + info.PrometheusName}
+	if info.Kind == collector.KindCounter {
+		v.counter = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: v.name,
+			Help: info.Description,
+		}, labels)
+	} else {
+		v.gauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: v.name,
+			Help: info.Description,
+		}, labels)
+	}
+	return v
+}
+
+func (v *promVec) collector() prometheus.Collector {
+	if v.counter != nil {
+		return v.counter
+	}
+	return v.gauge
+}
+
+// set sets a gauge to value, or adds the increase since the last value to a
+// counter.
+func (v *promVec) set(deltas *counterDeltas, labels prometheus.Labels, value int) {
+	if v.counter != nil {
+		v.counter.With(labels).Add(float64(deltas.delta(v.key(labels), value)))
+		return
+	}
+	v.gauge.With(labels).Set(float64(value))
+}
+
+// delete deletes the series with labels. A deleted counter starts again from
+// the next value it is set to.
+func (v *promVec) delete(deltas *counterDeltas, labels prometheus.Labels) {
+	if v.counter != nil {
+		v.counter.Delete(labels)
+		deltas.forget(v.key(labels))
+		return
+	}
+	v.gauge.Delete(labels)
+}
+
+// key identifies the series with labels to counterDeltas.
+func (v *promVec) key(labels prometheus.Labels) string {
+	return v.name + "\x00" + labels["cluster"] + "\x00" + labels["queue"]
 }
 
 var (
@@ -43,51 +109,137 @@ func NewPrometheusBackend() *Prometheus {
 
 func createPromSingleton() {
 	promSingleton = &Prometheus{
-		totals:    make(map[string]*prometheus.GaugeVec),
-		queues:    make(map[string]*prometheus.GaugeVec),
+		totals:    make(map[string]*promVec),
+		queues:    make(map[string]*promVec),
+		self:      make(map[string]*promVec),
 		oldQueues: make(map[string]map[string]struct{}),
 	}
 
 	for _, name := range collector.AllMetrics {
-		gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "buildkite_total_" + camelToUnderscore(name),
-			Help: "Buildkite Total: " + name,
-		}, []string{"cluster"})
-		prometheus.MustRegister(gauge)
-		promSingleton.totals[name] = gauge
-
-		gauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "buildkite_queues_" + camelToUnderscore(name),
-			Help: "Buildkite Queues: " + name,
-		}, []string{"queue", "cluster"})
-		prometheus.MustRegister(gauge)
-		promSingleton.queues[name] = gauge
+		if err := promSingleton.registerGauges(name); err != nil {
+			panic(err)
+		}
+	}
+
+	failed := metricInfo(collector.QueueCollectionFailed)
+	promSingleton.failed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "buildkite_queues_" + failed.PrometheusName,
+		Help: failed.Description,
+	}, []string{"queue", "cluster"})
+	prometheus.MustRegister(promSingleton.failed)
+}
+
+// registerGauges creates and registers the total and queue gauges (or
+// counters) for the named metric, unless they already exist.
+func (p *Prometheus) registerGauges(name string) error {
+	if _, ok := p.totals[name]; ok {
+		return nil
+	}
+
+	info := metricInfo(name)
+
+	totals := newPromVec(info, "buildkite_total_", []string{"cluster"})
+	if err := prometheus.Register(totals.collector()); err != nil {
+		return err
+	}
+
+	queues := newPromVec(info, "buildkite_queues_", []string{"queue", "cluster"})
+	if err := prometheus.Register(queues.collector()); err != nil {
+		prometheus.Unregister(totals.collector())
+		return err
+	}
+
+	p.totals[name] = totals
+	p.queues[name] = queues
+	return nil
+}
+
+// registerSelf creates and registers the gauge (or counter) for the named self
+// metric, unless it already exists. Self metrics are named buildkite_ followed
+// by their Prometheus name, such as buildkite_agent_metrics_up.
+func (p *Prometheus) registerSelf(name string) error {
+	if _, ok := p.self[name]; ok {
+		return nil
+	}
+
+	self := newPromVec(metricInfo(name), "buildkite_", []string{"cluster"})
+	if err := prometheus.Register(self.collector()); err != nil {
+		return err
 	}
+
+	p.self[name] = self
+	return nil
 }
 
-// Serve runs a Prometheus metrics HTTP server.
+// Serve runs a Prometheus metrics HTTP server. If the server fails, the process
+// exits.
 func (p *Prometheus) Serve(path, addr string) {
 	m := http.NewServeMux()
 	m.Handle(path, promhttp.Handler())
-	log.Fatal(http.ListenAndServe(addr, m))
+	err := http.ListenAndServe(addr, m)
+	logger("prometheus").Error("Prometheus server failed", "addr", addr, logging.Err(err))
+	os.Exit(1)
 }
 
 // Collect receives a set of metrics from the agent and updates the gauges.
 //
 // Note: This is called once per agent token per interval
 func (p *Prometheus) Collect(r *collector.Result) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for name, value := range r.SelfMetrics {
+		if err := p.registerSelf(name); err != nil {
+			logger("prometheus").Error("Failed to register Prometheus gauge", "metric", name, logging.Err(err))
+			continue
+		}
+		p.self[name].set(&p.counterDeltas, prometheus.Labels{
+			"cluster": r.Cluster,
+		}, value)
+	}
+
+	// Stale metrics are dropped, so that they are absent rather than stuck
+	// at their last values.
+	if r.Stale {
+		p.dropCluster(r.Cluster)
+		return nil
+	}
+
+	// A failed collection only updates the self metrics, leaving the others
+	// as they were.
+	if r.OnlySelfMetrics() {
+		return nil
+	}
+
+	// Metrics that weren't known in advance get gauges when first seen.
+	for name := range r.Totals {
+		if err := p.registerGauges(name); err != nil {
+			logger("prometheus").Error("Failed to register Prometheus gauges", "metric", name, logging.Err(err))
+		}
+	}
+	for _, counts := range r.Queues {
+		for name := range counts {
+			if err := p.registerGauges(name); err != nil {
+				logger("prometheus").Error("Failed to register Prometheus gauges", "metric", name, logging.Err(err))
+			}
+		}
+	}
 
 	// Ranging over all gauges and searching Totals / Queues for values ensures
-	// that metrics that are not in this collection are reset to 0.
+	// that metrics that are not in this collection are reset to 0. Counters
+	// keep their totals instead.
 
 	for name, gauge := range p.totals {
-		value := r.Totals[name] // 0 if missing
+		value, ok := r.Totals[name] // 0 if missing
+		if !ok && gauge.counter != nil {
+			continue
+		}
 
 		// note that r.Cluster will be empty for unclustered agents, this label
 		// will be dropped by prometheus
-		gauge.With(prometheus.Labels{
+		gauge.set(&p.counterDeltas, prometheus.Labels{
 			"cluster": r.Cluster,
-		}).Set(float64(value))
+		}, value)
 	}
 
 	currentQueues := make(map[string]struct{})
@@ -97,15 +249,35 @@ func (p *Prometheus) Collect(r *collector.Result) error {
 		delete(oldQueues, queue) // still current
 
 		for name, gauge := range p.queues {
-			value := counts[name] // 0 if missing
+			value, ok := counts[name] // 0 if missing
+			if !ok && gauge.counter != nil {
+				continue
+			}
 
 			// note that r.Cluster will be empty for unclustered agents, this
 			// label will be dropped by prometheus
-			gauge.With(prometheus.Labels{
+			gauge.set(&p.counterDeltas, prometheus.Labels{
 				"cluster": r.Cluster,
 				"queue":   queue,
-			}).Set(float64(value))
+			}, value)
 		}
+
+		p.failed.With(prometheus.Labels{
+			"cluster": r.Cluster,
+			"queue":   queue,
+		}).Set(0)
+	}
+
+	// Queues that could not be collected keep their last values, so that a
+	// single failed request does not look like the queue emptied out.
+	for queue := range r.QueueErrors {
+		currentQueues[queue] = struct{}{}
+		delete(oldQueues, queue) // still current
+
+		p.failed.With(prometheus.Labels{
+			"cluster": r.Cluster,
+			"queue":   queue,
+		}).Set(1)
 	}
 
 	// oldQueues contains queues that were in the previous collector result, but
@@ -113,17 +285,41 @@ func (p *Prometheus) Collect(r *collector.Result) error {
 	// This is to prevent accumulating label values for deleted queues.
 	for queue := range oldQueues {
 		for _, gauge := range p.queues {
-			gauge.Delete(prometheus.Labels{
+			gauge.delete(&p.counterDeltas, prometheus.Labels{
 				"cluster": r.Cluster,
 				"queue":   queue,
 			})
 		}
+		p.failed.Delete(prometheus.Labels{
+			"cluster": r.Cluster,
+			"queue":   queue,
+		})
 	}
 	p.oldQueues[r.Cluster] = currentQueues
 
 	return nil
 }
 
+// dropCluster deletes the total and queue series for cluster.
+func (p *Prometheus) dropCluster(cluster string) {
+	for _, gauge := range p.totals {
+		gauge.delete(&p.counterDeltas, prometheus.Labels{"cluster": cluster})
+	}
+	for queue := range p.oldQueues[cluster] {
+		for _, gauge := range p.queues {
+			gauge.delete(&p.counterDeltas, prometheus.Labels{
+				"cluster": cluster,
+				"queue":   queue,
+			})
+		}
+		p.failed.Delete(prometheus.Labels{
+			"cluster": cluster,
+			"queue":   queue,
+		})
+	}
+	delete(p.oldQueues, cluster)
+}
+
 func camelToUnderscore(s string) string {
 	var a []string
 	for _, sub := range camelCaseRE.FindAllStringSubmatch(s, -1) {
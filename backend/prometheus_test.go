@@ -1,12 +1,14 @@
 package backend
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 
 	"github.com/buildkite/buildkite-agent-metrics/v5/collector"
 	"github.com/google/go-cmp/cmp"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	dto "github.com/prometheus/client_model/go"
 )
 
@@ -71,7 +73,7 @@ func gatherMetrics(t *testing.T) map[string]*dto.MetricFamily {
 func TestCollect(t *testing.T) {
 	metricFamilies := gatherMetrics(t)
 
-	if got, want := len(metricFamilies), 16; got != want {
+	if got, want := len(metricFamilies), 17; got != want {
 		t.Errorf("len(metricFamilies) = %d, want %d", got, want)
 	}
 
@@ -90,7 +92,7 @@ func TestCollect(t *testing.T) {
 		{
 			group:      "Total",
 			metricName: "buildkite_total_running_jobs_count",
-			wantHelp:   "Buildkite Total: RunningJobsCount",
+			wantHelp:   "Number of running jobs",
 			wantType:   dto.MetricType_GAUGE,
 			wantMetrics: []promMetric{
 				{
@@ -102,7 +104,7 @@ func TestCollect(t *testing.T) {
 		{
 			group:      "Total",
 			metricName: "buildkite_total_scheduled_jobs_count",
-			wantHelp:   "Buildkite Total: ScheduledJobsCount",
+			wantHelp:   "Number of scheduled jobs",
 			wantType:   dto.MetricType_GAUGE,
 			wantMetrics: []promMetric{
 				{
@@ -114,7 +116,7 @@ func TestCollect(t *testing.T) {
 		{
 			group:      "Queues",
 			metricName: "buildkite_queues_unfinished_jobs_count",
-			wantHelp:   "Buildkite Queues: UnfinishedJobsCount",
+			wantHelp:   "Number of unfinished jobs",
 			wantType:   dto.MetricType_GAUGE,
 			wantMetrics: []promMetric{
 				{
@@ -136,7 +138,7 @@ func TestCollect(t *testing.T) {
 		{
 			group:      "Queues",
 			metricName: "buildkite_queues_idle_agent_count",
-			wantHelp:   "Buildkite Queues: IdleAgentCount",
+			wantHelp:   "Number of idle agents",
 			wantType:   dto.MetricType_GAUGE,
 			wantMetrics: []promMetric{
 				{
@@ -155,6 +157,28 @@ func TestCollect(t *testing.T) {
 				},
 			},
 		},
+		{
+			group:      "Queues",
+			metricName: "buildkite_queues_queue_collection_failed",
+			wantHelp:   "Whether the metrics for a queue could not be collected (1) or not (0)",
+			wantType:   dto.MetricType_GAUGE,
+			wantMetrics: []promMetric{
+				{
+					Labels: map[string]string{
+						"cluster": "test_cluster",
+						"queue":   "default",
+					},
+					Value: 0,
+				},
+				{
+					Labels: map[string]string{
+						"cluster": "test_cluster",
+						"queue":   "deploy",
+					},
+					Value: 0,
+				},
+			},
+		},
 	}
 
 	for _, tc := range tcs {
@@ -193,6 +217,117 @@ func TestCollect(t *testing.T) {
 	}
 }
 
+func TestCollectFailedQueue(t *testing.T) {
+	oldRegisterer := prometheus.DefaultRegisterer
+	defer func() {
+		prometheus.DefaultRegisterer = oldRegisterer
+	}()
+	r := prometheus.NewRegistry()
+	prometheus.DefaultRegisterer = r
+
+	p := NewPrometheusBackend()
+	if err := p.Collect(newTestResult(t)); err != nil {
+		t.Fatalf("p.Collect() = %v", err)
+	}
+
+	// On the next collection the deploy queue could not be fetched.
+	res := newTestResult(t)
+	delete(res.Queues, "deploy")
+	res.QueueErrors = map[string]error{"deploy": errors.New("boom")}
+	if err := p.Collect(res); err != nil {
+		t.Fatalf("p.Collect() = %v", err)
+	}
+
+	labels := prometheus.Labels{"cluster": "test_cluster", "queue": "deploy"}
+
+	if got, want := testutil.ToFloat64(p.failed.With(labels)), 1.0; got != want {
+		t.Errorf("failed gauge for deploy = %v, want %v", got, want)
+	}
+
+	// The last known values are kept rather than deleted.
+	idle := p.queues[collector.IdleAgentCount].gauge.With(labels)
+	if got, want := testutil.ToFloat64(idle), float64(fakeDeployQueue[collector.IdleAgentCount]); got != want {
+		t.Errorf("idle agent gauge for deploy = %v, want %v", got, want)
+	}
+}
+
+func TestCollectOtherMetrics(t *testing.T) {
+	oldRegisterer := prometheus.DefaultRegisterer
+	defer func() {
+		prometheus.DefaultRegisterer = oldRegisterer
+	}()
+	r := prometheus.NewRegistry()
+	prometheus.DefaultRegisterer = r
+
+	// A metric outside collector.AllMetrics, as passed through from the Agent
+	// API, gets its gauges when first seen.
+	res := newTestResult(t)
+	res.Totals = map[string]int{"AssignedJobsCount": 2}
+	res.Queues = map[string]map[string]int{
+		"default": {"AssignedJobsCount": 1},
+	}
+
+	p := NewPrometheusBackend()
+	if err := p.Collect(res); err != nil {
+		t.Fatalf("p.Collect() = %v", err)
+	}
+
+	total := p.totals["AssignedJobsCount"].gauge.With(prometheus.Labels{"cluster": "test_cluster"})
+	if got, want := testutil.ToFloat64(total), 2.0; got != want {
+		t.Errorf("buildkite_total_assigned_jobs_count = %v, want %v", got, want)
+	}
+
+	mfs, err := r.Gather()
+	if err != nil {
+		t.Fatalf("prometheus.Registry.Gather() = %v", err)
+	}
+	var found bool
+	for _, mf := range mfs {
+		if mf.GetName() == "buildkite_queues_assigned_jobs_count" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("buildkite_queues_assigned_jobs_count was not registered")
+	}
+}
+
+func TestCollectCounter(t *testing.T) {
+	oldRegisterer := prometheus.DefaultRegisterer
+	defer func() {
+		prometheus.DefaultRegisterer = oldRegisterer
+	}()
+	prometheus.DefaultRegisterer = prometheus.NewRegistry()
+
+	registerTestMetric(t, collector.MetricInfo{
+		Name:           "PrometheusTestCounter",
+		Description:    "A test counter",
+		Kind:           collector.KindCounter,
+		PrometheusName: "prometheus_test_counter",
+	})
+
+	p := NewPrometheusBackend()
+
+	// The values in a result are running totals, which may reset.
+	for _, v := range []int{3, 5, 2} {
+		res := &collector.Result{
+			Cluster: "test_cluster",
+			Totals:  map[string]int{"PrometheusTestCounter": v},
+		}
+		if err := p.Collect(res); err != nil {
+			t.Fatalf("p.Collect() = %v", err)
+		}
+	}
+
+	counter := p.totals["PrometheusTestCounter"].counter
+	if counter == nil {
+		t.Fatalf("PrometheusTestCounter was not registered as a counter")
+	}
+	if got, want := testutil.ToFloat64(counter.With(prometheus.Labels{"cluster": "test_cluster"})), 7.0; got != want {
+		t.Errorf("buildkite_total_prometheus_test_counter = %v, want %v", got, want)
+	}
+}
+
 func TestCamelToUnderscore(t *testing.T) {
 	tcs := []struct {
 		input string
@@ -218,3 +353,115 @@ func TestCamelToUnderscore(t *testing.T) {
 		}
 	}
 }
+
+func TestCollectSelfMetrics(t *testing.T) {
+	oldRegisterer := prometheus.DefaultRegisterer
+	defer func() {
+		prometheus.DefaultRegisterer = oldRegisterer
+	}()
+	r := prometheus.NewRegistry()
+	prometheus.DefaultRegisterer = r
+
+	p := NewPrometheusBackend()
+	res := newTestResult(t)
+	res.SelfMetrics = map[string]int{
+		collector.AgentMetricsUp:                          1,
+		collector.AgentMetricsLastSuccessTimestampSeconds: 1700000000,
+		collector.AgentMetricsAPIResponses2xx:             3,
+	}
+	if err := p.Collect(res); err != nil {
+		t.Fatalf("p.Collect() = %v", err)
+	}
+
+	// A failed collection only has self metrics, and must not reset the
+	// others.
+	failed := &collector.Result{
+		Cluster: "test_cluster",
+		SelfMetrics: map[string]int{
+			collector.AgentMetricsUp:                          0,
+			collector.AgentMetricsLastSuccessTimestampSeconds: 1700000000,
+			collector.AgentMetricsAPIResponses2xx:             3,
+			collector.AgentMetricsAPIResponses5xx:             2,
+		},
+	}
+	if err := p.Collect(failed); err != nil {
+		t.Fatalf("p.Collect() = %v", err)
+	}
+
+	mfs, err := r.Gather()
+	if err != nil {
+		t.Fatalf("prometheus.Registry.Gather() = %v", err)
+	}
+	got := make(map[string]float64)
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			if len(m.GetLabel()) != 1 || m.GetLabel()[0].GetValue() != "test_cluster" {
+				continue
+			}
+			switch {
+			case m.GetGauge() != nil:
+				got[mf.GetName()] = m.GetGauge().GetValue()
+			case m.GetCounter() != nil:
+				got[mf.GetName()] = m.GetCounter().GetValue()
+			}
+		}
+	}
+
+	for name, want := range map[string]float64{
+		"buildkite_agent_metrics_up":                             0,
+		"buildkite_agent_metrics_last_success_timestamp_seconds": 1700000000,
+		"buildkite_agent_metrics_api_responses_2xx_total":        3,
+		"buildkite_agent_metrics_api_responses_5xx_total":        2,
+	} {
+		if got, ok := got[name]; !ok || got != want {
+			t.Errorf("%s = %v (present: %t), want %v", name, got, ok, want)
+		}
+	}
+
+	// Nor reset the totals or delete the queues.
+	total := p.totals[collector.IdleAgentCount].gauge.With(prometheus.Labels{"cluster": "test_cluster"})
+	if got, want := testutil.ToFloat64(total), float64(fakeTotals[collector.IdleAgentCount]); got != want {
+		t.Errorf("idle agent total gauge = %v, want %v", got, want)
+	}
+	idle := p.queues[collector.IdleAgentCount].gauge.With(prometheus.Labels{"cluster": "test_cluster", "queue": "deploy"})
+	if got, want := testutil.ToFloat64(idle), float64(fakeDeployQueue[collector.IdleAgentCount]); got != want {
+		t.Errorf("idle agent gauge for deploy = %v, want %v", got, want)
+	}
+}
+
+func TestCollectStale(t *testing.T) {
+	oldRegisterer := prometheus.DefaultRegisterer
+	defer func() {
+		prometheus.DefaultRegisterer = oldRegisterer
+	}()
+	prometheus.DefaultRegisterer = prometheus.NewRegistry()
+
+	p := NewPrometheusBackend()
+	if err := p.Collect(newTestResult(t)); err != nil {
+		t.Fatalf("p.Collect() = %v", err)
+	}
+
+	stale := &collector.Result{
+		Cluster:     "test_cluster",
+		Stale:       true,
+		SelfMetrics: map[string]int{collector.AgentMetricsStale: 1},
+	}
+	if err := p.Collect(stale); err != nil {
+		t.Fatalf("p.Collect() = %v", err)
+	}
+
+	// The series are dropped rather than kept at their last values.
+	totals := p.totals[collector.IdleAgentCount].gauge
+	if got := testutil.CollectAndCount(totals); got != 0 {
+		t.Errorf("idle agent total series = %d, want 0", got)
+	}
+	queues := p.queues[collector.IdleAgentCount].gauge
+	if got := testutil.CollectAndCount(queues); got != 0 {
+		t.Errorf("idle agent queue series = %d, want 0", got)
+	}
+
+	indicator := p.self[collector.AgentMetricsStale].gauge.With(prometheus.Labels{"cluster": "test_cluster"})
+	if got, want := testutil.ToFloat64(indicator), 1.0; got != want {
+		t.Errorf("buildkite_agent_metrics_stale = %v, want %v", got, want)
+	}
+}
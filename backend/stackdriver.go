@@ -3,11 +3,12 @@ package backend
 import (
 	"context"
 	"fmt"
-	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/buildkite/buildkite-agent-metrics/v5/collector"
+	"github.com/buildkite/buildkite-agent-metrics/v5/logging"
 	"google.golang.org/genproto/googleapis/api/label"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
@@ -30,9 +31,16 @@ var dashReplacer = strings.NewReplacer("-", "_")
 
 // StackDriverBackend sends metrics to GCP Stackdriver
 type StackDriverBackend struct {
-	projectID   string
-	client      *monitoring.MetricClient
-	metricTypes map[string]string
+	projectID string
+	client    *monitoring.MetricClient
+
+	metricTypesMu sync.Mutex
+	metricTypes   map[string]string
+
+	// startTime is the start of the interval of every cumulative (counter)
+	// metric point, until the counter is reset
+	startTime time.Time
+	counters  counterStarts
 }
 
 // NewStackDriverBackend returns a new StackDriverBackend for the specified project
@@ -47,61 +55,85 @@ func NewStackDriverBackend(gcpProjectID string) (*StackDriverBackend, error) {
 		projectID:   gcpProjectID,
 		client:      c,
 		metricTypes: make(map[string]string),
+		startTime:   time.Now(),
 	}, nil
 }
 
 // Collect metrics
 func (sd *StackDriverBackend) Collect(r *collector.Result) error {
-	ctx := context.Background()
-	now := &timestamppb.Timestamp{
-		Seconds: time.Now().Unix(),
-	}
+	return sd.CollectContext(context.Background(), r)
+}
+
+// CollectContext implements the ContextBackend interface
+func (sd *StackDriverBackend) CollectContext(ctx context.Context, r *collector.Result) error {
+	now := time.Unix(time.Now().Unix(), 0)
+	end := timestamppb.New(now)
 	orgName := dashReplacer.Replace(r.Org)
 	metricTypeFunc := func(name string) string {
 		return fmt.Sprintf(metricTypeFmt, orgName, name)
 	}
 
-	for name, value := range r.Totals {
-		mt, present := sd.metricTypes[name]
-		if !present {
-			mt = metricTypeFunc(name)
-			metricReq := createCustomMetricRequest(&sd.projectID, &mt)
-			_, err := sd.client.CreateMetricDescriptor(ctx, metricReq)
-			if err != nil {
-				retErr := fmt.Errorf("[Collect] could not create custom metric [%s]: %w", mt, err)
-				log.Println(retErr)
-				return retErr
-			}
-			log.Printf("[Collect] created custom metric [%s]", mt)
-			sd.metricTypes[name] = mt
-		}
-		req := createTimeSeriesValueRequest(&sd.projectID, &mt, r.Cluster, totalMetricsQueue, value, now)
-		err := sd.client.CreateTimeSeries(ctx, req)
-		if err != nil {
-			retErr := fmt.Errorf("[Collect] could not write metric [%s] value [%d], %w", mt, value, err)
-			log.Println(retErr)
-			return retErr
+	// Counters restart from 0 when the collector does, such as when its
+	// config is reloaded, so each series starts again when it goes down
+	startTimeFunc := func(name, mt, queue string, value int) *timestamppb.Timestamp {
+		if metricInfo(name).Kind != collector.KindCounter {
+			return end
 		}
+		key := mt + "\x00" + r.Cluster + "\x00" + queue
+		return timestamppb.New(sd.counters.start(key, value, sd.startTime, now))
 	}
 
-	for queue, counts := range r.Queues {
-		for name, value := range counts {
-			mt := metricTypeFunc(name)
-			req := createTimeSeriesValueRequest(&sd.projectID, &mt, r.Cluster, queue, value, now)
+	// Self metrics are about the organization as a whole, like the totals
+	for _, totals := range []map[string]int{r.Totals, r.SelfMetrics} {
+		for name, value := range totals {
+			sd.metricTypesMu.Lock()
+			mt, present := sd.metricTypes[name]
+			sd.metricTypesMu.Unlock()
+			if !present {
+				mt = metricTypeFunc(name)
+				metricReq := createCustomMetricRequest(&sd.projectID, &mt, metricInfo(name))
+				_, err := sd.client.CreateMetricDescriptor(ctx, metricReq)
+				if err != nil {
+					retErr := fmt.Errorf("[Collect] could not create custom metric [%s]: %w", mt, err)
+					logger("stackdriver").Error("Could not create custom metric", "metric_type", mt, logging.Err(err))
+					return retErr
+				}
+				logger("stackdriver").Info("Created custom metric", "metric_type", mt)
+				sd.metricTypesMu.Lock()
+				sd.metricTypes[name] = mt
+				sd.metricTypesMu.Unlock()
+			}
+			req := createTimeSeriesValueRequest(&sd.projectID, &mt, r.Cluster, totalMetricsQueue, value, startTimeFunc(name, mt, totalMetricsQueue, value), end)
 			err := sd.client.CreateTimeSeries(ctx, req)
 			if err != nil {
-				retErr := fmt.Errorf("[Collect] could not write metric [%s] value [%d], %w ", mt, value, err)
-				log.Println(retErr)
+				retErr := fmt.Errorf("[Collect] could not write metric [%s] value [%d], %w", mt, value, err)
+				logger("stackdriver").Error("Could not write metric", "metric_type", mt, "value", value, logging.Err(err))
 				return retErr
 			}
 		}
 	}
 
+	for _, queues := range []map[string]map[string]int{r.Queues, r.QueueCollectionStatus()} {
+		for queue, counts := range queues {
+			for name, value := range counts {
+				mt := metricTypeFunc(name)
+				req := createTimeSeriesValueRequest(&sd.projectID, &mt, r.Cluster, queue, value, startTimeFunc(name, mt, queue, value), end)
+				err := sd.client.CreateTimeSeries(ctx, req)
+				if err != nil {
+					retErr := fmt.Errorf("[Collect] could not write metric [%s] value [%d], %w ", mt, value, err)
+					logger("stackdriver").Error("Could not write metric", "metric_type", mt, logging.QueueKey, queue, "value", value, logging.Err(err))
+					return retErr
+				}
+			}
+		}
+	}
+
 	return nil
 }
 
-// createCustomMetricRequest creates a custom metric request as specified by the metric type.
-func createCustomMetricRequest(projectID *string, metricType *string) *monitoringpb.CreateMetricDescriptorRequest {
+// createCustomMetricRequest creates a custom metric request as specified by the metric type,
+// with the kind, unit and description of the metric.
+func createCustomMetricRequest(projectID *string, metricType *string, info collector.MetricInfo) *monitoringpb.CreateMetricDescriptorRequest {
 	clusterLabel := &label.LabelDescriptor{
 		Key:         clusterLabelKey,
 		ValueType:   label.LabelDescriptor_STRING,
@@ -116,12 +148,17 @@ func createCustomMetricRequest(projectID *string, metricType *string) *monitorin
 		clusterLabel,
 		queueLabel,
 	}
+	kind := metric.MetricDescriptor_GAUGE
+	if info.Kind == collector.KindCounter {
+		kind = metric.MetricDescriptor_CUMULATIVE
+	}
 	md := &metric.MetricDescriptor{
 		Name:        *metricType,
 		Type:        *metricType,
-		MetricKind:  metric.MetricDescriptor_GAUGE,
+		MetricKind:  kind,
 		ValueType:   metric.MetricDescriptor_INT64,
-		Description: fmt.Sprintf("Buildkite metric: [%s]", *metricType),
+		Unit:        stackdriverUnit(info.Unit),
+		Description: info.Description,
 		DisplayName: *metricType,
 		Labels:      labels,
 	}
@@ -133,8 +170,23 @@ func createCustomMetricRequest(projectID *string, metricType *string) *monitorin
 	return req
 }
 
-// createTimeSeriesValueRequest creates a StackDriver value request for the specified metric
-func createTimeSeriesValueRequest(projectID *string, metricType *string, cluster, queue string, value int, time *timestamppb.Timestamp) *monitoringpb.CreateTimeSeriesRequest {
+// stackdriverUnit returns the UCUM unit of a metric unit.
+func stackdriverUnit(u collector.Unit) string {
+	switch u {
+	case collector.UnitPercent:
+		return "%"
+	case collector.UnitSeconds:
+		return "s"
+	case collector.UnitMilliseconds:
+		return "ms"
+	default:
+		return "1"
+	}
+}
+
+// createTimeSeriesValueRequest creates a StackDriver value request for the specified metric.
+// The start time is the same as the end time for gauges, and the start of the total for counters.
+func createTimeSeriesValueRequest(projectID *string, metricType *string, cluster, queue string, value int, start, end *timestamppb.Timestamp) *monitoringpb.CreateTimeSeriesRequest {
 	req := &monitoringpb.CreateTimeSeriesRequest{
 		Name: "projects/" + *projectID,
 		TimeSeries: []*monitoringpb.TimeSeries{{
@@ -147,8 +199,8 @@ func createTimeSeriesValueRequest(projectID *string, metricType *string, cluster
 			},
 			Points: []*monitoringpb.Point{{
 				Interval: &monitoringpb.TimeInterval{
-					StartTime: time,
-					EndTime:   time,
+					StartTime: start,
+					EndTime:   end,
 				},
 				Value: &monitoringpb.TypedValue{
 					Value: &monitoringpb.TypedValue_Int64Value{
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"github.com/buildkite/buildkite-agent-metrics/v5/collector"
 	"github.com/google/go-cmp/cmp"
 	"google.golang.org/genproto/googleapis/api/label"
 	"google.golang.org/genproto/googleapis/api/metric"
@@ -16,6 +17,7 @@ func Test_createCustomMetricRequest(t *testing.T) {
 	type args struct {
 		projectID  string
 		metricType string
+		info       collector.MetricInfo
 	}
 	tests := []struct {
 		name string
@@ -27,6 +29,11 @@ func Test_createCustomMetricRequest(t *testing.T) {
 			args: args{
 				projectID:  "test-project-id",
 				metricType: "test-metric-type",
+				info: collector.MetricInfo{
+					Description: "Number of test things",
+					Unit:        collector.UnitCount,
+					Kind:        collector.KindGauge,
+				},
 			},
 			want: &monitoringpb.CreateMetricDescriptorRequest{
 				Name: "projects/test-project-id",
@@ -35,7 +42,44 @@ func Test_createCustomMetricRequest(t *testing.T) {
 					Type:        "test-metric-type",
 					MetricKind:  metric.MetricDescriptor_GAUGE,
 					ValueType:   metric.MetricDescriptor_INT64,
-					Description: "Buildkite metric: [test-metric-type]",
+					Unit:        "1",
+					Description: "Number of test things",
+					DisplayName: "test-metric-type",
+					Labels: []*label.LabelDescriptor{
+						{
+							Key:         clusterLabelKey,
+							ValueType:   label.LabelDescriptor_STRING,
+							Description: clusterDescription,
+						},
+						{
+							Key:         queueLabelKey,
+							ValueType:   label.LabelDescriptor_STRING,
+							Description: queueDescription,
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "PercentCounter",
+			args: args{
+				projectID:  "test-project-id",
+				metricType: "test-metric-type",
+				info: collector.MetricInfo{
+					Description: "Percentage of test things",
+					Unit:        collector.UnitPercent,
+					Kind:        collector.KindCounter,
+				},
+			},
+			want: &monitoringpb.CreateMetricDescriptorRequest{
+				Name: "projects/test-project-id",
+				MetricDescriptor: &metric.MetricDescriptor{
+					Name:        "test-metric-type",
+					Type:        "test-metric-type",
+					MetricKind:  metric.MetricDescriptor_CUMULATIVE,
+					ValueType:   metric.MetricDescriptor_INT64,
+					Unit:        "%",
+					Description: "Percentage of test things",
 					DisplayName: "test-metric-type",
 					Labels: []*label.LabelDescriptor{
 						{
@@ -55,7 +99,7 @@ func Test_createCustomMetricRequest(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := createCustomMetricRequest(&tt.args.projectID, &tt.args.metricType)
+			got := createCustomMetricRequest(&tt.args.projectID, &tt.args.metricType, tt.args.info)
 			if diff := cmp.Diff(got, tt.want, protocmp.Transform()); diff != "" {
 				t.Errorf("createCustomMetricRequest diff (-got +want):\n%s", diff)
 			}
@@ -151,7 +195,7 @@ func Test_createTimeSeriesValueRequest(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := createTimeSeriesValueRequest(&tt.args.projectID, &tt.args.metricType, tt.args.cluster, tt.args.queue, tt.args.value, tt.args.time)
+			got := createTimeSeriesValueRequest(&tt.args.projectID, &tt.args.metricType, tt.args.cluster, tt.args.queue, tt.args.value, tt.args.time, tt.args.time)
 			if diff := cmp.Diff(got, tt.want, protocmp.Transform()); diff != "" {
 				t.Errorf("createTimeSeriesValueRequest diff (-got +want):\n%s", diff)
 			}
@@ -2,6 +2,7 @@ package backend
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/DataDog/datadog-go/statsd"
 	"github.com/buildkite/buildkite-agent-metrics/v5/collector"
@@ -11,6 +12,7 @@ import (
 type StatsD struct {
 	client        *statsd.Client
 	tagsSupported bool
+	counterDeltas counterDeltas
 }
 
 func NewStatsDBackend(host string, tagsSupported bool) (*StatsD, error) {
@@ -49,17 +51,25 @@ func (cb *StatsD) collectWithTags(r *collector.Result) error {
 	}
 
 	for name, value := range r.Totals {
-		if err := cb.client.Gauge(prefix+name, float64(value), commonTags, 1.0); err != nil {
+		if err := cb.send(prefix+name, name, value, commonTags); err != nil {
 			return err
 		}
 	}
 
-	for queue, counts := range r.Queues {
-		tags := append(commonTags, "queue:"+queue)
+	for name, value := range r.SelfMetrics {
+		if err := cb.send(prefix+name, name, value, commonTags); err != nil {
+			return err
+		}
+	}
 
-		for name, value := range counts {
-			if err := cb.client.Gauge(prefix+"queues."+name, float64(value), tags, 1.0); err != nil {
-				return err
+	for _, queues := range []map[string]map[string]int{r.Queues, r.QueueCollectionStatus()} {
+		for queue, counts := range queues {
+			tags := append(commonTags, "queue:"+queue)
+
+			for name, value := range counts {
+				if err := cb.send(prefix+"queues."+name, name, value, tags); err != nil {
+					return err
+				}
 			}
 		}
 	}
@@ -75,23 +85,41 @@ func (cb *StatsD) collectWithoutTags(r *collector.Result) error {
 	}
 
 	for name, value := range r.Totals {
-		if err := cb.client.Gauge(prefix+name, float64(value), nil, 1.0); err != nil {
+		if err := cb.send(prefix+name, name, value, nil); err != nil {
 			return err
 		}
 	}
 
-	for queue, counts := range r.Queues {
-		prefix := fmt.Sprintf("queues.%s.", queue)
-		if r.Cluster != "" {
-			prefix = fmt.Sprintf("clusters.%s.queues.%s.", r.Cluster, queue)
+	for name, value := range r.SelfMetrics {
+		if err := cb.send(prefix+name, name, value, nil); err != nil {
+			return err
 		}
+	}
 
-		for name, value := range counts {
-			if err := cb.client.Gauge(prefix+name, float64(value), nil, 1.0); err != nil {
-				return err
+	for _, queues := range []map[string]map[string]int{r.Queues, r.QueueCollectionStatus()} {
+		for queue, counts := range queues {
+			prefix := fmt.Sprintf("queues.%s.", queue)
+			if r.Cluster != "" {
+				prefix = fmt.Sprintf("clusters.%s.queues.%s.", r.Cluster, queue)
+			}
+
+			for name, value := range counts {
+				if err := cb.send(prefix+name, name, value, nil); err != nil {
+					return err
+				}
 			}
 		}
 	}
 
 	return cb.client.Flush()
 }
+
+// send sends the value of the named metric as stat. Gauges are sent as they
+// are, and counters as the increase since they were last sent.
+func (cb *StatsD) send(stat, name string, value int, tags []string) error {
+	if metricInfo(name).Kind == collector.KindCounter {
+		key := stat + "\x00" + strings.Join(tags, ",")
+		return cb.client.Count(stat, int64(cb.counterDeltas.delta(key, value)), tags, 1.0)
+	}
+	return cb.client.Gauge(stat, float64(value), tags, 1.0)
+}
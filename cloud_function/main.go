@@ -7,11 +7,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	// Google Cloud Functions framework
@@ -24,6 +26,7 @@ import (
 	// Buildkite metrics collection packages from the published module
 	"github.com/buildkite/buildkite-agent-metrics/v5/backend"
 	"github.com/buildkite/buildkite-agent-metrics/v5/collector"
+	"github.com/buildkite/buildkite-agent-metrics/v5/logging"
 	"github.com/buildkite/buildkite-agent-metrics/v5/version"
 )
 
@@ -35,13 +38,11 @@ const (
 )
 
 // Poll duration tracking to respect Buildkite API rate limits.
-// These package-level variables persist between invocations within the same
+// This package-level variable persists between invocations within the same
 // Cloud Function container instance (similar to Lambda behavior).
-// When using multiple tokens, nextPollTime applies globally to all tokens.
-var (
-	nextPollTime time.Time
-	lastPollTime time.Time
-)
+// Each token is polled on its own schedule, so one that is rate-limited
+// doesn't hold up the others.
+var schedule collector.PollSchedule
 
 // init registers the HTTP function with the Functions Framework.
 // This function is called once when the Cloud Function container starts.
@@ -144,9 +145,9 @@ func (s *secretManagerTokenProvider) Get() (string, error) {
 //
 // Poll Duration Tracking:
 // The function tracks poll duration from the Buildkite API to respect rate limits.
-// If called before the next allowed poll time, it returns early with a success response.
-// When using multiple tokens, the function uses the maximum poll duration across all tokens,
-// which means all tokens will wait for the longest duration before being polled again.
+// Each token has its own next allowed poll time, and is skipped if called before it.
+// If no token is due, it returns early with a success response. Due tokens are
+// polled concurrently, and an error with one doesn't stop the others.
 //
 // Token configuration (choose one):
 //   - BUILDKITE_AGENT_TOKENS: Comma-separated Buildkite API tokens or single token
@@ -157,12 +158,23 @@ func (s *secretManagerTokenProvider) Get() (string, error) {
 //
 // Optional environment variables:
 //   - BUILDKITE_QUEUE: Comma-separated list of specific queues to monitor
+//   - BUILDKITE_QUEUE_FILTER: Comma-separated glob or /regex/ patterns of queues to monitor, "!" excludes (e.g. "deploy-*,!*-canary")
 //   - BUILDKITE_AGENT_ENDPOINT: Custom Buildkite API endpoint (defaults to https://agent.buildkite.com/v3)
-//   - BUILDKITE_QUIET: Set to "true" or "1" to suppress non-error logs
-//   - BUILDKITE_DEBUG: Set to "true" or "1" to enable debug logging
-//   - BUILDKITE_AGENT_METRICS_DEBUG_HTTP: Set to "true" or "1" to enable HTTP request/response debugging
+//   - BUILDKITE_AGENT_METRICS_LOG_LEVEL: Lowest level to log: debug, info, warn or error (default: info)
+//   - BUILDKITE_AGENT_METRICS_LOG_FORMAT: "text" for key=value pairs, or "json" for one JSON object per line (default: text)
+//   - BUILDKITE_QUIET: Set to "true" or "1" to suppress non-error logs, unless the log level is set
+//   - BUILDKITE_DEBUG: Set to "true" or "1" to enable debug logging, unless the log level is set
+//   - BUILDKITE_AGENT_METRICS_DEBUG_HTTP: Set to "true" or "1" to log HTTP requests and responses at debug level
+//   - BUILDKITE_AGENT_METRICS_PASSTHROUGH_UNKNOWN_METRICS: Set to "true" or "1" to also publish API fields this version doesn't know about
+//   - BUILDKITE_AGENT_METRICS_DERIVED_METRICS: Set to "true" or "1" to also publish the required agent count, agent deficit and agent surplus
+//   - BUILDKITE_AGENT_METRICS_JOBS_PER_AGENT: Jobs each agent runs at once, for derived metrics (default: 1)
+//   - BUILDKITE_AGENT_METRICS_SPARE_CAPACITY_PERCENT: Spare capacity to require beyond scheduled and running jobs, for derived metrics (default: 0)
 //   - BUILDKITE_AGENT_METRICS_TIMEOUT: HTTP client timeout in seconds (default: 15)
 //   - BUILDKITE_AGENT_METRICS_MAX_IDLE_CONNS: Max idle connections (default: 100)
+//   - BUILDKITE_AGENT_METRICS_QUEUE_CONCURRENCY: Max queues fetched at once when BUILDKITE_QUEUE is set (default: 1)
+//   - BUILDKITE_AGENT_METRICS_RETRY_MAX_ATTEMPTS: Attempts per API request, including the first (default: 3)
+//   - BUILDKITE_AGENT_METRICS_RETRY_INITIAL_BACKOFF: Delay before the first retry, e.g. "1s" (default: 1s)
+//   - BUILDKITE_AGENT_METRICS_RETRY_MAX_BACKOFF: Maximum delay between retries, e.g. "30s" (default: 30s)
 func CollectMetrics(w http.ResponseWriter, r *http.Request) {
 	// Set response header to JSON since we always return JSON
 	w.Header().Set("Content-Type", "application/json")
@@ -170,6 +182,10 @@ func CollectMetrics(w http.ResponseWriter, r *http.Request) {
 	// Initialize our response object
 	response := Response{}
 
+	// The request context carries the invocation deadline, and is cancelled if
+	// the caller goes away, so in-flight API and Stackdriver calls are aborted.
+	ctx := r.Context()
+
 	// Get project ID from environment
 	projectID := os.Getenv("GCP_PROJECT_ID")
 	if projectID == "" {
@@ -191,36 +207,37 @@ func CollectMetrics(w http.ResponseWriter, r *http.Request) {
 	quiet := isQuietMode()
 	debug := isDebugMode()
 	debugHTTP := isDebugHTTPMode()
-
-	// Configure logging based on quiet/debug settings
-	if quiet && !debug {
-		// In quiet mode (without debug), suppress all non-error logs
-		log.SetOutput(nullWriter{})
+	passthroughUnknownMetrics := isPassthroughUnknownMetricsMode()
+
+	// Configure logging. Unless the level is set, quiet mode (without
+	// debug) only logs errors
+	level, err := logging.LevelFor(os.Getenv("BUILDKITE_AGENT_METRICS_LOG_LEVEL"), quiet && !debug, debug || debugHTTP)
+	if err == nil {
+		var logger *slog.Logger
+		if logger, err = logging.New(os.Stderr, level, os.Getenv("BUILDKITE_AGENT_METRICS_LOG_FORMAT")); err == nil {
+			slog.SetDefault(logger)
+		}
+	}
+	if err != nil {
+		response.Success = false
+		response.Error = fmt.Sprintf("Invalid logging configuration: %v", err)
+		slog.Error(response.Error)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
 	}
 
 	// Log the start of execution
-	log.Printf("Starting Buildkite metrics collection for project: %s", projectID)
+	slog.Info("Starting Buildkite metrics collection", "project_id", projectID)
 
-	// Check if we should skip this poll based on the last poll duration.
-	// This applies globally to all tokens when using multiple tokens.
 	startTime := time.Now()
-	if !nextPollTime.IsZero() && nextPollTime.After(startTime) {
-		timeUntilNextPoll := nextPollTime.Sub(startTime)
-		log.Printf("Skipping polling, next poll time is in %v", timeUntilNextPoll)
-
-		response.Success = true
-		response.Message = fmt.Sprintf("Skipping polling, next poll time is in %v", timeUntilNextPoll)
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(response)
-		return
-	}
 
 	// Initialize token provider (supports both env vars and Secret Manager)
 	provider, err := initTokenProvider()
 	if err != nil {
 		response.Success = false
 		response.Error = fmt.Sprintf("Failed to initialize token provider: %v", err)
-		log.Printf("ERROR: %s", response.Error)
+		slog.Error(response.Error)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(response)
 		return
@@ -231,13 +248,39 @@ func CollectMetrics(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		response.Success = false
 		response.Error = fmt.Sprintf("Failed to get tokens: %v", err)
-		log.Printf("ERROR: %s", response.Error)
+		slog.Error(response.Error)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(response)
 		return
 	}
 
-	log.Printf("Successfully retrieved %d agent token(s)", len(tokens))
+	slog.Info("Successfully retrieved agent tokens", "count", len(tokens))
+
+	// Check which tokens are due to be polled, based on their last poll
+	// durations. Tokens keep their position in the list for error details,
+	// and are scheduled by their name, which is their position, so that a
+	// token keeps its schedule when it is rotated.
+	due := make([]int, 0, len(tokens))
+	var timeUntilNextPoll time.Duration
+	for i := range tokens {
+		ok, wait := schedule.Due(tokenName(i), startTime)
+		if !ok {
+			if timeUntilNextPoll == 0 || wait < timeUntilNextPoll {
+				timeUntilNextPoll = wait
+			}
+			continue
+		}
+		due = append(due, i)
+	}
+	if len(due) == 0 {
+		slog.Info("Skipping polling", "next_poll", timeUntilNextPoll)
+
+		response.Success = true
+		response.Message = fmt.Sprintf("Skipping polling, next poll time is in %v", timeUntilNextPoll)
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
 
 	// Parse the queue list if provided
 	// If empty, we'll collect metrics for all queues in the organization
@@ -250,9 +293,34 @@ func CollectMetrics(w http.ResponseWriter, r *http.Request) {
 				queues = append(queues, queue)
 			}
 		}
-		log.Printf("Monitoring specific queues: %v", queues)
+		slog.Info("Monitoring specific queues", "queues", queues)
 	} else {
-		log.Println("Monitoring all queues in the organization")
+		slog.Info("Monitoring all queues in the organization")
+	}
+
+	// Parse the queue filter if provided
+	// It selects from all queues, so it can't be combined with specific queues
+	queueFilterEnv := os.Getenv("BUILDKITE_QUEUE_FILTER")
+	if queueFilterEnv != "" && len(queues) > 0 {
+		response.Success = false
+		response.Error = "BUILDKITE_QUEUE and BUILDKITE_QUEUE_FILTER can't both be set"
+		slog.Error(response.Error)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	queueFilter, err := collector.ParseQueueFilter(strings.Split(queueFilterEnv, ","))
+	if err != nil {
+		response.Success = false
+		response.Error = fmt.Sprintf("Invalid queue filter: %v", err)
+		slog.Error(response.Error)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if queueFilter != nil {
+		slog.Info("Filtering queues", "queue_filter", queueFilter.String())
 	}
 
 	// Create the Stackdriver backend for sending metrics
@@ -263,7 +331,7 @@ func CollectMetrics(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		response.Success = false
 		response.Error = fmt.Sprintf("Failed to create Stackdriver backend: %v", err)
-		log.Printf("ERROR: %s", response.Error)
+		slog.Error(response.Error)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(response)
 		return
@@ -277,7 +345,7 @@ func CollectMetrics(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		response.Success = false
 		response.Error = fmt.Sprintf("Invalid timeout value: %v", err)
-		log.Printf("ERROR: %s", response.Error)
+		slog.Error(response.Error)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(response)
 		return
@@ -287,7 +355,27 @@ func CollectMetrics(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		response.Success = false
 		response.Error = fmt.Sprintf("Invalid max idle connections value: %v", err)
-		log.Printf("ERROR: %s", response.Error)
+		slog.Error(response.Error)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	queueConcurrency, err := toIntWithDefault(os.Getenv("BUILDKITE_AGENT_METRICS_QUEUE_CONCURRENCY"), 1)
+	if err != nil {
+		response.Success = false
+		response.Error = fmt.Sprintf("Invalid queue concurrency value: %v", err)
+		slog.Error(response.Error)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	derivedMetrics, err := getDerivedMetrics()
+	if err != nil {
+		response.Success = false
+		response.Error = fmt.Sprintf("Invalid derived metrics configuration: %v", err)
+		slog.Error(response.Error)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(response)
 		return
@@ -296,132 +384,148 @@ func CollectMetrics(w http.ResponseWriter, r *http.Request) {
 	// Create HTTP client with configurable timeout and connections
 	httpClient := collector.NewHTTPClient(configuredTimeout, configuredMaxIdleConns)
 
+	// Parse the retry policy for failed Buildkite API requests
+	retryPolicy, err := getRetryPolicy()
+	if err != nil {
+		response.Success = false
+		response.Error = fmt.Sprintf("Invalid retry configuration: %v", err)
+		slog.Error(response.Error)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
 	// Build the User-Agent string to identify our client
 	userAgent := fmt.Sprintf("buildkite-agent-metrics/%s gcp-cloud-function", version.Version)
 
-	// Track the maximum poll duration across all tokens.
-	// NOTE: This means ALL tokens will wait for the longest duration returned.
-	// For example, if token A returns 30s and token B returns 60s, we wait 60s
-	// before polling either token again. This is conservative but may delay some
-	// tokens unnecessarily.
-	// TODO: Consider per-token poll duration tracking for more efficient polling.
-	var pollDuration time.Duration
-
-	// Collect metrics for each token
+	// Collect metrics for each due token concurrently
 	totalMetrics := 0
 	successfulTokens := 0
 	var tokenErrors []TokenErrorDetail
-
-	for i, token := range tokens {
-		log.Printf("Processing token %d of %d", i+1, len(tokens))
-
-		// Create collector for this token
-		bkCollector := &collector.Collector{
-			Client:    httpClient,
-			UserAgent: userAgent,
-			Endpoint:  endpoint,
-			Token:     token,
-			Queues:    queues,
-			Quiet:     quiet,
-			Debug:     debug,
-			DebugHttp: debugHTTP,
-		}
-
-		// Collect metrics from Buildkite API
-		log.Printf("Fetching metrics from Buildkite API for token %d...", i+1)
-
-		result, err := bkCollector.Collect()
-		if err != nil {
-			// Log the error but continue with other tokens
-			errorDetail := TokenErrorDetail{
-				TokenIndex: i + 1,
-				Error:      fmt.Sprintf("Failed to collect metrics: %v", err),
+	var mu sync.Mutex // guards the above
+	var wg sync.WaitGroup
+
+	for _, i := range due {
+		token := tokens[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			logger := slog.Default().With(logging.TokenKey, tokenName(i))
+			logger.Info("Processing token", "tokens", len(tokens))
+
+			// Create the Agent API source for this token
+			var source collector.Source = &collector.Collector{
+				Client:    httpClient,
+				UserAgent: userAgent,
+				Endpoint:  endpoint,
+				Token:     token,
+				Queues:    queues,
+				Quiet:     quiet,
+				DebugHttp: debugHTTP,
+				Logger:    logger,
+				Retry:     retryPolicy,
+
+				QueueConcurrency: queueConcurrency,
+				QueueFilter:      queueFilter,
+
+				PassthroughUnknownMetrics: passthroughUnknownMetrics,
+				DerivedMetrics:            derivedMetrics,
 			}
-			tokenErrors = append(tokenErrors, errorDetail)
-			log.Printf("ERROR for token %d: %s", i+1, errorDetail.Error)
-			continue
-		}
 
-		// Log what we collected (if not in quiet mode)
-		if !quiet {
-			log.Printf("Token %d - Collected metrics for organization: %s", i+1, result.Org)
-			if result.Cluster != "" {
-				log.Printf("Token %d - Cluster: %s", i+1, result.Cluster)
+			// Collect metrics from Buildkite API
+			logger.Info("Fetching metrics from Buildkite API")
+
+			result, err := collector.CollectContext(ctx, source)
+			if err != nil {
+				// Log the error but continue with other tokens
+				errorDetail := TokenErrorDetail{
+					TokenIndex: i + 1,
+					Error:      fmt.Sprintf("Failed to collect metrics: %v", err),
+				}
+				mu.Lock()
+				tokenErrors = append(tokenErrors, errorDetail)
+				mu.Unlock()
+				logger.Error(errorDetail.Error)
+				return
 			}
-			log.Printf("Token %d - Metrics collected: %d organization-wide, %d queue-specific",
-				i+1, len(result.Totals), countQueueMetrics(result))
-			// Dump detailed metrics for debugging (matching Lambda implementation)
-			result.Dump()
-		}
 
-		// Send the collected metrics to Stackdriver
-		log.Printf("Sending metrics to Stackdriver for token %d...", i+1)
-		err = metricsBackend.Collect(result)
-		if err != nil {
-			// Log the error but continue with other tokens
-			errorDetail := TokenErrorDetail{
-				TokenIndex: i + 1,
-				Cluster:    result.Cluster,
-				Error:      fmt.Sprintf("Failed to send metrics to Stackdriver: %v", err),
+			// Log what we collected. The collector has already logged the
+			// metrics themselves, unless it is quiet
+			logger = logger.With(logging.OrgKey, result.Org, logging.ClusterKey, result.Cluster)
+			logger.Info("Metrics collected", "organization_metrics", len(result.Totals), "queue_metrics", countQueueMetrics(result))
+
+			// Send the collected metrics to Stackdriver
+			logger.Info("Sending metrics to Stackdriver")
+			err = backend.CollectContext(ctx, metricsBackend, result)
+			if err != nil {
+				// Log the error but continue with other tokens
+				errorDetail := TokenErrorDetail{
+					TokenIndex: i + 1,
+					Cluster:    result.Cluster,
+					Error:      fmt.Sprintf("Failed to send metrics to Stackdriver: %v", err),
+				}
+				mu.Lock()
+				tokenErrors = append(tokenErrors, errorDetail)
+				mu.Unlock()
+				logger.Error(errorDetail.Error)
+				return
 			}
-			tokenErrors = append(tokenErrors, errorDetail)
-			log.Printf("ERROR for token %d: %s", i+1, errorDetail.Error)
-			continue
-		}
 
-		// Update poll duration - take the maximum across all tokens
-		if result.PollDuration > pollDuration {
-			pollDuration = result.PollDuration
-		}
+			// Update this token's poll time tracking after successful collection
+			schedule.Polled(tokenName(i), time.Now(), result.PollDuration)
+			if result.PollDuration > 0 {
+				logger.Info("Next poll allowed", "poll_duration", result.PollDuration)
+			}
 
-		// Track successful collections
-		successfulTokens++
-		tokenMetricsCount := len(result.Totals) + countQueueMetrics(result)
-		totalMetrics += tokenMetricsCount
+			// Track successful collections
+			tokenMetricsCount := len(result.Totals) + countQueueMetrics(result)
+			mu.Lock()
+			successfulTokens++
+			totalMetrics += tokenMetricsCount
+			mu.Unlock()
 
-		log.Printf("SUCCESS for token %d: Sent %d metrics to Stackdriver", i+1, tokenMetricsCount)
+			logger.Info("Sent metrics to Stackdriver", "metrics", tokenMetricsCount)
+		}()
 	}
+	wg.Wait()
+
+	// Report token errors in the order of the tokens
+	sort.Slice(tokenErrors, func(a, b int) bool {
+		return tokenErrors[a].TokenIndex < tokenErrors[b].TokenIndex
+	})
 
 	// Clean up backend resources if it implements the Closer interface
 	// (matching Lambda implementation for proper resource management)
 	if closer, ok := metricsBackend.(backend.Closer); ok {
 		if err := closer.Close(); err != nil {
-			log.Printf("WARNING: Failed to close backend: %v", err)
+			slog.Warn("Failed to close backend", logging.Err(err))
 		}
 	}
 
-	// Update poll time tracking after successful collection.
-	// This applies globally to all tokens.
-	lastPollTime = time.Now()
-	nextPollTime = time.Now().Add(pollDuration)
-	if pollDuration > 0 {
-		log.Printf("Next poll allowed in %v", pollDuration)
-	}
-
 	// Prepare response based on results
-	response.TokensProcessed = len(tokens)
+	response.TokensProcessed = len(due)
 	response.Metrics = totalMetrics
 	response.TokenErrors = tokenErrors
 
 	if successfulTokens == 0 {
 		// All tokens failed
 		response.Success = false
-		response.Error = fmt.Sprintf("All %d tokens failed to collect metrics", len(tokens))
-		log.Printf("ERROR: %s", response.Error)
+		response.Error = fmt.Sprintf("All %d tokens failed to collect metrics", len(due))
+		slog.Error(response.Error)
 		w.WriteHeader(http.StatusInternalServerError)
 	} else if len(tokenErrors) > 0 {
 		// Partial success
 		response.Success = true
 		response.Message = fmt.Sprintf("Successfully processed %d of %d tokens, collected %d total metrics. %d token(s) had errors.",
-			successfulTokens, len(tokens), totalMetrics, len(tokenErrors))
-		log.Printf("PARTIAL SUCCESS: %s", response.Message)
+			successfulTokens, len(due), totalMetrics, len(tokenErrors))
+		slog.Warn(response.Message)
 		w.WriteHeader(http.StatusOK)
 	} else {
 		// Complete success
 		response.Success = true
 		response.Message = fmt.Sprintf("Successfully processed all %d tokens and collected %d total metrics",
-			len(tokens), totalMetrics)
-		log.Printf("SUCCESS: %s", response.Message)
+			len(due), totalMetrics)
+		slog.Info(response.Message)
 		w.WriteHeader(http.StatusOK)
 	}
 
@@ -510,6 +614,85 @@ func toIntWithDefault(s string, defaultValue int) (int, error) {
 	return val, nil
 }
 
+// toDurationWithDefault parses a string such as "1s" to a duration with a
+// default value
+func toDurationWithDefault(s string, defaultValue time.Duration) (time.Duration, error) {
+	if s == "" {
+		return defaultValue, nil
+	}
+
+	val, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse '%s' as duration: %w", s, err)
+	}
+
+	return val, nil
+}
+
+// toFloatWithDefault parses a string to float64 with a default value
+func toFloatWithDefault(s string, defaultValue float64) (float64, error) {
+	if s == "" {
+		return defaultValue, nil
+	}
+
+	val, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse '%s' as number: %w", s, err)
+	}
+
+	return val, nil
+}
+
+// getDerivedMetrics returns the configuration for derived autoscaling metrics,
+// or nil if they aren't enabled.
+func getDerivedMetrics() (*collector.DerivedMetrics, error) {
+	enabled := os.Getenv("BUILDKITE_AGENT_METRICS_DERIVED_METRICS")
+	if enabled != "1" && enabled != "true" {
+		return nil, nil
+	}
+
+	var (
+		derived collector.DerivedMetrics
+		err     error
+	)
+	derived.JobsPerAgent, err = toFloatWithDefault(os.Getenv("BUILDKITE_AGENT_METRICS_JOBS_PER_AGENT"), 1)
+	if err != nil {
+		return nil, err
+	}
+	derived.SpareCapacityPercent, err = toFloatWithDefault(os.Getenv("BUILDKITE_AGENT_METRICS_SPARE_CAPACITY_PERCENT"), 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := derived.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &derived, nil
+}
+
+// getRetryPolicy returns the retry policy for Buildkite API requests,
+// starting from collector.DefaultRetryPolicy and applying any overrides from
+// environment variables.
+func getRetryPolicy() (collector.RetryPolicy, error) {
+	policy := collector.DefaultRetryPolicy
+
+	var err error
+	policy.MaxAttempts, err = toIntWithDefault(os.Getenv("BUILDKITE_AGENT_METRICS_RETRY_MAX_ATTEMPTS"), policy.MaxAttempts)
+	if err != nil {
+		return policy, err
+	}
+	policy.InitialBackoff, err = toDurationWithDefault(os.Getenv("BUILDKITE_AGENT_METRICS_RETRY_INITIAL_BACKOFF"), policy.InitialBackoff)
+	if err != nil {
+		return policy, err
+	}
+	policy.MaxBackoff, err = toDurationWithDefault(os.Getenv("BUILDKITE_AGENT_METRICS_RETRY_MAX_BACKOFF"), policy.MaxBackoff)
+	if err != nil {
+		return policy, err
+	}
+
+	return policy, nil
+}
+
 // getEndpoint returns the Buildkite API endpoint to use.
 // It checks for a custom endpoint in environment variables,
 // otherwise returns the default production endpoint.
@@ -542,6 +725,18 @@ func isDebugHTTPMode() bool {
 	return debugHTTP == "1" || debugHTTP == "true"
 }
 
+// isPassthroughUnknownMetricsMode checks if numeric fields of Buildkite API
+// responses that the collector doesn't know about should also be published.
+func isPassthroughUnknownMetricsMode() bool {
+	passthrough := os.Getenv("BUILDKITE_AGENT_METRICS_PASSTHROUGH_UNKNOWN_METRICS")
+	return passthrough == "1" || passthrough == "true"
+}
+
+// tokenName names the token at index i in logs and the poll schedule.
+func tokenName(i int) string {
+	return fmt.Sprintf("token %d", i+1)
+}
+
 // countQueueMetrics counts the total number of metrics across all queues.
 // This is used for reporting how many metrics were collected.
 func countQueueMetrics(result *collector.Result) int {
@@ -552,15 +747,6 @@ func countQueueMetrics(result *collector.Result) int {
 	return count
 }
 
-// nullWriter is a writer that discards all data written to it.
-// Used to suppress logs in quiet mode.
-type nullWriter struct{}
-
-// Write implements io.Writer interface but discards all data
-func (nullWriter) Write([]byte) (int, error) {
-	return 0, nil
-}
-
 // HealthCheck is an optional endpoint that can be used to verify the function is deployed.
 // You can register this as a separate function if you want a health check endpoint.
 func HealthCheck(w http.ResponseWriter, r *http.Request) {
@@ -3,6 +3,7 @@ package cloudfunction
 import (
 	"os"
 	"testing"
+	"time"
 )
 
 func TestInitTokenProvider(t *testing.T) {
@@ -185,6 +186,36 @@ func TestToIntWithDefault(t *testing.T) {
 	}
 }
 
+func TestToDurationWithDefault(t *testing.T) {
+	tests := []struct {
+		name         string
+		input        string
+		defaultValue time.Duration
+		want         time.Duration
+		wantErr      bool
+	}{
+		{"empty_string_returns_default", "", time.Second, time.Second, false},
+		{"valid_duration", "250ms", time.Second, 250 * time.Millisecond, false},
+		{"bare_number", "5", time.Second, 0, true},
+		{"invalid_duration", "soon", time.Second, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := toDurationWithDefault(tt.input, tt.defaultValue)
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("toDurationWithDefault() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			if got != tt.want {
+				t.Errorf("toDurationWithDefault() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestIsQuietMode(t *testing.T) {
 	// Save original env var
 	orig := os.Getenv("BUILDKITE_QUIET")
@@ -1,11 +1,13 @@
 package collector
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"maps"
 	"net"
 	"net/http"
@@ -13,10 +15,13 @@ import (
 	"net/http/httputil"
 	"net/textproto"
 	"net/url"
-	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/buildkite/buildkite-agent-metrics/v5/logging"
 )
 
 const (
@@ -29,6 +34,12 @@ const (
 	TotalAgentCount     = "TotalAgentCount"
 	BusyAgentPercentage = "BusyAgentPercentage"
 
+	// QueueCollectionFailed is published with a value of 1 for each queue in
+	// Result.QueueErrors, and 0 for each queue in Result.Queues except in New
+	// Relic events. It is not part of AllMetrics, because it only applies to
+	// queues and has no value from the Agent API.
+	QueueCollectionFailed = "QueueCollectionFailed"
+
 	PollDurationHeader = `Buildkite-Agent-Metrics-Poll-Duration`
 )
 
@@ -43,17 +54,81 @@ var AllMetrics = []string{
 	BusyAgentPercentage,
 }
 
-var traceLog = log.New(os.Stderr, "TRACE", log.Ldate|log.Ltime|log.Lmicroseconds|log.Lshortfile|log.Lmsgprefix)
-
 type Collector struct {
 	Client    *http.Client
 	Endpoint  string
 	Token     string
 	UserAgent string
 	Queues    []string
-	Quiet     bool
-	Debug     bool
+
+	// Quiet stops the metrics in each Result from being logged.
+	Quiet bool
+
+	// Debug has no effect.
+	//
+	// Deprecated: Set the level of Logger to slog.LevelDebug instead.
+	Debug bool
+
+	// DebugHttp logs each request and response, with the token redacted, and
+	// how the connection for it was made, at slog.LevelDebug.
 	DebugHttp bool
+
+	// Logger is where the collector logs to. If it is nil, slog.Default() is
+	// used.
+	Logger *slog.Logger
+
+	// QueueConcurrency is the maximum number of per-queue requests made at
+	// once when Queues is set. Values below 2 fetch one queue at a time.
+	QueueConcurrency int
+
+	// Retry controls how failed Agent API requests are retried. The zero
+	// value makes a single attempt.
+	Retry RetryPolicy
+
+	// QueueFilter selects which queues from the all-queues response are
+	// kept in Result.Queues. It is not used when Queues is set, and a nil
+	// filter keeps every queue. Totals always cover every queue.
+	QueueFilter *QueueFilter
+
+	// PassthroughUnknownMetrics adds numeric fields of the agents and jobs
+	// objects in Agent API responses that the collector does not otherwise
+	// know about to Result.Totals and Result.Queues, named by
+	// PassthroughMetricName. This makes new metrics available before the
+	// collector is updated to know about them.
+	PassthroughUnknownMetrics bool
+
+	// DerivedMetrics, if set, adds RequiredAgentCount, AgentDeficit and
+	// AgentSurplus to Result.Totals and Result.Queues.
+	DerivedMetrics *DerivedMetrics
+
+	// Window, if set, adds statistics over a rolling window of results,
+	// including any derived metrics, to each Result. It is only useful when
+	// the same Collector is used repeatedly, such as in daemon mode.
+	Window *Window
+
+	// SelfMetrics, if set, records metrics about the health of the
+	// collector, and they are added to Result.SelfMetrics.
+	SelfMetrics *SelfMetrics
+
+	// Staleness, if set, decides what FailedResult returns for publishing
+	// when a collection fails, and adds AgentMetricsStale to
+	// Result.SelfMetrics.
+	Staleness *Staleness
+
+	// TokenProvider, if set, is asked for the token again when the Agent API
+	// rejects Token with a 401, such as after it has been rotated. If it
+	// gives a different token, that replaces Token and the request is made
+	// once more with it.
+	TokenProvider TokenProvider
+
+	// tokenMu guards Token once it can be replaced by TokenProvider.
+	tokenMu sync.Mutex
+}
+
+// TokenProvider provides the token for the Agent API, such as a
+// token.Provider.
+type TokenProvider interface {
+	Get() (string, error)
 }
 
 type Result struct {
@@ -62,6 +137,21 @@ type Result struct {
 	Org          string
 	Cluster      string
 	PollDuration time.Duration
+
+	// QueueErrors holds the error for each queue whose metrics could not be
+	// collected. Such queues are absent from Queues.
+	QueueErrors map[string]error
+
+	// SelfMetrics holds metrics about the health of the collector itself,
+	// when Collector.SelfMetrics is set. They apply to the organization and
+	// cluster as a whole, rather than any queue.
+	SelfMetrics map[string]int
+
+	// Stale is set when collecting the metrics for Org and Cluster has failed
+	// too many times in a row, according to Collector.Staleness. Backends
+	// should drop the metrics they hold for Org and Cluster, or stop sending
+	// them. Only SelfMetrics are set in a stale Result.
+	Stale bool
 }
 
 type organizationResponse struct {
@@ -90,6 +180,10 @@ type queueMetricsResponse struct {
 	Jobs         metricsJobsResponse   `json:"jobs"`
 	Organization organizationResponse  `json:"organization"`
 	Cluster      clusterResponse       `json:"cluster"`
+
+	// unknown holds the passed through metrics when PassthroughUnknownMetrics
+	// is set.
+	unknown map[string]int
 }
 
 type allMetricsAgentsResponse struct {
@@ -112,6 +206,10 @@ type allMetricsResponse struct {
 type HTTPError struct {
 	StatusCode int    `json:"-"`
 	Message    string `json:"message"`
+
+	// RetryAfter is the delay requested by a Retry-After header on a 429 or
+	// 503 response, or 0 if there was none.
+	RetryAfter time.Duration `json:"-"`
 }
 
 func (e HTTPError) Error() string {
@@ -123,6 +221,11 @@ func handleHTTPError(res *http.Response) error {
 		return nil
 	}
 
+	var retryAfter time.Duration
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable {
+		retryAfter = parseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+	}
+
 	bodyBytes, err := io.ReadAll(res.Body)
 	if err != nil {
 		return fmt.Errorf("failed to read error response body (status: %d): %w", res.StatusCode, err)
@@ -136,6 +239,7 @@ func handleHTTPError(res *http.Response) error {
 		}
 
 		httpErr.StatusCode = res.StatusCode
+		httpErr.RetryAfter = retryAfter
 
 		return httpErr
 	}
@@ -143,72 +247,75 @@ func handleHTTPError(res *http.Response) error {
 	return HTTPError{
 		StatusCode: res.StatusCode,
 		Message:    string(bodyBytes),
+		RetryAfter: retryAfter,
 	}
 }
 
+// Collect fetches metrics from the Buildkite Agent API. It is equivalent to
+// calling CollectContext with context.Background().
 func (c *Collector) Collect() (*Result, error) {
+	return c.CollectContext(context.Background())
+}
+
+// CollectContext fetches metrics from the Buildkite Agent API. Every request is
+// bound to ctx, so cancelling ctx or reaching its deadline aborts any in-flight
+// request and returns the context's error.
+func (c *Collector) CollectContext(ctx context.Context) (*Result, error) {
 	result := &Result{
-		Totals: map[string]int{},
-		Queues: map[string]map[string]int{},
+		Totals:      map[string]int{},
+		Queues:      map[string]map[string]int{},
+		QueueErrors: map[string]error{},
 	}
 
+	start := time.Now()
+	var err error
 	if len(c.Queues) == 0 {
-		if err := c.collectAllQueues(result); err != nil {
-			return nil, err
-		}
+		err = c.collectAllQueues(ctx, result)
 	} else {
-		for _, queue := range c.Queues {
-			if err := c.collectQueue(result, queue); err != nil {
-				return nil, err
-			}
-		}
+		err = c.collectQueues(ctx, result)
 	}
-
-	if !c.Quiet {
-		result.Dump()
+	c.SelfMetrics.collection(result, err, start, time.Now())
+	if err != nil {
+		return nil, err
 	}
 
-	return result, nil
-}
-
-func (c *Collector) collectAllQueues(result *Result) error {
-	log.Println("Collecting agent metrics for all queues")
+	if c.DerivedMetrics != nil {
+		c.DerivedMetrics.Apply(result)
+	}
 
-	endpoint, err := url.Parse(c.Endpoint)
-	if err != nil {
-		return err
+	if c.Window != nil {
+		c.Window.Apply(result, time.Now())
 	}
 
-	endpoint.Path += "/metrics"
+	result.SelfMetrics = c.SelfMetrics.Metrics()
+	c.Staleness.succeeded(result)
 
-	req, err := http.NewRequest("GET", endpoint.String(), nil)
-	if err != nil {
-		return err
+	if !c.Quiet {
+		result.dump(c.logger())
 	}
 
-	req.Header.Set("User-Agent", c.UserAgent)
-	req.Header.Set("Authorization", fmt.Sprintf("Token %s", c.Token))
+	return result, nil
+}
 
-	if c.DebugHttp {
-		req = traceHTTPRequest(req)
+func (c *Collector) collectAllQueues(ctx context.Context, result *Result) error {
+	if c.QueueFilter != nil {
+		c.logger().Info("Collecting agent metrics for all queues matching filter", "queue_filter", c.QueueFilter.String())
+	} else {
+		c.logger().Info("Collecting agent metrics for all queues")
 	}
 
-	res, err := c.Client.Do(req)
+	endpoint, err := url.Parse(c.Endpoint)
 	if err != nil {
 		return err
 	}
-	defer res.Body.Close() //nolint:errcheck // this is idiomatic for http response bodies
 
-	if c.DebugHttp {
-		if dump, err := httputil.DumpResponse(res, true); err == nil {
-			traceLog.Printf("response uri=%s\n%s", req.URL, dump)
-		}
-	}
+	endpoint.Path += "/metrics"
 
-	err = handleHTTPError(res)
+	res, err := c.get(ctx, endpoint.String())
 	if err != nil {
 		return fmt.Errorf("making http request to fetch all metrics: %w", err)
 	}
+	defer res.Body.Close() //nolint:errcheck // this is idiomatic for http response bodies
 
 	var allMetrics allMetricsResponse
 
@@ -216,22 +323,28 @@ func (c *Collector) collectAllQueues(result *Result) error {
 	if pollSeconds := res.Header.Get(PollDurationHeader); pollSeconds != "" {
 		pollSecondsInt, err := strconv.ParseInt(pollSeconds, 10, 64)
 		if err != nil {
-			log.Printf("Failed to parse %s header: %v", PollDurationHeader, err)
+			c.logger().Warn("Failed to parse header", "header", PollDurationHeader, logging.Err(err))
 		} else {
 			result.PollDuration = time.Duration(pollSecondsInt) * time.Second
 		}
 	}
 
-	err = json.NewDecoder(res.Body).Decode(&allMetrics)
+	body, err := io.ReadAll(res.Body)
 	if err != nil {
 		return err
 	}
 
+	err = json.Unmarshal(body, &allMetrics)
+	if err != nil {
+		c.SelfMetrics.decodeError()
+		return err
+	}
+
 	if allMetrics.Organization.Slug == "" {
 		return fmt.Errorf("no organization slug was found in the metrics response")
 	}
 
-	log.Printf("Found organization %q, cluster %q", allMetrics.Organization.Slug, allMetrics.Cluster.Name)
+	c.logger().Info("Found organization", logging.OrgKey, allMetrics.Organization.Slug, logging.ClusterKey, allMetrics.Cluster.Name)
 	result.Org = allMetrics.Organization.Slug
 	result.Cluster = allMetrics.Cluster.Name
 
@@ -245,6 +358,9 @@ func (c *Collector) collectAllQueues(result *Result) error {
 	result.Totals[BusyAgentPercentage] = busyAgentPercentage(allMetrics.Agents.metricsAgentsResponse)
 
 	for queueName, queueJobMetrics := range allMetrics.Jobs.Queues {
+		if !c.QueueFilter.Match(queueName) {
+			continue
+		}
 		if _, ok := result.Queues[queueName]; !ok {
 			result.Queues[queueName] = map[string]int{}
 		}
@@ -255,6 +371,9 @@ func (c *Collector) collectAllQueues(result *Result) error {
 	}
 
 	for queueName, queueAgentMetrics := range allMetrics.Agents.Queues {
+		if !c.QueueFilter.Match(queueName) {
+			continue
+		}
 		if _, ok := result.Queues[queueName]; !ok {
 			result.Queues[queueName] = map[string]int{}
 		}
@@ -264,74 +383,258 @@ func (c *Collector) collectAllQueues(result *Result) error {
 		result.Queues[queueName][BusyAgentPercentage] = busyAgentPercentage(queueAgentMetrics)
 	}
 
+	if c.PassthroughUnknownMetrics {
+		if err := passthroughAllQueues(body, result); err != nil {
+			c.SelfMetrics.decodeError()
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (c *Collector) collectQueue(result *Result, queue string) error {
-	log.Printf("Collecting agent metrics for queue '%s'", queue)
+// collectQueues fetches the metrics for each of c.Queues, making up to
+// c.QueueConcurrency requests at a time, and merges them into result in the
+// order the queues were given.
+//
+// A queue that fails is recorded in result.QueueErrors so the other queues can
+// still be published. The first error in c.Queues order is returned instead if
+// it affects every queue (such as an invalid token or a cancelled context), or
+// if no queue succeeded.
+func (c *Collector) collectQueues(ctx context.Context, result *Result) error {
+	type queueResult struct {
+		metrics *queueMetricsResponse
+		err     error
+	}
+	results := make([]queueResult, len(c.Queues))
+
+	workers := min(max(c.QueueConcurrency, 1), len(c.Queues))
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Go(func() {
+			for i := range indexes {
+				results[i].metrics, results[i].err = c.collectQueue(ctx, c.Queues[i])
+			}
+		})
+	}
+	for i := range c.Queues {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	var firstErr error
+	for i, queue := range c.Queues {
+		if err := results[i].err; err != nil {
+			if !isQueueError(err) {
+				return err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			c.logger().Warn("Failed to collect agent metrics for queue", logging.QueueKey, queue, logging.Err(err))
+			result.QueueErrors[queue] = err
+			continue
+		}
+		queueMetrics := results[i].metrics
+
+		result.Org = queueMetrics.Organization.Slug
+		result.Cluster = queueMetrics.Cluster.Name
+
+		result.Queues[queue] = map[string]int{
+			ScheduledJobsCount:  queueMetrics.Jobs.Scheduled,
+			RunningJobsCount:    queueMetrics.Jobs.Running,
+			UnfinishedJobsCount: queueMetrics.Jobs.Total,
+			WaitingJobsCount:    queueMetrics.Jobs.Waiting,
+			IdleAgentCount:      queueMetrics.Agents.Idle,
+			BusyAgentCount:      queueMetrics.Agents.Busy,
+			TotalAgentCount:     queueMetrics.Agents.Total,
+			BusyAgentPercentage: busyAgentPercentage(queueMetrics.Agents),
+		}
+		for name, value := range queueMetrics.unknown {
+			if _, exists := result.Queues[queue][name]; !exists {
+				result.Queues[queue][name] = value
+			}
+		}
+	}
+
+	if len(result.Queues) == 0 {
+		return firstErr
+	}
+
+	return nil
+}
+
+// isQueueError reports whether err, from fetching a single queue's metrics,
+// is specific to that queue rather than something that would affect them all.
+func isQueueError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var httpErr HTTPError
+	if errors.As(err, &httpErr) {
+		switch httpErr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *Collector) collectQueue(ctx context.Context, queue string) (*queueMetricsResponse, error) {
+	c.logger().Info("Collecting agent metrics for queue", logging.QueueKey, queue)
 
 	endpoint, err := url.Parse(c.Endpoint)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	endpoint.Path += "/metrics/queue"
 	endpoint.RawQuery = url.Values{"name": {queue}}.Encode()
 
-	req, err := http.NewRequest("GET", endpoint.String(), nil)
+	res, err := c.get(ctx, endpoint.String())
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("making http request to fetch metrics for queue %q: %w", queue, err)
 	}
+	defer res.Body.Close() //nolint:errcheck // this is idiomatic for http response bodies
 
-	req.Header.Set("User-Agent", c.UserAgent)
-	req.Header.Set("Authorization", fmt.Sprintf("Token %s", c.Token))
-
-	if c.DebugHttp {
-		req = traceHTTPRequest(req)
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
 	}
 
-	res, err := c.Client.Do(req)
+	var queueMetrics queueMetricsResponse
+	err = json.Unmarshal(body, &queueMetrics)
 	if err != nil {
-		return err
+		c.SelfMetrics.decodeError()
+		return nil, err
 	}
-	defer res.Body.Close() //nolint:errcheck // this is idiomatic for http response bodies
 
-	if c.DebugHttp {
-		if dump, err := httputil.DumpResponse(res, true); err == nil {
-			traceLog.Printf("response uri=%s\n%s", req.URL, dump)
+	if c.PassthroughUnknownMetrics {
+		queueMetrics.unknown, err = passthroughQueue(body)
+		if err != nil {
+			c.SelfMetrics.decodeError()
+			return nil, err
 		}
 	}
 
-	err = handleHTTPError(res)
+	if queueMetrics.Organization.Slug == "" {
+		return nil, fmt.Errorf("no organization slug was found in the metrics response")
+	}
+
+	c.logger().Info("Found organization", logging.OrgKey, queueMetrics.Organization.Slug, logging.ClusterKey, queueMetrics.Cluster.Name, logging.QueueKey, queue)
+	return &queueMetrics, nil
+}
+
+// get makes a GET request to the Agent API, retrying according to c.Retry. If
+// it returns a nil error, the response has a 2xx status and the caller must
+// close its body.
+func (c *Collector) get(ctx context.Context, u string) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		res, err := c.getAuthorized(ctx, u)
+		if err == nil {
+			return res, nil
+		}
+
+		delay, retry := c.Retry.delay(attempt+1, err)
+		if !retry {
+			return nil, err
+		}
+
+		c.logger().Warn("Request failed, retrying", "url", u, "delay", delay, "attempt", attempt+1, "max_attempts", c.Retry.MaxAttempts, logging.Err(err))
+		if err := sleepContext(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// getAuthorized makes a GET request to the Agent API. If the token is rejected
+// and c.TokenProvider gives a new one, it makes the request once more with the
+// new token.
+func (c *Collector) getAuthorized(ctx context.Context, u string) (*http.Response, error) {
+	token := c.token()
+	res, err := c.getOnce(ctx, u, token)
+
+	var httpErr HTTPError
+	if c.TokenProvider == nil || !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+
+	refreshed, refreshErr := c.refreshToken(token)
+	if refreshErr != nil {
+		return nil, fmt.Errorf("%w (refreshing the token failed: %v)", err, refreshErr)
+	}
+	if refreshed == token {
+		return nil, err
+	}
+
+	c.logger().Info("Token was rejected, retrying request with a refreshed token", "url", u)
+	return c.getOnce(ctx, u, refreshed)
+}
+
+// token returns the token to make requests with.
+func (c *Collector) token() string {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	return c.Token
+}
+
+// refreshToken replaces the rejected token with one from c.TokenProvider,
+// unless a concurrent request has already replaced it, and returns the token
+// to retry with.
+func (c *Collector) refreshToken(rejected string) (string, error) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+
+	if c.Token != rejected {
+		return c.Token, nil
+	}
+	token, err := c.TokenProvider.Get()
 	if err != nil {
-		return fmt.Errorf("making http request to fetch metrics for queue %q: %w", queue, err)
+		return "", err
 	}
+	c.Token = token
+	return token, nil
+}
 
-	var queueMetrics queueMetricsResponse
-	err = json.NewDecoder(res.Body).Decode(&queueMetrics)
+// getOnce makes a single GET request to the Agent API with token.
+func (c *Collector) getOnce(ctx context.Context, u, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if queueMetrics.Organization.Slug == "" {
-		return fmt.Errorf("no organization slug was found in the metrics response")
+	req.Header.Set("User-Agent", c.UserAgent)
+	req.Header.Set("Authorization", fmt.Sprintf("Token %s", token))
+
+	if c.DebugHttp {
+		req = traceHTTPRequest(req, c.logger())
 	}
 
-	log.Printf("Found organization %q, cluster %q", queueMetrics.Organization.Slug, queueMetrics.Cluster.Name)
-	result.Org = queueMetrics.Organization.Slug
-	result.Cluster = queueMetrics.Cluster.Name
+	start := time.Now()
+	res, err := c.Client.Do(req)
+	if err != nil {
+		c.SelfMetrics.request(0, time.Since(start))
+		return nil, err
+	}
+	c.SelfMetrics.request(res.StatusCode, time.Since(start))
 
-	result.Queues[queue] = map[string]int{
-		ScheduledJobsCount:  queueMetrics.Jobs.Scheduled,
-		RunningJobsCount:    queueMetrics.Jobs.Running,
-		UnfinishedJobsCount: queueMetrics.Jobs.Total,
-		WaitingJobsCount:    queueMetrics.Jobs.Waiting,
-		IdleAgentCount:      queueMetrics.Agents.Idle,
-		BusyAgentCount:      queueMetrics.Agents.Busy,
-		TotalAgentCount:     queueMetrics.Agents.Total,
-		BusyAgentPercentage: busyAgentPercentage(queueMetrics.Agents),
+	if c.DebugHttp {
+		if dump, err := httputil.DumpResponse(res, true); err == nil {
+			c.logger().Debug("HTTP response", "url", req.URL.String(), "dump", string(dump))
+		}
 	}
-	return nil
+
+	if err := handleHTTPError(res); err != nil {
+		res.Body.Close() //nolint:errcheck // the body has already been read
+		return nil, err
+	}
+
+	return res, nil
 }
 
 func busyAgentPercentage(agents metricsAgentsResponse) int {
@@ -341,63 +644,129 @@ func busyAgentPercentage(agents metricsAgentsResponse) int {
 	return 0
 }
 
+// FailedQueues returns a QueueCollectionFailed metric with a value of 1 for
+// each queue in QueueErrors, shaped like Queues so that backends can publish
+// it the same way.
+func (r Result) FailedQueues() map[string]map[string]int {
+	failed := make(map[string]map[string]int, len(r.QueueErrors))
+	for queue := range r.QueueErrors {
+		failed[queue] = map[string]int{QueueCollectionFailed: 1}
+	}
+	return failed
+}
+
+// QueueCollectionStatus returns a QueueCollectionFailed metric for each queue,
+// with a value of 0 for those in Queues and 1 for those in QueueErrors, shaped
+// like Queues so that backends can publish it the same way.
+func (r Result) QueueCollectionStatus() map[string]map[string]int {
+	status := r.FailedQueues()
+	for queue := range r.Queues {
+		status[queue] = map[string]int{QueueCollectionFailed: 0}
+	}
+	return status
+}
+
+// OnlySelfMetrics reports whether r holds nothing but self metrics, as
+// published when a collection fails. Unless r is Stale, backends should leave
+// the metrics for the organization's agents and queues as they were for such a
+// result.
+func (r Result) OnlySelfMetrics() bool {
+	return r.Totals == nil && r.Queues == nil && r.QueueErrors == nil
+}
+
+// Dump logs the metrics in r with slog.Default(), as the collector does after
+// each collection unless it is Quiet.
 func (r Result) Dump() {
-	for name, c := range r.Totals {
-		log.Printf("Buildkite > Org=%s > %s=%d", r.Org, name, c)
+	r.dump(slog.Default())
+}
+
+// dump logs the totals in r, then the metrics for each queue, any queues that
+// failed, and the self metrics, each as a single record. Metrics are grouped
+// under "metrics" and sorted by name, as are queues.
+func (r Result) dump(logger *slog.Logger) {
+	logger = logger.With(logging.OrgKey, r.Org, logging.ClusterKey, r.Cluster)
+
+	if len(r.Totals) > 0 {
+		logger.Info("Collected metrics", metricsAttr(r.Totals))
 	}
 
-	for name, c := range r.Queues {
-		for k, v := range c {
-			log.Printf("Buildkite > Org=%s > Queue=%s > %s=%d", r.Org, name, k, v)
-		}
+	for _, name := range slices.Sorted(maps.Keys(r.Queues)) {
+		logger.Info("Collected metrics", logging.QueueKey, name, metricsAttr(r.Queues[name]))
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(r.QueueErrors)) {
+		logger.Warn("Failed to collect metrics", logging.QueueKey, name, "metric", QueueCollectionFailed, logging.Err(r.QueueErrors[name]))
+	}
+
+	if len(r.SelfMetrics) > 0 {
+		logger.Info("Collected self metrics", metricsAttr(r.SelfMetrics))
 	}
 }
 
-func traceHTTPRequest(req *http.Request) *http.Request {
+// metricsAttr returns metrics as a group of attributes sorted by name.
+func metricsAttr(metrics map[string]int) slog.Attr {
+	attrs := make([]any, 0, len(metrics))
+	for _, name := range slices.Sorted(maps.Keys(metrics)) {
+		attrs = append(attrs, slog.Int(name, metrics[name]))
+	}
+	return slog.Group("metrics", attrs...)
+}
+
+// logger returns the logger for c.
+func (c *Collector) logger() *slog.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return slog.Default()
+}
+
+// traceHTTPRequest logs req, and how the connection for it is made, at
+// slog.LevelDebug.
+func traceHTTPRequest(req *http.Request, logger *slog.Logger) *http.Request {
 	trace := &httptrace.ClientTrace{
 		GetConn: func(hostPort string) {
-			traceLog.Printf("getting connection to %s\n", hostPort)
+			logger.Debug("Getting connection", "host_port", hostPort)
 		},
 		GotConn: func(info httptrace.GotConnInfo) {
-			traceLog.Printf("got connection [reused?: %t, idle?: %t (time: %v)]", info.Reused, info.WasIdle, info.IdleTime)
+			logger.Debug("Got connection", "reused", info.Reused, "was_idle", info.WasIdle, "idle_time", info.IdleTime)
 		},
 		PutIdleConn: func(err error) {
 			if err != nil {
-				traceLog.Printf("Failed to put connection idle with error - %v", err)
+				logger.Debug("Failed to put connection idle", logging.Err(err))
 				return
 			}
-			traceLog.Printf("connection successfully put idle")
+			logger.Debug("Put connection idle")
 		},
 		GotFirstResponseByte: func() {
-			traceLog.Printf("received first response byte")
+			logger.Debug("Received first response byte")
 		},
 		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
-			traceLog.Printf("received %d with header %v", code, header)
+			logger.Debug("Received informational response", "status", code, "header", header)
 			return nil
 		},
 		DNSStart: func(_ httptrace.DNSStartInfo) {
-			traceLog.Print("dns start")
+			logger.Debug("DNS lookup started")
 		},
 		DNSDone: func(_ httptrace.DNSDoneInfo) {
-			traceLog.Print("dns done")
+			logger.Debug("DNS lookup done")
 		},
 		ConnectStart: func(_, _ string) {
-			traceLog.Print("connection start")
+			logger.Debug("Connecting")
 		},
 		ConnectDone: func(_, _ string, _ error) {
-			traceLog.Print("connection done")
+			logger.Debug("Connected")
 		},
 		TLSHandshakeStart: func() {
-			traceLog.Print("TLS Handshake start")
+			logger.Debug("TLS handshake started")
 		},
 		TLSHandshakeDone: func(_ tls.ConnectionState, _ error) {
-			traceLog.Print("TLS Handshake done")
+			logger.Debug("TLS handshake done")
 		},
 		WroteHeaders: func() {
-			traceLog.Print("wrote headers")
+			logger.Debug("Wrote headers")
 		},
 		WroteRequest: func(_ httptrace.WroteRequestInfo) {
-			traceLog.Print("wrote request")
+			logger.Debug("Wrote request")
 		},
 	}
 
@@ -412,30 +781,58 @@ func traceHTTPRequest(req *http.Request) *http.Request {
 
 	dump, err := httputil.DumpRequest(req, true)
 	if err != nil {
-		traceLog.Printf("Couldn't dump request: %v", err)
+		logger.Debug("Couldn't dump request", logging.Err(err))
 		return req
 	}
-	traceLog.Printf("request uri=%s\n%s", req.URL, dump)
+	logger.Debug("HTTP request", "url", req.URL.String(), "dump", string(dump))
 	return req
 }
 
-func NewHTTPClient(timeout, maxIdleConns int) *http.Client {
+// NewHTTPClient returns an HTTP client for the Agent API. timeout, in seconds,
+// limits each request as a whole, as well as connecting and waiting for a
+// response unless options set those separately. If an option sets a longer
+// timeout, that limits each request as a whole instead, so that it can take
+// effect.
+func NewHTTPClient(timeout, maxIdleConns int, opts ...HTTPClientOption) *http.Client {
 
 	connectionTimeout := time.Duration(timeout) * time.Second
 
+	cfg := httpClientConfig{
+		connectTimeout:  connectionTimeout,
+		responseTimeout: connectionTimeout,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if cfg.proxy != nil {
+		proxy = http.ProxyURL(cfg.proxy)
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.rootCAs != nil || len(cfg.certificates) > 0 {
+		tlsConfig = &tls.Config{
+			RootCAs:      cfg.rootCAs,
+			Certificates: cfg.certificates,
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+
 	return &http.Client{
-		Timeout: connectionTimeout,
+		Timeout: max(connectionTimeout, cfg.connectTimeout, cfg.responseTimeout),
 		Transport: &http.Transport{
-			Proxy:                 http.ProxyFromEnvironment,
+			Proxy:                 proxy,
 			MaxIdleConns:          maxIdleConns,
 			IdleConnTimeout:       connectionTimeout,
-			ResponseHeaderTimeout: connectionTimeout,
+			ResponseHeaderTimeout: cfg.responseTimeout,
 			DisableKeepAlives:     false,
-			Dial: (&net.Dialer{
-				Timeout:   connectionTimeout,
+			DialContext: (&net.Dialer{
+				Timeout:   cfg.connectTimeout,
 				KeepAlive: connectionTimeout,
-			}).Dial,
-			TLSHandshakeTimeout: connectionTimeout,
+			}).DialContext,
+			TLSHandshakeTimeout: cfg.connectTimeout,
+			TLSClientConfig:     tlsConfig,
 		},
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
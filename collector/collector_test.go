@@ -1,12 +1,18 @@
 package collector
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 func TestCollectorWithEmptyResponseForAllQueues(t *testing.T) {
@@ -293,3 +299,211 @@ func TestCollectorWithProxy(t *testing.T) {
 		t.Fatalf("Proxy was not picked up from env.")
 	}
 }
+
+func TestCollectorPassthroughUnknownMetrics(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metrics":
+			_, _ = io.WriteString(w, `{
+				"organization": {"slug": "test"},
+				"jobs": {
+					"scheduled": 3,
+					"assigned": 2,
+					"unfinished": 99,
+					"label": "not a number",
+					"queues": {
+						"default": {"scheduled": 3, "assigned": 2, "avg_wait": 1.6}
+					}
+				},
+				"agents": {
+					"total": 4,
+					"stale_connected": 1,
+					"queues": {
+						"default": {"total": 4, "stale_connected": 1}
+					}
+				}
+			}`)
+		case "/metrics/queue":
+			_, _ = io.WriteString(w, `{
+				"organization": {"slug": "test"},
+				"jobs": {"scheduled": 3, "assigned": 2},
+				"agents": {"total": 4, "stale_connected": 1}
+			}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+
+	tcs := []struct {
+		desc        string
+		queues      []string
+		passthrough bool
+		wantTotals  map[string]int
+		wantDefault map[string]int
+	}{
+		{
+			desc:   "all queues without passthrough",
+			queues: nil,
+			wantTotals: map[string]int{
+				ScheduledJobsCount: 3,
+				TotalAgentCount:    4,
+			},
+			wantDefault: map[string]int{
+				ScheduledJobsCount: 3,
+				TotalAgentCount:    4,
+			},
+		},
+		{
+			desc:        "all queues with passthrough",
+			queues:      nil,
+			passthrough: true,
+			wantTotals: map[string]int{
+				ScheduledJobsCount:         3,
+				TotalAgentCount:            4,
+				"AssignedJobsCount":        2,
+				"StaleConnectedAgentCount": 1,
+			},
+			wantDefault: map[string]int{
+				ScheduledJobsCount:         3,
+				TotalAgentCount:            4,
+				"AssignedJobsCount":        2,
+				"AvgWaitJobsCount":         2,
+				"StaleConnectedAgentCount": 1,
+			},
+		},
+		{
+			desc:        "single queue with passthrough",
+			queues:      []string{"default"},
+			passthrough: true,
+			wantDefault: map[string]int{
+				ScheduledJobsCount:         3,
+				TotalAgentCount:            4,
+				"AssignedJobsCount":        2,
+				"StaleConnectedAgentCount": 1,
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := &Collector{
+				Client:    &http.Client{},
+				Endpoint:  s.URL,
+				Token:     "abc123",
+				UserAgent: "some-client/1.2.3",
+				Queues:    tc.queues,
+				Quiet:     true,
+
+				PassthroughUnknownMetrics: tc.passthrough,
+			}
+
+			res, err := c.Collect()
+			if err != nil {
+				t.Fatalf("c.Collect() = %v", err)
+			}
+
+			for name, want := range tc.wantTotals {
+				if got := res.Totals[name]; got != want {
+					t.Errorf("res.Totals[%q] = %d, want %d", name, got, want)
+				}
+			}
+			for name, want := range tc.wantDefault {
+				if got := res.Queues["default"][name]; got != want {
+					t.Errorf("res.Queues[default][%q] = %d, want %d", name, got, want)
+				}
+			}
+
+			// Known metrics are never replaced by passed through ones, and
+			// nothing is passed through unless asked for.
+			if got, want := res.Totals[UnfinishedJobsCount], 0; len(tc.queues) == 0 && got != want {
+				t.Errorf("res.Totals[UnfinishedJobsCount] = %d, want %d", got, want)
+			}
+			wantLen := len(AllMetrics)
+			if tc.passthrough {
+				wantLen = len(tc.wantDefault) + len(AllMetrics) - 2
+			}
+			if got := len(res.Queues["default"]); got != wantLen {
+				t.Errorf("len(res.Queues[default]) = %d, want %d: %v", got, wantLen, res.Queues["default"])
+			}
+		})
+	}
+}
+
+func TestCollectorLogsResult(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{
+			"organization": {"slug": "test"},
+			"cluster": {"name": "main"},
+			"jobs": {"scheduled": 3, "queues": {"deploy": {"scheduled": 2}, "default": {"scheduled": 1}}},
+			"agents": {"idle": 1, "total": 1, "queues": {"default": {"idle": 1, "total": 1}}}
+		}`)
+	}))
+	defer s.Close()
+
+	var buf bytes.Buffer
+	c := &Collector{
+		Client:    &http.Client{},
+		Endpoint:  s.URL,
+		Token:     "abc123",
+		UserAgent: "some-client/1.2.3",
+		Logger:    slog.New(slog.NewJSONHandler(&buf, nil)).With("token", "ci"),
+	}
+	if _, err := c.Collect(); err != nil {
+		t.Fatalf("c.Collect() = %v", err)
+	}
+
+	var got []map[string]any
+	for line := range strings.Lines(buf.String()) {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("json.Unmarshal(%q) = %v", line, err)
+		}
+		if record[slog.MessageKey] != "Collected metrics" {
+			continue
+		}
+		delete(record, slog.TimeKey)
+		got = append(got, record)
+	}
+
+	metrics := func(scheduled, idle, total, busyPercentage float64) map[string]any {
+		return map[string]any{
+			ScheduledJobsCount:  scheduled,
+			RunningJobsCount:    0.0,
+			UnfinishedJobsCount: 0.0,
+			WaitingJobsCount:    0.0,
+			IdleAgentCount:      idle,
+			BusyAgentCount:      0.0,
+			TotalAgentCount:     total,
+			BusyAgentPercentage: busyPercentage,
+		}
+	}
+	record := func(queue string, metrics map[string]any) map[string]any {
+		r := map[string]any{
+			"level":   "INFO",
+			"msg":     "Collected metrics",
+			"token":   "ci",
+			"org":     "test",
+			"cluster": "main",
+			"metrics": metrics,
+		}
+		if queue != "" {
+			r["queue"] = queue
+		}
+		return r
+	}
+	deploy := map[string]any{
+		ScheduledJobsCount:  2.0,
+		RunningJobsCount:    0.0,
+		UnfinishedJobsCount: 0.0,
+		WaitingJobsCount:    0.0,
+	}
+	want := []map[string]any{
+		record("", metrics(3, 1, 1, 0)),
+		record("default", metrics(1, 1, 1, 0)),
+		record("deploy", deploy),
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("logged records diff (-got +want):\n%s", diff)
+	}
+}
@@ -0,0 +1,116 @@
+package collector
+
+import (
+	"fmt"
+	"math"
+)
+
+// Derived metrics, computed from the metrics returned by the Agent API to save
+// every autoscaler from working them out for itself.
+const (
+	// RequiredAgentCount is the number of agents needed to run every
+	// scheduled and running job, with spare capacity.
+	RequiredAgentCount = "RequiredAgentCount"
+	// AgentDeficit is how many more agents are required than there are.
+	AgentDeficit = "AgentDeficit"
+	// AgentSurplus is how many more agents there are than are required.
+	AgentSurplus = "AgentSurplus"
+)
+
+func init() {
+	for _, info := range []MetricInfo{
+		{
+			Name:              RequiredAgentCount,
+			Description:       "Number of agents required to run scheduled and running jobs",
+			Unit:              UnitCount,
+			Kind:              KindGauge,
+			PrometheusName:    "required_agent_count",
+			OpenTelemetryName: "buildkite.agents.required",
+		},
+		{
+			Name:              AgentDeficit,
+			Description:       "Number of agents required beyond those connected",
+			Unit:              UnitCount,
+			Kind:              KindGauge,
+			PrometheusName:    "agent_deficit",
+			OpenTelemetryName: "buildkite.agents.deficit",
+		},
+		{
+			Name:              AgentSurplus,
+			Description:       "Number of connected agents beyond those required",
+			Unit:              UnitCount,
+			Kind:              KindGauge,
+			PrometheusName:    "agent_surplus",
+			OpenTelemetryName: "buildkite.agents.surplus",
+		},
+	} {
+		RegisterMetric(info)
+	}
+}
+
+// DerivedMetrics computes RequiredAgentCount, AgentDeficit and AgentSurplus
+// from the metrics in a Result.
+//
+// The jobs that need an agent are those that are scheduled or running. The
+// required agent count is the number of those jobs, plus SpareCapacityPercent
+// percent, divided by JobsPerAgent and rounded up.
+type DerivedMetrics struct {
+	// JobsPerAgent is the number of jobs each agent can run at once, such as
+	// when agents are started with --spawn. Values of 0 or less mean 1.
+	JobsPerAgent float64
+
+	// SpareCapacityPercent is how much capacity to require beyond the jobs
+	// that need an agent, as a percentage of them. 20 requires agents for
+	// 12 jobs when 10 need one.
+	SpareCapacityPercent float64
+}
+
+// Validate returns an error if the ratio or percentage can't be used.
+func (d DerivedMetrics) Validate() error {
+	if math.IsNaN(d.JobsPerAgent) || math.IsInf(d.JobsPerAgent, 0) {
+		return fmt.Errorf("jobs per agent must be a number, got %v", d.JobsPerAgent)
+	}
+	if math.IsNaN(d.SpareCapacityPercent) || math.IsInf(d.SpareCapacityPercent, 0) || d.SpareCapacityPercent < 0 {
+		return fmt.Errorf("spare capacity percent must be a number of at least 0, got %v", d.SpareCapacityPercent)
+	}
+	return nil
+}
+
+// Apply adds the derived metrics to the totals of r, if it has any, and to
+// each of its queues.
+func (d DerivedMetrics) Apply(r *Result) {
+	if len(r.Totals) > 0 {
+		d.apply(r.Totals)
+	}
+	for _, counts := range r.Queues {
+		d.apply(counts)
+	}
+}
+
+func (d DerivedMetrics) apply(counts map[string]int) {
+	required := d.RequiredAgents(counts[ScheduledJobsCount] + counts[RunningJobsCount])
+	agents := counts[TotalAgentCount]
+
+	counts[RequiredAgentCount] = required
+	counts[AgentDeficit] = max(required-agents, 0)
+	counts[AgentSurplus] = max(agents-required, 0)
+}
+
+// RequiredAgents returns the number of agents required for the given number of
+// jobs that need one.
+func (d DerivedMetrics) RequiredAgents(jobs int) int {
+	if jobs <= 0 {
+		return 0
+	}
+
+	jobsPerAgent := d.JobsPerAgent
+	if jobsPerAgent <= 0 {
+		jobsPerAgent = 1
+	}
+
+	agents := float64(jobs) * (1 + max(d.SpareCapacityPercent, 0)/100) / jobsPerAgent
+
+	// Allow for floating point error, so that e.g. 10 jobs with 10% spare
+	// capacity require 11 agents rather than 12.
+	return int(math.Ceil(agents - 1e-9))
+}
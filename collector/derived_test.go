@@ -0,0 +1,166 @@
+package collector
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDerivedMetricsRequiredAgents(t *testing.T) {
+	tcs := []struct {
+		desc    string
+		derived DerivedMetrics
+		jobs    int
+		want    int
+	}{
+		{
+			desc: "zero value is one job per agent",
+			jobs: 5,
+			want: 5,
+		},
+		{
+			desc:    "no jobs",
+			derived: DerivedMetrics{JobsPerAgent: 2, SpareCapacityPercent: 50},
+			jobs:    0,
+			want:    0,
+		},
+		{
+			desc:    "jobs per agent rounds up",
+			derived: DerivedMetrics{JobsPerAgent: 4},
+			jobs:    9,
+			want:    3,
+		},
+		{
+			desc:    "spare capacity",
+			derived: DerivedMetrics{JobsPerAgent: 1, SpareCapacityPercent: 20},
+			jobs:    10,
+			want:    12,
+		},
+		{
+			desc:    "spare capacity without floating point error",
+			derived: DerivedMetrics{JobsPerAgent: 1, SpareCapacityPercent: 10},
+			jobs:    10,
+			want:    11,
+		},
+		{
+			desc:    "fractional jobs per agent",
+			derived: DerivedMetrics{JobsPerAgent: 0.5},
+			jobs:    3,
+			want:    6,
+		},
+		{
+			desc:    "jobs per agent and spare capacity",
+			derived: DerivedMetrics{JobsPerAgent: 2, SpareCapacityPercent: 25},
+			jobs:    8,
+			want:    5,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := tc.derived.RequiredAgents(tc.jobs); got != tc.want {
+				t.Errorf("%+v.RequiredAgents(%d) = %d, want %d", tc.derived, tc.jobs, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDerivedMetricsApply(t *testing.T) {
+	r := &Result{
+		Totals: map[string]int{
+			ScheduledJobsCount: 4,
+			RunningJobsCount:   2,
+			WaitingJobsCount:   7,
+			TotalAgentCount:    3,
+		},
+		Queues: map[string]map[string]int{
+			"default": {
+				ScheduledJobsCount: 4,
+				RunningJobsCount:   1,
+				TotalAgentCount:    1,
+			},
+			"deploy": {
+				RunningJobsCount: 1,
+				TotalAgentCount:  2,
+			},
+		},
+	}
+
+	DerivedMetrics{JobsPerAgent: 2}.Apply(r)
+
+	want := map[string]map[string]int{
+		"": {
+			RequiredAgentCount: 3,
+			AgentDeficit:       0,
+			AgentSurplus:       0,
+		},
+		"default": {
+			RequiredAgentCount: 3,
+			AgentDeficit:       2,
+			AgentSurplus:       0,
+		},
+		"deploy": {
+			RequiredAgentCount: 1,
+			AgentDeficit:       0,
+			AgentSurplus:       1,
+		},
+	}
+
+	got := map[string]map[string]int{"": derivedOnly(r.Totals)}
+	for queue, counts := range r.Queues {
+		got[queue] = derivedOnly(counts)
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("derived metrics diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestDerivedMetricsApplyWithoutTotals(t *testing.T) {
+	r := &Result{
+		Totals: map[string]int{},
+		Queues: map[string]map[string]int{
+			"default": {ScheduledJobsCount: 1},
+		},
+	}
+
+	DerivedMetrics{}.Apply(r)
+
+	if len(r.Totals) != 0 {
+		t.Errorf("r.Totals = %v, want no metrics", r.Totals)
+	}
+	if got, want := r.Queues["default"][AgentDeficit], 1; got != want {
+		t.Errorf("r.Queues[default][AgentDeficit] = %d, want %d", got, want)
+	}
+}
+
+func TestDerivedMetricsValidate(t *testing.T) {
+	tcs := []struct {
+		desc    string
+		derived DerivedMetrics
+		wantErr bool
+	}{
+		{desc: "zero value", derived: DerivedMetrics{}},
+		{desc: "valid", derived: DerivedMetrics{JobsPerAgent: 3, SpareCapacityPercent: 25}},
+		{desc: "negative spare capacity", derived: DerivedMetrics{SpareCapacityPercent: -10}, wantErr: true},
+		{desc: "NaN jobs per agent", derived: DerivedMetrics{JobsPerAgent: math.NaN()}, wantErr: true},
+		{desc: "infinite spare capacity", derived: DerivedMetrics{SpareCapacityPercent: math.Inf(1)}, wantErr: true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := tc.derived.Validate()
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("%+v.Validate() = %v, want error: %t", tc.derived, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func derivedOnly(counts map[string]int) map[string]int {
+	return map[string]int{
+		RequiredAgentCount: counts[RequiredAgentCount],
+		AgentDeficit:       counts[AgentDeficit],
+		AgentSurplus:       counts[AgentSurplus],
+	}
+}
@@ -0,0 +1,311 @@
+package collector_test
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-metrics/v5/collector"
+	"github.com/buildkite/buildkite-agent-metrics/v5/fakeapi"
+)
+
+// These tests run the collector against the fake Agent API in the fakeapi
+// package, which can't be imported by the collector package's own tests.
+
+// newFakeAPI returns a fake Agent API allowing the token "abc123" for the
+// test org, and a server for it.
+func newFakeAPI(t *testing.T) (*fakeapi.API, *httptest.Server) {
+	t.Helper()
+
+	api := fakeapi.New()
+	api.AddToken("abc123", "test", "")
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+	return api, srv
+}
+
+func newFakeAPICollector(srv *httptest.Server) *collector.Collector {
+	return &collector.Collector{
+		Client:    srv.Client(),
+		Endpoint:  srv.URL + "/v3",
+		Token:     "abc123",
+		UserAgent: "some-client/1.2.3",
+		Quiet:     true,
+	}
+}
+
+func TestCollectorContextDeadline(t *testing.T) {
+	api, srv := newFakeAPI(t)
+	api.SetLatency(time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := newFakeAPICollector(srv).CollectContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("c.CollectContext(ctx) error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestCollectorWithConcurrentQueues(t *testing.T) {
+	queues := []string{"a", "bb", "ccc", "dddd", "eeeee", "ffffff", "ggggggg", "hhhhhhhh"}
+
+	api := fakeapi.New()
+	api.AddToken("abc123", "test", "")
+	for _, queue := range queues {
+		api.SetQueue("test", "", queue, fakeapi.Queue{
+			Agents: fakeapi.Agents{Idle: 1, Busy: 1},
+			Jobs:   fakeapi.Jobs{Scheduled: len(queue)},
+		})
+	}
+	api.SetLatency(20 * time.Millisecond)
+
+	var inFlight, maxInFlight atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		api.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	c := newFakeAPICollector(srv)
+	c.Queues = queues
+	c.QueueConcurrency = 4
+
+	res, err := c.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(res.Queues), len(queues); got != want {
+		t.Fatalf("len(res.Queues) = %d, want %d", got, want)
+	}
+	for _, queue := range queues {
+		if got, want := res.Queues[queue][collector.ScheduledJobsCount], len(queue); got != want {
+			t.Errorf("res.Queues[%q][ScheduledJobsCount] = %d, want %d", queue, got, want)
+		}
+		if got, want := res.Queues[queue][collector.BusyAgentPercentage], 50; got != want {
+			t.Errorf("res.Queues[%q][BusyAgentPercentage] = %d, want %d", queue, got, want)
+		}
+	}
+	if got := maxInFlight.Load(); got < 2 || got > 4 {
+		t.Errorf("max concurrent requests = %d, want between 2 and 4", got)
+	}
+
+	// When every queue fails, the error reported is for the first failing
+	// queue in the configured order, regardless of which request finished
+	// first.
+	c.Queues = []string{"missing", "gone"}
+	_, err = c.Collect()
+	if err == nil || !strings.Contains(err.Error(), `queue "missing"`) {
+		t.Errorf("c.Collect() error = %v, want error for queue %q", err, "missing")
+	}
+}
+
+func TestCollectorWithPartialQueueFailures(t *testing.T) {
+	api, srv := newFakeAPI(t)
+	for _, queue := range []string{"default", "deploy"} {
+		api.SetQueue("test", "", queue, fakeapi.Queue{
+			Agents: fakeapi.Agents{Idle: 1},
+			Jobs:   fakeapi.Jobs{Scheduled: 2},
+		})
+	}
+
+	c := newFakeAPICollector(srv)
+	c.Queues = []string{"default", "typo", "deploy"}
+
+	res, err := c.Collect()
+	if err != nil {
+		t.Fatalf("c.Collect() = %v", err)
+	}
+	for _, queue := range []string{"default", "deploy"} {
+		if got, want := res.Queues[queue][collector.ScheduledJobsCount], 2; got != want {
+			t.Errorf("res.Queues[%q][ScheduledJobsCount] = %d, want %d", queue, got, want)
+		}
+	}
+	if _, ok := res.Queues["typo"]; ok {
+		t.Errorf("res.Queues[%q] present, want absent", "typo")
+	}
+	var httpErr collector.HTTPError
+	if err := res.QueueErrors["typo"]; !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusNotFound {
+		t.Errorf("res.QueueErrors[%q] = %v, want HTTPError with status 404", "typo", err)
+	}
+	if got, want := res.FailedQueues()["typo"][collector.QueueCollectionFailed], 1; got != want {
+		t.Errorf("res.FailedQueues()[%q][QueueCollectionFailed] = %d, want %d", "typo", got, want)
+	}
+	if got, want := len(res.FailedQueues()), 1; got != want {
+		t.Errorf("len(res.FailedQueues()) = %d, want %d", got, want)
+	}
+	wantStatus := map[string]map[string]int{
+		"default": {collector.QueueCollectionFailed: 0},
+		"typo":    {collector.QueueCollectionFailed: 1},
+		"deploy":  {collector.QueueCollectionFailed: 0},
+	}
+	if got := res.QueueCollectionStatus(); !maps.EqualFunc(got, wantStatus, maps.Equal) {
+		t.Errorf("res.QueueCollectionStatus() = %v, want %v", got, wantStatus)
+	}
+
+	// Errors that would affect every queue abort the whole collection.
+	api.AddFault(fakeapi.Fault{Queue: "typo", StatusCode: http.StatusForbidden, Message: "Forbidden"})
+	if _, err := c.Collect(); !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusForbidden {
+		t.Errorf("c.Collect() error = %v, want HTTPError with status 403", err)
+	}
+}
+
+// tokenFunc is a TokenProvider that calls itself.
+type tokenFunc func() (string, error)
+
+func (f tokenFunc) Get() (string, error) {
+	return f()
+}
+
+func TestCollectorRefreshesRejectedToken(t *testing.T) {
+	tests := []struct {
+		name         string
+		provider     tokenFunc
+		wantErr      string
+		wantToken    string
+		wantRequests []string
+	}{
+		{
+			name:         "rotated",
+			provider:     func() (string, error) { return "new", nil },
+			wantToken:    "new",
+			wantRequests: []string{"old", "new"},
+		},
+		{
+			name:         "unchanged",
+			provider:     func() (string, error) { return "old", nil },
+			wantErr:      "making http request to fetch all metrics: request failed with status 401: Invalid token",
+			wantToken:    "old",
+			wantRequests: []string{"old"},
+		},
+		{
+			name:         "also rejected",
+			provider:     func() (string, error) { return "revoked", nil },
+			wantErr:      "making http request to fetch all metrics: request failed with status 401: Invalid token",
+			wantToken:    "revoked",
+			wantRequests: []string{"old", "revoked"},
+		},
+		{
+			name:         "provider failed",
+			provider:     func() (string, error) { return "", errors.New("parameter not found") },
+			wantErr:      "making http request to fetch all metrics: request failed with status 401: Invalid token (refreshing the token failed: parameter not found)",
+			wantToken:    "old",
+			wantRequests: []string{"old"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := fakeapi.New()
+			api.AddToken("new", "test", "")
+			srv := httptest.NewServer(api)
+			defer srv.Close()
+
+			c := newFakeAPICollector(srv)
+			c.Token = "old"
+			c.TokenProvider = test.provider
+
+			_, err := c.Collect()
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("c.Collect() = %v", err)
+			}
+			if test.wantErr != "" {
+				var httpErr collector.HTTPError
+				if err == nil || err.Error() != test.wantErr || !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusUnauthorized {
+					t.Errorf("c.Collect() error = %v, want %q wrapping an HTTPError with status 401", err, test.wantErr)
+				}
+			}
+			if c.Token != test.wantToken {
+				t.Errorf("c.Token = %q, want %q", c.Token, test.wantToken)
+			}
+			var requests []string
+			for _, r := range api.Requests() {
+				requests = append(requests, r.Token)
+			}
+			if !slices.Equal(requests, test.wantRequests) {
+				t.Errorf("requests = %q, want %q", requests, test.wantRequests)
+			}
+		})
+	}
+}
+
+func TestCollectorWithQueueFilterForAllQueues(t *testing.T) {
+	api, srv := newFakeAPI(t)
+	api.SetQueue("test", "", "default", fakeapi.Queue{Jobs: fakeapi.Jobs{Scheduled: 1}})
+	api.SetQueue("test", "", "deploy-us", fakeapi.Queue{Jobs: fakeapi.Jobs{Scheduled: 2}})
+	api.SetQueue("test", "", "deploy-us-canary", fakeapi.Queue{Jobs: fakeapi.Jobs{Scheduled: 3}})
+	api.SetQueue("test", "", "deploy-eu", fakeapi.Queue{Agents: fakeapi.Agents{Idle: 2}})
+
+	filter, err := collector.ParseQueueFilter([]string{"deploy-*", "!*-canary"})
+	if err != nil {
+		t.Fatalf("ParseQueueFilter() error = %v", err)
+	}
+
+	c := newFakeAPICollector(srv)
+	c.QueueFilter = filter
+
+	res, err := c.Collect()
+	if err != nil {
+		t.Fatalf("c.Collect() = %v", err)
+	}
+
+	if got, want := slices.Sorted(maps.Keys(res.Queues)), []string{"deploy-eu", "deploy-us"}; !slices.Equal(got, want) {
+		t.Errorf("queues = %q, want %q", got, want)
+	}
+
+	// Totals are not affected by the filter.
+	if got, want := res.Totals[collector.ScheduledJobsCount], 6; got != want {
+		t.Errorf("res.Totals[ScheduledJobsCount] = %d, want %d", got, want)
+	}
+}
+
+func TestCollectorRetriesTransientErrors(t *testing.T) {
+	api, srv := newFakeAPI(t)
+	api.SetQueue("test", "", "default", fakeapi.Queue{Jobs: fakeapi.Jobs{Scheduled: 3}})
+	api.AddFault(fakeapi.Fault{StatusCode: http.StatusServiceUnavailable, Times: 2})
+
+	c := newFakeAPICollector(srv)
+	c.Retry = collector.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+
+	res, err := c.Collect()
+	if err != nil {
+		t.Fatalf("c.Collect() = %v", err)
+	}
+	if got, want := res.Totals[collector.ScheduledJobsCount], 3; got != want {
+		t.Errorf("res.Totals[ScheduledJobsCount] = %d, want %d", got, want)
+	}
+	if got, want := len(api.Requests()), 3; got != want {
+		t.Errorf("requests = %d, want %d", got, want)
+	}
+}
+
+func TestCollectorDoesNotRetryUnauthorized(t *testing.T) {
+	api, srv := newFakeAPI(t)
+
+	c := newFakeAPICollector(srv)
+	c.Token = "revoked"
+	c.Retry = collector.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+
+	_, err := c.Collect()
+	var httpErr collector.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("c.Collect() error = %v, want HTTPError with status 401", err)
+	}
+	if got, want := len(api.Requests()), 1; got != want {
+		t.Errorf("requests = %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,121 @@
+package collector
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// QueueFilter selects queues by name from the all-queues metrics response.
+//
+// A filter is built from include and exclude patterns. A queue is kept if it
+// matches any include pattern (or there are none), and does not match any
+// exclude pattern. A nil *QueueFilter keeps every queue.
+type QueueFilter struct {
+	include []queuePattern
+	exclude []queuePattern
+}
+
+type queuePattern struct {
+	text  string
+	match func(string) bool
+}
+
+// ParseQueueFilter builds a QueueFilter from patterns. Each pattern is either:
+//
+//   - a glob, such as `deploy-*`, matched against the whole queue name with the
+//     syntax of path.Match, or
+//   - a regular expression between slashes, such as `/^deploy-(us|eu)$/`,
+//     which matches if it matches any part of the queue name.
+//
+// Prefixing a pattern with `!`, such as `!*-canary`, excludes the queues it
+// matches instead. Empty patterns are ignored, and if there are no other
+// patterns ParseQueueFilter returns a nil filter, which keeps every queue.
+func ParseQueueFilter(patterns []string) (*QueueFilter, error) {
+	f := &QueueFilter{}
+	for _, p := range patterns {
+		p = strings.TrimSpace(p)
+
+		exclude := strings.HasPrefix(p, "!")
+		if exclude {
+			p = p[1:]
+		}
+		if p == "" {
+			continue
+		}
+
+		qp, err := parseQueuePattern(p)
+		if err != nil {
+			return nil, err
+		}
+
+		if exclude {
+			f.exclude = append(f.exclude, qp)
+		} else {
+			f.include = append(f.include, qp)
+		}
+	}
+
+	if len(f.include) == 0 && len(f.exclude) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+func parseQueuePattern(p string) (queuePattern, error) {
+	if len(p) >= 2 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/") {
+		re, err := regexp.Compile(p[1 : len(p)-1])
+		if err != nil {
+			return queuePattern{}, fmt.Errorf("invalid queue regular expression %q: %w", p, err)
+		}
+		return queuePattern{text: p, match: re.MatchString}, nil
+	}
+
+	if _, err := path.Match(p, ""); err != nil {
+		return queuePattern{}, fmt.Errorf("invalid queue glob %q: %w", p, err)
+	}
+	return queuePattern{
+		text: p,
+		match: func(queue string) bool {
+			ok, _ := path.Match(p, queue)
+			return ok
+		},
+	}, nil
+}
+
+// Match reports whether the filter keeps the named queue.
+func (f *QueueFilter) Match(queue string) bool {
+	if f == nil {
+		return true
+	}
+
+	if len(f.include) > 0 && !matchAny(f.include, queue) {
+		return false
+	}
+	return !matchAny(f.exclude, queue)
+}
+
+func (f *QueueFilter) String() string {
+	if f == nil {
+		return ""
+	}
+
+	patterns := make([]string, 0, len(f.include)+len(f.exclude))
+	for _, p := range f.include {
+		patterns = append(patterns, p.text)
+	}
+	for _, p := range f.exclude {
+		patterns = append(patterns, "!"+p.text)
+	}
+	return strings.Join(patterns, ",")
+}
+
+func matchAny(patterns []queuePattern, queue string) bool {
+	for _, p := range patterns {
+		if p.match(queue) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package collector
+
+import (
+	"testing"
+)
+
+func TestQueueFilterMatch(t *testing.T) {
+	tcs := []struct {
+		desc     string
+		patterns []string
+		match    []string
+		noMatch  []string
+	}{
+		{
+			desc:     "no patterns",
+			patterns: nil,
+			match:    []string{"default", "deploy-us"},
+		},
+		{
+			desc:     "glob include",
+			patterns: []string{"deploy-*"},
+			match:    []string{"deploy-us", "deploy-eu-canary"},
+			noMatch:  []string{"default", "my-deploy-us"},
+		},
+		{
+			desc:     "glob include with exclude",
+			patterns: []string{"deploy-*", "!*-canary"},
+			match:    []string{"deploy-us"},
+			noMatch:  []string{"deploy-eu-canary", "default"},
+		},
+		{
+			desc:     "exclude only",
+			patterns: []string{"!*-canary"},
+			match:    []string{"default", "deploy-us"},
+			noMatch:  []string{"deploy-eu-canary"},
+		},
+		{
+			desc:     "regex",
+			patterns: []string{`/^deploy-(us|eu)$/`, "default"},
+			match:    []string{"deploy-us", "deploy-eu", "default"},
+			noMatch:  []string{"deploy-ap", "deploy-us-canary"},
+		},
+		{
+			desc:     "unanchored regex exclude",
+			patterns: []string{`!/canary/`},
+			match:    []string{"deploy-us"},
+			noMatch:  []string{"canary-deploy", "deploy-canary-2"},
+		},
+		{
+			desc:     "blank patterns ignored",
+			patterns: []string{" ", "!", " default "},
+			match:    []string{"default"},
+			noMatch:  []string{"deploy"},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.desc, func(t *testing.T) {
+			f, err := ParseQueueFilter(tc.patterns)
+			if err != nil {
+				t.Fatalf("ParseQueueFilter(%q) error = %v", tc.patterns, err)
+			}
+			for _, q := range tc.match {
+				if !f.Match(q) {
+					t.Errorf("f.Match(%q) = false, want true", q)
+				}
+			}
+			for _, q := range tc.noMatch {
+				if f.Match(q) {
+					t.Errorf("f.Match(%q) = true, want false", q)
+				}
+			}
+		})
+	}
+}
+
+func TestQueueFilterNil(t *testing.T) {
+	var f *QueueFilter
+	if !f.Match("default") {
+		t.Errorf("nil filter Match(%q) = false, want true", "default")
+	}
+}
+
+func TestParseQueueFilterErrors(t *testing.T) {
+	for _, p := range []string{"deploy-[", "!/(/"} {
+		if _, err := ParseQueueFilter([]string{p}); err == nil {
+			t.Errorf("ParseQueueFilter(%q) error = nil, want an error", p)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package collector
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-metrics/v5/version"
+)
+
+// DefaultHARMaxEntries is the number of requests a HARTransport keeps by
+// default.
+const DefaultHARMaxEntries = 1000
+
+// HARTransport is an http.RoundTripper that records each request and response
+// to a HAR (HTTP Archive) file, with the token redacted and timings from
+// httptrace. HAR files can be loaded into browser developer tools to see where
+// the time in slow requests goes, or shared with Buildkite support.
+//
+// Only the most recent MaxEntries requests are kept, so that a long-running
+// daemon doesn't use ever more memory. The file is written by Flush, such as
+// after each collection, replacing it so that it is always complete.
+type HARTransport struct {
+	// Path is the file the HAR is written to.
+	Path string
+
+	// Base makes the requests. If nil, http.DefaultTransport is used.
+	Base http.RoundTripper
+
+	// MaxEntries is the number of most recent requests kept. Values below 1
+	// keep DefaultHARMaxEntries.
+	MaxEntries int
+
+	// entries is a ring buffer of the requests kept, the oldest of which is
+	// at next once it is full.
+	mu      sync.Mutex
+	entries []harEntry
+	next    int
+}
+
+// NewHARTransport returns a HARTransport that writes to path, checking that it
+// can be written.
+func NewHARTransport(path string, base http.RoundTripper) (*HARTransport, error) {
+	t := &HARTransport{Path: path, Base: base, MaxEntries: DefaultHARMaxEntries}
+	if err := t.Flush(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// RoundTrip makes the request with Base, timing each phase of it, and adds it
+// to the HAR. Requests that fail without a response are not recorded.
+func (t *HARTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	timings := &harTimer{start: time.Now()}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), timings.trace()))
+
+	res, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+
+	entry := newHAREntry(req, res, body, timings.start, timings.finish())
+	entry.ServerIPAddress = timings.serverIP()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	maxEntries := t.MaxEntries
+	if maxEntries < 1 {
+		maxEntries = DefaultHARMaxEntries
+	}
+	if len(t.entries) < maxEntries {
+		t.entries = append(t.entries, entry)
+	} else {
+		t.entries[t.next] = entry
+		t.next = (t.next + 1) % len(t.entries)
+	}
+	return res, nil
+}
+
+// Flush replaces the HAR file with one containing the requests kept so far,
+// oldest first.
+func (t *HARTransport) Flush() error {
+	t.mu.Lock()
+	entries := make([]harEntry, 0, len(t.entries))
+	entries = append(entries, t.entries[t.next:]...)
+	entries = append(entries, t.entries[:t.next]...)
+	t.mu.Unlock()
+
+	data, err := json.MarshalIndent(harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "buildkite-agent-metrics", Version: version.Version},
+		Entries: entries,
+	}}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename it, so the HAR is never left
+	// partly written.
+	tmp, err := os.CreateTemp(filepath.Dir(t.Path), filepath.Base(t.Path)+".*")
+	if err != nil {
+		return fmt.Errorf("writing HAR: %w", err)
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck // the file is gone after a successful rename
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing HAR: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing HAR: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), t.Path); err != nil {
+		return fmt.Errorf("writing HAR: %w", err)
+	}
+	return nil
+}
+
+// harTimer collects the times of the events of a request from httptrace.
+type harTimer struct {
+	mu sync.Mutex
+
+	start, getConn, gotConn       time.Time
+	dnsStart, dnsDone             time.Time
+	connectStart, connectDone     time.Time
+	tlsStart, tlsDone             time.Time
+	wroteRequest, firstByte, done time.Time
+
+	remoteAddr string
+}
+
+func (h *harTimer) trace() *httptrace.ClientTrace {
+	// The hooks can be called from several goroutines, such as when dialling
+	// IPv4 and IPv6 addresses at once, so only the first of each is kept.
+	set := func(t *time.Time) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if t.IsZero() {
+			*t = time.Now()
+		}
+	}
+
+	return &httptrace.ClientTrace{
+		GetConn: func(string) { set(&h.getConn) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			set(&h.gotConn)
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			if info.Conn != nil {
+				h.remoteAddr = info.Conn.RemoteAddr().String()
+			}
+		},
+		DNSStart:             func(httptrace.DNSStartInfo) { set(&h.dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { set(&h.dnsDone) },
+		ConnectStart:         func(_, _ string) { set(&h.connectStart) },
+		ConnectDone:          func(_, _ string, _ error) { set(&h.connectDone) },
+		TLSHandshakeStart:    func() { set(&h.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { set(&h.tlsDone) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { set(&h.wroteRequest) },
+		GotFirstResponseByte: func() { set(&h.firstByte) },
+	}
+}
+
+// finish records the end of the response, and returns the timings of the
+// request in HAR form.
+func (h *harTimer) finish() harTimings {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.done = time.Now()
+
+	// Phases that didn't happen, such as connecting on a reused connection,
+	// are -1. Phases that did are never negative.
+	ms := func(from, to time.Time) float64 {
+		if from.IsZero() || to.IsZero() {
+			return -1
+		}
+		return max(float64(to.Sub(from).Microseconds())/1000, 0)
+	}
+
+	t := harTimings{
+		DNS:     ms(h.dnsStart, h.dnsDone),
+		Connect: ms(h.connectStart, h.connectDone),
+		SSL:     ms(h.tlsStart, h.tlsDone),
+		Send:    ms(h.gotConn, h.wroteRequest),
+		Wait:    ms(h.wroteRequest, h.firstByte),
+		Receive: ms(h.firstByte, h.done),
+	}
+
+	// HAR includes the TLS handshake in connect, which httptrace doesn't.
+	if t.SSL >= 0 {
+		t.Connect = max(t.Connect, 0) + t.SSL
+	}
+
+	// Blocked is the time spent waiting for a connection, other than looking
+	// up and connecting to the server.
+	t.Blocked = ms(h.start, h.gotConn)
+	if t.Blocked >= 0 {
+		t.Blocked = max(t.Blocked-max(t.DNS, 0)-max(t.Connect, 0), 0)
+	}
+
+	return t
+}
+
+// serverIP returns the IP address of the server the request was sent to, if
+// known.
+func (h *harTimer) serverIP() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	host, _, err := net.SplitHostPort(h.remoteAddr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+func newHAREntry(req *http.Request, res *http.Response, body []byte, start time.Time, timings harTimings) harEntry {
+	query := harNameValues(req.URL.Query())
+
+	var total float64
+	for _, phase := range []float64{timings.Blocked, timings.DNS, timings.Connect, timings.Send, timings.Wait, timings.Receive} {
+		total += max(phase, 0)
+	}
+
+	entry := harEntry{
+		StartedDateTime: start.UTC().Format(time.RFC3339Nano),
+		Time:            total,
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			HTTPVersion: req.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harNameValues(redactHeader(req.Header)),
+			QueryString: query,
+			HeadersSize: -1,
+			BodySize:    0,
+		},
+		Response: harResponse{
+			Status:      res.StatusCode,
+			StatusText:  http.StatusText(res.StatusCode),
+			HTTPVersion: res.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harNameValues(redactHeader(res.Header)),
+			Content: harContent{
+				Size:     len(body),
+				MimeType: res.Header.Get("Content-Type"),
+				Text:     string(body),
+			},
+			RedirectURL: res.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    len(body),
+		},
+		Timings: timings,
+	}
+	if entry.Request.HTTPVersion == "" {
+		entry.Request.HTTPVersion = "HTTP/1.1"
+	}
+	return entry
+}
+
+// harNameValues returns the values of headers or a query string, sorted by
+// name.
+func harNameValues(values map[string][]string) []harNameValue {
+	pairs := []harNameValue{}
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		for _, v := range values[name] {
+			pairs = append(pairs, harNameValue{Name: name, Value: v})
+		}
+	}
+	return pairs
+}
@@ -0,0 +1,160 @@
+package collector
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHARTransport(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(PollDurationHeader, "15")
+		_, _ = io.WriteString(w, `{
+			"organization": {"slug": "test"},
+			"jobs": {"scheduled": 3, "running": 0, "waiting": 0, "total": 3},
+			"agents": {"idle": 0, "busy": 0, "total": 0}
+		}`)
+	}))
+	defer s.Close()
+
+	path := filepath.Join(t.TempDir(), "agent-api.har")
+	har, err := NewHARTransport(path, s.Client().Transport)
+	if err != nil {
+		t.Fatalf("NewHARTransport() = %v", err)
+	}
+
+	c := &Collector{
+		Client:   &http.Client{Transport: har},
+		Endpoint: s.URL,
+		Token:    "abc123",
+		Queues:   []string{"default", "deploy"},
+		Quiet:    true,
+	}
+	if _, err := c.Collect(); err != nil {
+		t.Fatalf("c.Collect() = %v", err)
+	}
+	if err := har.Flush(); err != nil {
+		t.Fatalf("har.Flush() = %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%q) = %v", path, err)
+	}
+	if strings.Contains(string(data), "abc123") {
+		t.Errorf("HAR contains the token:\n%s", data)
+	}
+
+	var got harFile
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("json.Unmarshal(HAR) = %v", err)
+	}
+	if got.Log.Version != "1.2" {
+		t.Errorf("HAR version = %q, want %q", got.Log.Version, "1.2")
+	}
+	if len(got.Log.Entries) != 2 {
+		t.Fatalf("len(HAR entries) = %d, want 2", len(got.Log.Entries))
+	}
+
+	for _, entry := range got.Log.Entries {
+		if entry.Response.Status != http.StatusOK {
+			t.Errorf("entry for %s has status %d, want %d", entry.Request.URL, entry.Response.Status, http.StatusOK)
+		}
+		if !strings.Contains(entry.Response.Content.Text, `"slug": "test"`) {
+			t.Errorf("entry for %s has content %q, want the response body", entry.Request.URL, entry.Response.Content.Text)
+		}
+		if len(entry.Request.QueryString) != 1 || entry.Request.QueryString[0].Name != "name" {
+			t.Errorf("entry for %s has query string %v, want the queue name", entry.Request.URL, entry.Request.QueryString)
+		}
+		for _, h := range entry.Request.Headers {
+			if h.Name == "Authorization" && h.Value != "Token "+redacted {
+				t.Errorf("entry for %s has Authorization %q, want it redacted", entry.Request.URL, h.Value)
+			}
+		}
+
+		timings := entry.Timings
+		for name, phase := range map[string]float64{"send": timings.Send, "wait": timings.Wait, "receive": timings.Receive, "blocked": timings.Blocked} {
+			if phase < 0 {
+				t.Errorf("entry for %s has %s timing %v, want at least 0", entry.Request.URL, name, phase)
+			}
+		}
+		if entry.Time < timings.Wait {
+			t.Errorf("entry for %s has time %v, less than its wait timing %v", entry.Request.URL, entry.Time, timings.Wait)
+		}
+		if entry.ServerIPAddress != "127.0.0.1" {
+			t.Errorf("entry for %s has server IP %q, want %q", entry.Request.URL, entry.ServerIPAddress, "127.0.0.1")
+		}
+	}
+
+	// The first request connects and shakes hands with the server, which
+	// the second reuses.
+	first := got.Log.Entries[0].Timings
+	if first.Connect < 0 || first.SSL < 0 || first.Connect < first.SSL {
+		t.Errorf("first entry has connect %v and ssl %v timings, want a connection including the TLS handshake", first.Connect, first.SSL)
+	}
+	second := got.Log.Entries[1].Timings
+	if second.Connect != -1 || second.SSL != -1 {
+		t.Errorf("second entry has connect %v and ssl %v timings, want -1 for a reused connection", second.Connect, second.SSL)
+	}
+}
+
+func TestHARTransportKeepsMostRecentEntries(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer s.Close()
+
+	path := filepath.Join(t.TempDir(), "agent-api.har")
+	har, err := NewHARTransport(path, s.Client().Transport)
+	if err != nil {
+		t.Fatalf("NewHARTransport() = %v", err)
+	}
+	har.MaxEntries = 2
+	client := &http.Client{Transport: har}
+
+	read := func() []string {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("os.ReadFile(%q) = %v", path, err)
+		}
+		var got harFile
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatalf("json.Unmarshal(HAR) = %v", err)
+		}
+		urls := make([]string, len(got.Log.Entries))
+		for i, entry := range got.Log.Entries {
+			urls[i] = entry.Request.URL
+		}
+		return urls
+	}
+
+	for _, name := range []string{"a", "b", "c"} {
+		res, err := client.Get(s.URL + "/" + name)
+		if err != nil {
+			t.Fatalf("client.Get(%q) = %v", name, err)
+		}
+		res.Body.Close() //nolint:errcheck // the body isn't needed
+	}
+
+	// Requests are only written when flushed
+	if got := read(); len(got) != 0 {
+		t.Errorf("HAR entries before flushing = %v, want none", got)
+	}
+
+	if err := har.Flush(); err != nil {
+		t.Fatalf("har.Flush() = %v", err)
+	}
+	want := []string{s.URL + "/b", s.URL + "/c"}
+	if diff := cmp.Diff(read(), want); diff != "" {
+		t.Errorf("HAR entry URLs diff (-got +want):\n%s", diff)
+	}
+}
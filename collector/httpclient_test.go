@@ -0,0 +1,228 @@
+package collector
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePEM writes a PEM block of the given type to a file in dir and returns
+// its path.
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatalf("os.WriteFile(%q) = %v", path, err)
+	}
+	return path
+}
+
+// newClientCert creates a CA and a client certificate signed by it, written to
+// PEM files in dir.
+func newClientCert(t *testing.T, dir string) (caPool *x509.CertPool, certFile, keyFile string) {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "test client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caPool = x509.NewCertPool()
+	caPool.AddCert(ca)
+	return caPool, writePEM(t, dir, "client.pem", "CERTIFICATE", der), writePEM(t, dir, "client-key.pem", "EC PRIVATE KEY", keyDER)
+}
+
+func TestHTTPNetworkConfigTLS(t *testing.T) {
+	dir := t.TempDir()
+	clientCAs, certFile, keyFile := newClientCert(t, dir)
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	s.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	s.StartTLS()
+	defer s.Close()
+
+	caFile := writePEM(t, dir, "ca.pem", "CERTIFICATE", s.Certificate().Raw)
+
+	tcs := []struct {
+		desc    string
+		config  HTTPNetworkConfig
+		wantErr bool
+	}{
+		{
+			desc:    "system trust store",
+			config:  HTTPNetworkConfig{},
+			wantErr: true,
+		},
+		{
+			desc:    "CA bundle without client certificate",
+			config:  HTTPNetworkConfig{CACertFile: caFile},
+			wantErr: true,
+		},
+		{
+			desc:   "CA bundle with client certificate",
+			config: HTTPNetworkConfig{CACertFile: caFile, ClientCertFile: certFile, ClientKeyFile: keyFile},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts, err := tc.config.Options()
+			if err != nil {
+				t.Fatalf("Options() = %v", err)
+			}
+			res, err := NewHTTPClient(5, 1, opts...).Get(s.URL)
+			if err == nil {
+				res.Body.Close()
+			}
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("Get() = %v, want error: %t", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestHTTPNetworkConfigInvalid(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "not.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tcs := []struct {
+		desc   string
+		config HTTPNetworkConfig
+	}{
+		{desc: "missing CA file", config: HTTPNetworkConfig{CACertFile: filepath.Join(dir, "missing.pem")}},
+		{desc: "CA file without certificates", config: HTTPNetworkConfig{CACertFile: notPEM}},
+		{desc: "client certificate without key", config: HTTPNetworkConfig{ClientCertFile: notPEM}},
+		{desc: "unsupported proxy scheme", config: HTTPNetworkConfig{Proxy: "ftp://proxy.example.com"}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.desc, func(t *testing.T) {
+			if _, err := tc.config.Options(); err == nil {
+				t.Errorf("%+v.Options() = nil error, want an error", tc.config)
+			}
+		})
+	}
+}
+
+func TestHTTPNetworkConfigProxy(t *testing.T) {
+	var gotURL, gotAuth string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotURL = r.URL.String()
+		gotAuth = r.Header.Get("Proxy-Authorization")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+
+	opts, err := HTTPNetworkConfig{Proxy: "http://user:secret@" + proxy.Listener.Addr().String()}.Options()
+	if err != nil {
+		t.Fatalf("Options() = %v", err)
+	}
+
+	res, err := NewHTTPClient(5, 1, opts...).Get("http://agent.buildkite.test/v3/metrics")
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	res.Body.Close()
+
+	if want := "http://agent.buildkite.test/v3/metrics"; gotURL != want {
+		t.Errorf("proxied request URL = %q, want %q", gotURL, want)
+	}
+	if want := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret")); gotAuth != want {
+		t.Errorf("Proxy-Authorization = %q, want %q", gotAuth, want)
+	}
+}
+
+func TestHTTPNetworkConfigTimeouts(t *testing.T) {
+	opts, err := HTTPNetworkConfig{ConnectTimeout: 2 * time.Second, ResponseTimeout: 7 * time.Second}.Options()
+	if err != nil {
+		t.Fatalf("Options() = %v", err)
+	}
+
+	client := NewHTTPClient(15, 1, opts...)
+	transport := client.Transport.(*http.Transport)
+	if got, want := transport.TLSHandshakeTimeout, 2*time.Second; got != want {
+		t.Errorf("TLSHandshakeTimeout = %v, want %v", got, want)
+	}
+	if got, want := transport.ResponseHeaderTimeout, 7*time.Second; got != want {
+		t.Errorf("ResponseHeaderTimeout = %v, want %v", got, want)
+	}
+	if got, want := client.Timeout, 15*time.Second; got != want {
+		t.Errorf("Timeout = %v, want %v", got, want)
+	}
+}
+
+func TestHTTPClientResponseTimeoutLongerThanTimeout(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(1500 * time.Millisecond)
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer s.Close()
+
+	client := NewHTTPClient(1, 1, WithResponseTimeout(5*time.Second))
+	if got, want := client.Timeout, 5*time.Second; got != want {
+		t.Errorf("Timeout = %v, want %v", got, want)
+	}
+
+	res, err := client.Get(s.URL)
+	if err != nil {
+		t.Fatalf("client.Get() = %v, want the response within the response timeout", err)
+	}
+	res.Body.Close() //nolint:errcheck // the body isn't needed
+}
@@ -0,0 +1,201 @@
+package collector
+
+import (
+	"slices"
+	"sync"
+)
+
+// Unit is the unit of a metric's values.
+type Unit string
+
+const (
+	// UnitCount is a number of things, such as jobs or agents.
+	UnitCount Unit = "Count"
+	// UnitPercent is a percentage between 0 and 100.
+	UnitPercent Unit = "Percent"
+	// UnitSeconds is a duration in seconds.
+	UnitSeconds Unit = "Seconds"
+	// UnitMilliseconds is a duration in milliseconds.
+	UnitMilliseconds Unit = "Milliseconds"
+)
+
+// Kind describes how a metric's values relate to each other over time.
+type Kind int
+
+const (
+	// KindGauge is a metric whose value is a point-in-time measurement that
+	// can go up or down, such as the number of running jobs.
+	KindGauge Kind = iota
+	// KindCounter is a metric whose value is a running total that only goes
+	// up, other than when the process reporting it restarts.
+	KindCounter
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindGauge:
+		return "gauge"
+	case KindCounter:
+		return "counter"
+	default:
+		return "unknown"
+	}
+}
+
+// MetricInfo describes a metric found in Result.Totals, Result.Queues or
+// Result.SelfMetrics, so that every backend can publish it with the same unit,
+// kind and description.
+type MetricInfo struct {
+	// Name is the key of the metric in Result.Totals and Result.Queues, and
+	// the name used by backends without a naming convention of their own,
+	// such as CloudWatch and StatsD.
+	Name string
+
+	// Description is a short, human readable description of the metric.
+	Description string
+
+	Unit Unit
+	Kind Kind
+
+	// PrometheusName is the name of the metric in Prometheus, without the
+	// buildkite_total_ or buildkite_queues_ prefix, or the buildkite_ prefix
+	// of self metrics.
+	PrometheusName string
+
+	// OpenTelemetryName is the name of the instrument in OpenTelemetry.
+	OpenTelemetryName string
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]MetricInfo{}
+	registered []string // names in registration order
+)
+
+func init() {
+	for _, info := range []MetricInfo{
+		{
+			Name:              ScheduledJobsCount,
+			Description:       "Number of scheduled jobs",
+			Unit:              UnitCount,
+			Kind:              KindGauge,
+			PrometheusName:    "scheduled_jobs_count",
+			OpenTelemetryName: "buildkite.jobs.scheduled",
+		},
+		{
+			Name:              RunningJobsCount,
+			Description:       "Number of running jobs",
+			Unit:              UnitCount,
+			Kind:              KindGauge,
+			PrometheusName:    "running_jobs_count",
+			OpenTelemetryName: "buildkite.jobs.running",
+		},
+		{
+			Name:              UnfinishedJobsCount,
+			Description:       "Number of unfinished jobs",
+			Unit:              UnitCount,
+			Kind:              KindGauge,
+			PrometheusName:    "unfinished_jobs_count",
+			OpenTelemetryName: "buildkite.jobs.unfinished",
+		},
+		{
+			Name:              WaitingJobsCount,
+			Description:       "Number of waiting jobs",
+			Unit:              UnitCount,
+			Kind:              KindGauge,
+			PrometheusName:    "waiting_jobs_count",
+			OpenTelemetryName: "buildkite.jobs.waiting",
+		},
+		{
+			Name:              IdleAgentCount,
+			Description:       "Number of idle agents",
+			Unit:              UnitCount,
+			Kind:              KindGauge,
+			PrometheusName:    "idle_agent_count",
+			OpenTelemetryName: "buildkite.agents.idle",
+		},
+		{
+			Name:              BusyAgentCount,
+			Description:       "Number of busy agents",
+			Unit:              UnitCount,
+			Kind:              KindGauge,
+			PrometheusName:    "busy_agent_count",
+			OpenTelemetryName: "buildkite.agents.busy",
+		},
+		{
+			Name:              TotalAgentCount,
+			Description:       "Total number of agents",
+			Unit:              UnitCount,
+			Kind:              KindGauge,
+			PrometheusName:    "total_agent_count",
+			OpenTelemetryName: "buildkite.agents.total",
+		},
+		{
+			Name:              BusyAgentPercentage,
+			Description:       "Percentage of busy agents",
+			Unit:              UnitPercent,
+			Kind:              KindGauge,
+			PrometheusName:    "busy_agent_percentage",
+			OpenTelemetryName: "buildkite.agents.busy_percentage",
+		},
+		{
+			Name:              QueueCollectionFailed,
+			Description:       "Whether the metrics for a queue could not be collected (1) or not (0)",
+			Unit:              UnitCount,
+			Kind:              KindGauge,
+			PrometheusName:    "queue_collection_failed",
+			OpenTelemetryName: "buildkite.queue.collection_failed",
+		},
+	} {
+		RegisterMetric(info)
+	}
+}
+
+// RegisterMetric adds a metric to the registry, or replaces the information
+// about a metric with the same name.
+func RegisterMetric(info MetricInfo) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, exists := registry[info.Name]; !exists {
+		registered = append(registered, info.Name)
+	}
+	registry[info.Name] = info
+}
+
+// UnregisterMetric removes the named metric from the registry, such as one
+// registered by a test, if it is registered.
+func UnregisterMetric(name string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, exists := registry[name]; !exists {
+		return
+	}
+	delete(registry, name)
+	registered = slices.DeleteFunc(registered, func(n string) bool { return n == name })
+}
+
+// LookupMetric returns the information about the named metric, and whether it
+// is registered. Metrics that aren't registered, such as those passed through
+// from the Agent API, are left for backends to describe as they see fit.
+func LookupMetric(name string) (MetricInfo, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	info, ok := registry[name]
+	return info, ok
+}
+
+// RegisteredMetrics returns the information about every registered metric, in
+// the order they were registered.
+func RegisteredMetrics() []MetricInfo {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	infos := make([]MetricInfo, 0, len(registered))
+	for _, name := range registered {
+		infos = append(infos, registry[name])
+	}
+	return infos
+}
@@ -0,0 +1,73 @@
+package collector
+
+import (
+	"testing"
+)
+
+func TestAllMetricsAreRegistered(t *testing.T) {
+	for _, name := range append(AllMetrics, QueueCollectionFailed) {
+		info, ok := LookupMetric(name)
+		if !ok {
+			t.Errorf("LookupMetric(%q) ok = false, want true", name)
+			continue
+		}
+		if info.Description == "" || info.PrometheusName == "" || info.OpenTelemetryName == "" {
+			t.Errorf("LookupMetric(%q) = %+v, want a description and backend names", name, info)
+		}
+	}
+
+	if got, want := mustLookupMetric(t, BusyAgentPercentage).Unit, UnitPercent; got != want {
+		t.Errorf("BusyAgentPercentage unit = %q, want %q", got, want)
+	}
+}
+
+func TestRegisterMetric(t *testing.T) {
+	const name = "TestRegisterMetricCount"
+
+	if _, ok := LookupMetric(name); ok {
+		t.Fatalf("LookupMetric(%q) ok = true before registering", name)
+	}
+
+	RegisterMetric(MetricInfo{Name: name, Description: "first", Kind: KindCounter})
+	RegisterMetric(MetricInfo{Name: name, Description: "second", Kind: KindCounter})
+	t.Cleanup(func() { UnregisterMetric(name) })
+
+	if got, want := mustLookupMetric(t, name).Description, "second"; got != want {
+		t.Errorf("LookupMetric(%q).Description = %q, want %q", name, got, want)
+	}
+
+	var count int
+	for _, info := range RegisteredMetrics() {
+		if info.Name == name {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("RegisteredMetrics() has %d entries for %q, want 1", count, name)
+	}
+}
+
+func TestUnregisterMetric(t *testing.T) {
+	const name = "TestUnregisterMetricCount"
+
+	RegisterMetric(MetricInfo{Name: name, Kind: KindCounter})
+	UnregisterMetric(name)
+
+	if _, ok := LookupMetric(name); ok {
+		t.Errorf("LookupMetric(%q) ok = true after unregistering", name)
+	}
+	for _, info := range RegisteredMetrics() {
+		if info.Name == name {
+			t.Errorf("RegisteredMetrics() has %q after unregistering", name)
+		}
+	}
+}
+
+func mustLookupMetric(t *testing.T, name string) MetricInfo {
+	t.Helper()
+	info, ok := LookupMetric(name)
+	if !ok {
+		t.Fatalf("LookupMetric(%q) ok = false, want true", name)
+	}
+	return info
+}
@@ -0,0 +1,132 @@
+package collector
+
+import (
+	"encoding/json"
+	"math"
+	"slices"
+	"strings"
+)
+
+// Fields of the agents and jobs objects in Agent API metrics responses that
+// are already decoded into metricsAgentsResponse and metricsJobsResponse.
+var (
+	knownAgentsFields = []string{"idle", "busy", "total", "queues"}
+	knownJobsFields   = []string{"scheduled", "running", "waiting", "total", "queues"}
+)
+
+// Suffixes given to the names of passed through metrics, in line with the
+// names of the metrics that are already known.
+const (
+	agentsMetricSuffix = "AgentCount"
+	jobsMetricSuffix   = "JobsCount"
+)
+
+// rawCounts holds the undecoded fields of an agents or jobs object.
+type rawCounts map[string]json.RawMessage
+
+type rawMetricsResponse struct {
+	Agents rawCounts `json:"agents"`
+	Jobs   rawCounts `json:"jobs"`
+}
+
+// queues decodes the queues field of an all-queues agents or jobs object.
+func (rc rawCounts) queues() map[string]rawCounts {
+	var queues map[string]rawCounts
+	if v, ok := rc["queues"]; ok {
+		_ = json.Unmarshal(v, &queues) // leave queues empty if it isn't an object
+	}
+	return queues
+}
+
+// passthroughAllQueues adds the unknown numeric fields of an all-queues
+// metrics response to result, for the totals and each queue already in
+// result.Queues.
+func passthroughAllQueues(body []byte, result *Result) error {
+	var raw rawMetricsResponse
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return err
+	}
+
+	addUnknownMetrics(result.Totals, raw.Agents, knownAgentsFields, agentsMetricSuffix)
+	addUnknownMetrics(result.Totals, raw.Jobs, knownJobsFields, jobsMetricSuffix)
+
+	agentsQueues, jobsQueues := raw.Agents.queues(), raw.Jobs.queues()
+	for queue, counts := range result.Queues {
+		addUnknownMetrics(counts, agentsQueues[queue], knownAgentsFields, agentsMetricSuffix)
+		addUnknownMetrics(counts, jobsQueues[queue], knownJobsFields, jobsMetricSuffix)
+	}
+	return nil
+}
+
+// passthroughQueue returns the unknown numeric fields of a single queue's
+// metrics response.
+func passthroughQueue(body []byte) (map[string]int, error) {
+	var raw rawMetricsResponse
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+	addUnknownMetrics(counts, raw.Agents, knownAgentsFields, agentsMetricSuffix)
+	addUnknownMetrics(counts, raw.Jobs, knownJobsFields, jobsMetricSuffix)
+	return counts, nil
+}
+
+// addUnknownMetrics adds each numeric field in fields that isn't one of known
+// to counts, named by PassthroughMetricName. It never replaces a metric that is
+// already in counts. Fractional values are rounded to the nearest integer.
+func addUnknownMetrics(counts map[string]int, fields rawCounts, known []string, suffix string) {
+	for field, value := range fields {
+		if slices.Contains(known, field) {
+			continue
+		}
+
+		var f float64
+		if err := json.Unmarshal(value, &f); err != nil {
+			continue // not a number
+		}
+
+		name := PassthroughMetricName(field, suffix)
+		if name == "" {
+			continue
+		}
+		if _, exists := counts[name]; exists {
+			continue
+		}
+		counts[name] = int(math.Round(f))
+	}
+}
+
+// PassthroughMetricName returns the metric name used for an Agent API field
+// that the collector does not know about. The field is converted to CamelCase,
+// dropping anything other than ASCII letters and digits, and suffixed with
+// suffix, so that the jobs field "assigned" becomes "AssignedJobsCount" when
+// suffix is "JobsCount". It returns "" if nothing of the field is left.
+func PassthroughMetricName(field, suffix string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range field {
+		switch {
+		case 'a' <= r && r <= 'z':
+			if upper {
+				r -= 'a' - 'A'
+			}
+			fallthrough
+		case 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			b.WriteRune(r)
+			upper = false
+		default:
+			upper = true
+		}
+	}
+	if b.Len() == 0 {
+		return ""
+	}
+
+	name := b.String()
+	if name[0] >= '0' && name[0] <= '9' {
+		// Most backends don't allow metric names to start with a digit.
+		name = "N" + name
+	}
+	return name + suffix
+}
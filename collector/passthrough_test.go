@@ -0,0 +1,27 @@
+package collector
+
+import (
+	"testing"
+)
+
+func TestPassthroughMetricName(t *testing.T) {
+	tcs := []struct {
+		field, suffix string
+		want          string
+	}{
+		{"assigned", jobsMetricSuffix, "AssignedJobsCount"},
+		{"limited_by_concurrency", jobsMetricSuffix, "LimitedByConcurrencyJobsCount"},
+		{"stale-connected", agentsMetricSuffix, "StaleConnectedAgentCount"},
+		{"pausedAt", agentsMetricSuffix, "PausedAtAgentCount"},
+		{"p95 wait (s)", jobsMetricSuffix, "P95WaitSJobsCount"},
+		{"2xx", jobsMetricSuffix, "N2xxJobsCount"},
+		{"ünïcode", jobsMetricSuffix, "NCodeJobsCount"},
+		{"___", jobsMetricSuffix, ""},
+	}
+
+	for _, tc := range tcs {
+		if got := PassthroughMetricName(tc.field, tc.suffix); got != tc.want {
+			t.Errorf("PassthroughMetricName(%q, %q) = %q, want %q", tc.field, tc.suffix, got, tc.want)
+		}
+	}
+}
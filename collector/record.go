@@ -0,0 +1,314 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redacted replaces credentials in recorded requests and responses.
+const redacted = "[REDACTED]"
+
+// Recording is a response from the Agent API saved by a RecordingTransport, one
+// per file.
+type Recording struct {
+	Time time.Time `json:"time"`
+	// Token is the name of the token the request was made for, as given to
+	// ForToken, if it was. Only recordings for the same token are served for a
+	// request when replaying.
+	Token  string `json:"token,omitempty"`
+	Method string `json:"method"`
+	// URL is the request URL. Only its path and query are used to match
+	// recordings to requests when replaying.
+	URL string `json:"url"`
+	// RequestHeader is the request's header, with the token redacted.
+	RequestHeader http.Header `json:"request_header"`
+
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       string      `json:"body"`
+}
+
+// RecordingTransport is an http.RoundTripper that saves each response to a
+// JSON file in Dir, named in the order the responses were received, with the
+// token redacted. The recordings can be served in place of the Agent API by a
+// ReplayTransport.
+type RecordingTransport struct {
+	// Dir is the directory the recordings are saved to.
+	Dir string
+
+	// Base makes the requests. If nil, http.DefaultTransport is used.
+	Base http.RoundTripper
+
+	mu  sync.Mutex
+	seq int
+}
+
+// NewRecordingTransport returns a RecordingTransport that saves recordings to
+// dir, creating it if needed. Recordings already in dir are kept, and new ones
+// are numbered after them.
+func NewRecordingTransport(dir string, base http.RoundTripper) (*RecordingTransport, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating recording directory: %w", err)
+	}
+
+	files, err := recordingFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &RecordingTransport{Dir: dir, Base: base}
+	for _, f := range files {
+		t.seq = max(t.seq, f.seq)
+	}
+	return t, nil
+}
+
+// RoundTrip makes the request with Base and saves the response. Errors from
+// Base, which have no response, are not recorded.
+func (t *RecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	res, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+
+	rec := Recording{
+		Time:          time.Now().UTC(),
+		Token:         tokenName(req),
+		Method:        req.Method,
+		URL:           req.URL.String(),
+		RequestHeader: redactHeader(req.Header),
+		StatusCode:    res.StatusCode,
+		Header:        redactHeader(res.Header),
+		Body:          string(body),
+	}
+	if err := t.save(req, rec); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (t *RecordingTransport) save(req *http.Request, rec Recording) error {
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.seq++
+	name := fmt.Sprintf("%06d-%s.json", t.seq, recordingName(req.URL.Path))
+	if err := os.WriteFile(filepath.Join(t.Dir, name), data, 0o644); err != nil {
+		return fmt.Errorf("saving recording: %w", err)
+	}
+	return nil
+}
+
+// ReplayTransport is an http.RoundTripper that serves the responses saved by
+// a RecordingTransport in place of the Agent API. Each request is served the
+// oldest recording for the same token, method, path and query that hasn't
+// been served yet, so replaying the requests of a recorded run, in the same
+// order for each token, reproduces its responses.
+type ReplayTransport struct {
+	tokens []string
+
+	mu         sync.Mutex
+	recordings map[string][]Recording
+}
+
+// NewReplayTransport returns a ReplayTransport serving the recordings in dir.
+func NewReplayTransport(dir string) (*ReplayTransport, error) {
+	files, err := recordingFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no recordings found in %s", dir)
+	}
+
+	t := &ReplayTransport{recordings: make(map[string][]Recording)}
+	for _, f := range files {
+		data, err := os.ReadFile(filepath.Join(dir, f.name))
+		if err != nil {
+			return nil, err
+		}
+		var rec Recording
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return nil, fmt.Errorf("reading recording %s: %w", f.name, err)
+		}
+		key, err := replayKey(rec.Token, rec.Method, rec.URL)
+		if err != nil {
+			return nil, fmt.Errorf("reading recording %s: %w", f.name, err)
+		}
+		if !slices.Contains(t.tokens, rec.Token) {
+			t.tokens = append(t.tokens, rec.Token)
+		}
+		t.recordings[key] = append(t.recordings[key], rec)
+	}
+	return t, nil
+}
+
+// Tokens returns the names of the tokens there are recordings for, in the
+// order they were first recorded.
+func (t *ReplayTransport) Tokens() []string {
+	return slices.Clone(t.tokens)
+}
+
+// RoundTrip serves the next recording for the request, or returns an error if
+// there are none left.
+func (t *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	key, err := replayKey(tokenName(req), req.Method, req.URL.String())
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	recs := t.recordings[key]
+	if len(recs) == 0 {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("no recordings left for %s", key)
+	}
+	rec := recs[0]
+	t.recordings[key] = recs[1:]
+	t.mu.Unlock()
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", rec.StatusCode, http.StatusText(rec.StatusCode)),
+		StatusCode:    rec.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rec.Header.Clone(),
+		Body:          io.NopCloser(strings.NewReader(rec.Body)),
+		ContentLength: int64(len(rec.Body)),
+		Request:       req,
+	}, nil
+}
+
+// replayKey identifies the recordings that can be served for a request.
+func replayKey(token, method, rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	key := method + " " + u.RequestURI()
+	if token != "" {
+		key = token + ": " + key
+	}
+	return key, nil
+}
+
+// tokenNameKey is the context key for the name of the token a request is for.
+type tokenNameKey struct{}
+
+// ForToken returns an http.RoundTripper that makes requests with base, marked
+// as being for the token named name. A RecordingTransport saves the name with
+// each recording, and a ReplayTransport serves each request only the
+// recordings saved for the same name, so that tokens collected concurrently
+// are each replayed their own responses. If base is nil, http.DefaultTransport
+// is used.
+func ForToken(base http.RoundTripper, name string) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return tokenTransport{base: base, name: name}
+}
+
+type tokenTransport struct {
+	base http.RoundTripper
+	name string
+}
+
+func (t tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(req.WithContext(context.WithValue(req.Context(), tokenNameKey{}, t.name)))
+}
+
+// tokenName returns the name of the token req is for, or "" if it wasn't made
+// through ForToken.
+func tokenName(req *http.Request) string {
+	name, _ := req.Context().Value(tokenNameKey{}).(string)
+	return name
+}
+
+// redactHeader returns a copy of h with the token removed.
+func redactHeader(h http.Header) http.Header {
+	h = h.Clone()
+	if h.Get("Authorization") != "" {
+		h.Set("Authorization", "Token "+redacted)
+	}
+	return h
+}
+
+// recordingName returns a file name friendly version of a request path, such
+// as "metrics-queue" for "/v3/metrics/queue".
+func recordingName(p string) string {
+	if i := strings.Index(p, "/metrics"); i >= 0 {
+		p = p[i:]
+	}
+	name := strings.ReplaceAll(strings.Trim(p, "/"), "/", "-")
+	if name == "" {
+		return "root"
+	}
+	return name
+}
+
+type recordingFile struct {
+	name string
+	seq  int
+}
+
+// recordingFiles returns the recordings in dir, in the order they were saved.
+func recordingFiles(dir string) ([]recordingFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []recordingFile
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		prefix, _, ok := strings.Cut(e.Name(), "-")
+		if !ok {
+			continue
+		}
+		seq, err := strconv.Atoi(prefix)
+		if err != nil {
+			continue
+		}
+		files = append(files, recordingFile{name: e.Name(), seq: seq})
+	}
+
+	slices.SortFunc(files, func(a, b recordingFile) int { return a.seq - b.seq })
+	return files, nil
+}
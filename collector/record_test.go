@@ -0,0 +1,172 @@
+package collector
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	var scheduled int
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metrics/queue" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		scheduled++
+		w.Header().Set(PollDurationHeader, "15")
+		_, _ = io.WriteString(w, `{
+			"organization": {"slug": "test"},
+			"jobs": {"scheduled": `+strings.Repeat("1", scheduled)+`, "running": 0, "waiting": 0, "total": 0},
+			"agents": {"idle": 0, "busy": 0, "total": 0}
+		}`)
+	}))
+	defer s.Close()
+
+	dir := t.TempDir()
+	recorder, err := NewRecordingTransport(dir, nil)
+	if err != nil {
+		t.Fatalf("NewRecordingTransport() = %v", err)
+	}
+
+	c := &Collector{
+		Client:   &http.Client{Transport: recorder},
+		Endpoint: s.URL,
+		Token:    "abc123",
+		Queues:   []string{"default"},
+		Quiet:    true,
+	}
+
+	var recorded []*Result
+	for range 2 {
+		res, err := c.Collect()
+		if err != nil {
+			t.Fatalf("c.Collect() = %v", err)
+		}
+		recorded = append(recorded, res)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatalf("filepath.Glob() = %v", err)
+	}
+	if diff := cmp.Diff(files, []string{
+		filepath.Join(dir, "000001-metrics-queue.json"),
+		filepath.Join(dir, "000002-metrics-queue.json"),
+	}); diff != "" {
+		t.Errorf("recordings diff (-got +want):\n%s", diff)
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatalf("os.ReadFile(%q) = %v", f, err)
+		}
+		if strings.Contains(string(data), "abc123") {
+			t.Errorf("recording %s contains the token:\n%s", f, data)
+		}
+	}
+
+	replayer, err := NewReplayTransport(dir)
+	if err != nil {
+		t.Fatalf("NewReplayTransport() = %v", err)
+	}
+	// The server isn't used when replaying.
+	s.Close()
+	c.Client = &http.Client{Transport: replayer}
+
+	for i, want := range recorded {
+		got, err := c.Collect()
+		if err != nil {
+			t.Fatalf("replayed c.Collect() = %v", err)
+		}
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Errorf("replayed result %d diff (-got +want):\n%s", i, diff)
+		}
+	}
+
+	if _, err := c.Collect(); err == nil {
+		t.Error("c.Collect() after every recording was replayed = nil error, want an error")
+	}
+}
+
+func TestReplayForToken(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		org := strings.TrimPrefix(r.Header.Get("Authorization"), "Token ")
+		_, _ = io.WriteString(w, `{
+			"organization": {"slug": "`+org+`"},
+			"jobs": {"scheduled": 0, "running": 0, "waiting": 0, "total": 0},
+			"agents": {"idle": 0, "busy": 0, "total": 0, "queues": {}}
+		}`)
+	}))
+	defer s.Close()
+
+	dir := t.TempDir()
+	recorder, err := NewRecordingTransport(dir, nil)
+	if err != nil {
+		t.Fatalf("NewRecordingTransport() = %v", err)
+	}
+
+	collectors := map[string]*Collector{}
+	for _, name := range []string{"first", "second"} {
+		collectors[name] = &Collector{
+			Client:   &http.Client{Transport: ForToken(recorder, name)},
+			Endpoint: s.URL,
+			Token:    name + "-org",
+			Quiet:    true,
+		}
+	}
+	for _, name := range []string{"first", "second"} {
+		if _, err := collectors[name].Collect(); err != nil {
+			t.Fatalf("%s c.Collect() = %v", name, err)
+		}
+	}
+
+	replayer, err := NewReplayTransport(dir)
+	if err != nil {
+		t.Fatalf("NewReplayTransport() = %v", err)
+	}
+	if diff := cmp.Diff(replayer.Tokens(), []string{"first", "second"}); diff != "" {
+		t.Errorf("replayer.Tokens() diff (-got +want):\n%s", diff)
+	}
+
+	// Replaying in a different order still serves each token its own
+	// recording.
+	for _, name := range []string{"second", "first"} {
+		c := collectors[name]
+		c.Client = &http.Client{Transport: ForToken(replayer, name)}
+		res, err := c.Collect()
+		if err != nil {
+			t.Fatalf("replayed %s c.Collect() = %v", name, err)
+		}
+		if got, want := res.Org, name+"-org"; got != want {
+			t.Errorf("replayed %s res.Org = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestNewRecordingTransportContinuesNumbering(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "000007-metrics.json"), []byte("{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder, err := NewRecordingTransport(dir, nil)
+	if err != nil {
+		t.Fatalf("NewRecordingTransport() = %v", err)
+	}
+	if got, want := recorder.seq, 7; got != want {
+		t.Errorf("recorder.seq = %d, want %d", got, want)
+	}
+}
+
+func TestNewReplayTransportEmptyDir(t *testing.T) {
+	if _, err := NewReplayTransport(t.TempDir()); err == nil {
+		t.Error("NewReplayTransport(empty dir) = nil error, want an error")
+	}
+}
@@ -0,0 +1,153 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy controls how failed Agent API requests are retried. The zero
+// value disables retries.
+//
+// Network errors, such as connections being reset or timing out, and
+// responses with status 429, 500, 502, 503 or 504 are retried. Other
+// responses, in particular 401 and 403, and errors that retrying won't fix,
+// such as TLS verification failures, are never retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts made for each request,
+	// including the first. Values below 2 disable retries.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the first retry. The delay doubles
+	// with each subsequent retry, and is jittered to avoid many collectors
+	// retrying in lockstep.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the delay between attempts. A Retry-After header
+	// asking for a longer delay than this ends the retries instead.
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy used by the command line tool, the
+// Lambda and the Cloud Function unless configured otherwise.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: time.Second,
+	MaxBackoff:     30 * time.Second,
+}
+
+// delay returns how long to wait before making the given attempt (2 for the
+// first retry), and whether another attempt should be made at all after err.
+func (p RetryPolicy) delay(attempt int, err error) (time.Duration, bool) {
+	if attempt > p.MaxAttempts || !isRetryable(err) {
+		return 0, false
+	}
+
+	var httpErr HTTPError
+	if errors.As(err, &httpErr) && httpErr.RetryAfter > 0 {
+		if p.MaxBackoff > 0 && httpErr.RetryAfter > p.MaxBackoff {
+			return 0, false
+		}
+		return httpErr.RetryAfter, true
+	}
+
+	return p.backoff(attempt - 1), true
+}
+
+// backoff returns the jittered exponential backoff before the nth retry,
+// somewhere between half and all of InitialBackoff * 2^(n-1).
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < retry; i++ {
+		d *= 2
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + rand.N(d-half+1)
+}
+
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var httpErr HTTPError
+	if errors.As(err, &httpErr) {
+		switch httpErr.StatusCode {
+		case http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return true
+		default:
+			return false
+		}
+	}
+
+	// Connections that were reset, refused or closed early, timeouts and DNS
+	// failures may succeed next time. Other errors, such as TLS verification
+	// failures, malformed URLs and responses that can't be decoded, won't.
+	// Every error from http.Client is a url.Error, which is a net.Error
+	// itself, so it is the error it wraps that counts.
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either a
+// number of seconds or an HTTP date. It returns 0 if the value is missing or
+// invalid.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// sleepContext waits for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
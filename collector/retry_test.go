@@ -0,0 +1,164 @@
+package collector
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     time.Second,
+	}
+
+	tcs := []struct {
+		desc      string
+		attempt   int
+		err       error
+		wantRetry bool
+		wantDelay time.Duration // exact delay, or 0 for a jittered backoff
+	}{
+		{"connection reset", 2, &url.Error{Op: "Get", URL: "https://agent.buildkite.com/v3/metrics", Err: &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}}, true, 0},
+		{"connection closed early", 2, &url.Error{Op: "Get", URL: "https://agent.buildkite.com/v3/metrics", Err: io.ErrUnexpectedEOF}, true, 0},
+		{"tls verification", 2, &url.Error{Op: "Get", URL: "https://agent.buildkite.com/v3/metrics", Err: &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}}, false, 0},
+		{"malformed url", 2, &url.Error{Op: "parse", URL: "agent.buildkite.com", Err: errors.New("missing protocol scheme")}, false, 0},
+		{"undecodable error response", 2, fmt.Errorf("unmarshalling error response: %w", &json.SyntaxError{}), false, 0},
+		{"server error", 2, HTTPError{StatusCode: 502}, true, 0},
+		{"too many requests", 2, HTTPError{StatusCode: 429}, true, 0},
+		{"retry after", 2, HTTPError{StatusCode: 429, RetryAfter: 500 * time.Millisecond}, true, 500 * time.Millisecond},
+		{"retry after too long", 2, HTTPError{StatusCode: 503, RetryAfter: time.Minute}, false, 0},
+		{"unauthorized", 2, HTTPError{StatusCode: 401}, false, 0},
+		{"forbidden", 2, HTTPError{StatusCode: 403}, false, 0},
+		{"not found", 2, HTTPError{StatusCode: 404}, false, 0},
+		{"attempts exhausted", 4, HTTPError{StatusCode: 502}, false, 0},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.desc, func(t *testing.T) {
+			delay, retry := p.delay(tc.attempt, tc.err)
+			if retry != tc.wantRetry {
+				t.Fatalf("p.delay(%d, %v) retry = %t, want %t", tc.attempt, tc.err, retry, tc.wantRetry)
+			}
+			if tc.wantDelay > 0 && delay != tc.wantDelay {
+				t.Errorf("p.delay(%d, %v) delay = %v, want %v", tc.attempt, tc.err, delay, tc.wantDelay)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     300 * time.Millisecond,
+	}
+
+	tcs := []struct {
+		retry    int
+		min, max time.Duration
+	}{
+		{1, 50 * time.Millisecond, 100 * time.Millisecond},
+		{2, 100 * time.Millisecond, 200 * time.Millisecond},
+		{3, 150 * time.Millisecond, 300 * time.Millisecond},
+		{10, 150 * time.Millisecond, 300 * time.Millisecond},
+	}
+
+	for _, tc := range tcs {
+		for range 20 {
+			if got := p.backoff(tc.retry); got < tc.min || got > tc.max {
+				t.Errorf("p.backoff(%d) = %v, want between %v and %v", tc.retry, got, tc.min, tc.max)
+			}
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tcs := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"5", 5 * time.Second},
+		{"-1", 0},
+		{"soon", 0},
+		{now.Add(30 * time.Second).Format(http.TimeFormat), 30 * time.Second},
+		{now.Add(-30 * time.Second).Format(http.TimeFormat), 0},
+	}
+
+	for _, tc := range tcs {
+		if got := parseRetryAfter(tc.value, now); got != tc.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestCollectorDoesNotRetryPermanentErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		tls     bool
+		handler http.HandlerFunc
+	}{
+		{
+			// The client doesn't trust the server's certificate.
+			name:    "tls verification",
+			tls:     true,
+			handler: func(w http.ResponseWriter, r *http.Request) {},
+		},
+		{
+			name: "undecodable error response",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				_, _ = io.WriteString(w, "<html>Service Unavailable</html>")
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var conns atomic.Int32
+			s := httptest.NewUnstartedServer(test.handler)
+			s.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					conns.Add(1)
+				}
+			}
+			if test.tls {
+				s.StartTLS()
+			} else {
+				s.Start()
+			}
+			defer s.Close()
+
+			c := &Collector{
+				Client:    &http.Client{Transport: &http.Transport{DisableKeepAlives: true}},
+				Endpoint:  s.URL,
+				Token:     "abc123",
+				UserAgent: "some-client/1.2.3",
+				Quiet:     true,
+				Retry:     RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+			}
+
+			if _, err := c.Collect(); err == nil {
+				t.Fatal("c.Collect() = nil error, want an error")
+			}
+			if got, want := conns.Load(), int32(1); got != want {
+				t.Errorf("attempts = %d, want %d", got, want)
+			}
+		})
+	}
+}
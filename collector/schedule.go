@@ -0,0 +1,43 @@
+package collector
+
+import (
+	"sync"
+	"time"
+)
+
+// PollSchedule keeps track of when each of several tokens may next be polled,
+// according to the poll duration the Agent API asked for when it was last
+// polled. Each token has its own time, so one token being rate-limited doesn't
+// hold up the others. Tokens are identified by any name that is unique to
+// them, such as their position.
+//
+// The zero value is ready to use.
+type PollSchedule struct {
+	mu   sync.Mutex
+	next map[string]time.Time
+}
+
+// Due reports whether the token may be polled at now, and if not, how long
+// until it may be.
+func (s *PollSchedule) Due(token string, now time.Time) (bool, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next, ok := s.next[token]
+	if !ok || !next.After(now) {
+		return true, 0
+	}
+	return false, next.Sub(now)
+}
+
+// Polled records that the token was polled at now, and the Agent API asked
+// for it not to be polled again for pollDuration.
+func (s *PollSchedule) Polled(token string, now time.Time, pollDuration time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.next == nil {
+		s.next = make(map[string]time.Time)
+	}
+	s.next[token] = now.Add(pollDuration)
+}
@@ -0,0 +1,29 @@
+package collector
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPollSchedule(t *testing.T) {
+	var s PollSchedule
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if due, wait := s.Due("a", now); !due || wait != 0 {
+		t.Errorf("s.Due(a) before polling = %t, %v, want true, 0", due, wait)
+	}
+
+	s.Polled("a", now, time.Minute)
+	s.Polled("b", now, 10*time.Second)
+
+	later := now.Add(30 * time.Second)
+	if due, wait := s.Due("a", later); due || wait != 30*time.Second {
+		t.Errorf("s.Due(a) = %t, %v, want false, 30s", due, wait)
+	}
+	if due, wait := s.Due("b", later); !due || wait != 0 {
+		t.Errorf("s.Due(b) = %t, %v, want true, 0", due, wait)
+	}
+	if due, _ := s.Due("a", now.Add(time.Minute)); !due {
+		t.Errorf("s.Due(a) after its poll duration = false, want true")
+	}
+}
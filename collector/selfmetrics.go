@@ -0,0 +1,325 @@
+package collector
+
+import (
+	"sync"
+	"time"
+)
+
+// Self metrics, about the health of the collector rather than of the agents
+// and jobs it collects metrics for. They are found in Result.SelfMetrics.
+const (
+	// AgentMetricsUp is 1 if the last collection succeeded, and 0 if it
+	// failed.
+	AgentMetricsUp = "AgentMetricsUp"
+	// AgentMetricsLastSuccessTimestampSeconds is the Unix time of the last
+	// successful collection.
+	AgentMetricsLastSuccessTimestampSeconds = "AgentMetricsLastSuccessTimestampSeconds"
+	// AgentMetricsConsecutiveFailures is the number of collections that have
+	// failed since the last one that succeeded.
+	AgentMetricsConsecutiveFailures = "AgentMetricsConsecutiveFailures"
+	// AgentMetricsCollectionDurationMilliseconds is how long the last
+	// collection took, including retries.
+	AgentMetricsCollectionDurationMilliseconds = "AgentMetricsCollectionDurationMilliseconds"
+	// AgentMetricsAPIRequestDurationMilliseconds is the average duration of
+	// the Agent API requests made by the last collection.
+	AgentMetricsAPIRequestDurationMilliseconds = "AgentMetricsAPIRequestDurationMilliseconds"
+	// AgentMetricsPollDurationSeconds is the poll duration advertised by the
+	// Agent API in the PollDurationHeader, or 0 if it didn't advertise one.
+	AgentMetricsPollDurationSeconds = "AgentMetricsPollDurationSeconds"
+
+	// AgentMetricsAPIResponses2xx, 3xx, 4xx and 5xx count the Agent API
+	// responses by the class of their status code.
+	AgentMetricsAPIResponses2xx = "AgentMetricsAPIResponses2xx"
+	AgentMetricsAPIResponses3xx = "AgentMetricsAPIResponses3xx"
+	AgentMetricsAPIResponses4xx = "AgentMetricsAPIResponses4xx"
+	AgentMetricsAPIResponses5xx = "AgentMetricsAPIResponses5xx"
+	// AgentMetricsAPIRequestErrors counts the Agent API requests that failed
+	// without a response, such as when the connection timed out.
+	AgentMetricsAPIRequestErrors = "AgentMetricsAPIRequestErrors"
+	// AgentMetricsDecodeErrors counts the Agent API responses that could not
+	// be decoded.
+	AgentMetricsDecodeErrors = "AgentMetricsDecodeErrors"
+	// AgentMetricsBackendErrors counts the times publishing to the backend
+	// failed.
+	AgentMetricsBackendErrors = "AgentMetricsBackendErrors"
+)
+
+func init() {
+	for _, info := range []MetricInfo{
+		{
+			Name:              AgentMetricsUp,
+			Description:       "Whether the last collection of agent metrics succeeded (1) or not (0)",
+			Unit:              UnitCount,
+			Kind:              KindGauge,
+			PrometheusName:    "agent_metrics_up",
+			OpenTelemetryName: "buildkite.agent_metrics.up",
+		},
+		{
+			Name:              AgentMetricsLastSuccessTimestampSeconds,
+			Description:       "Unix time of the last successful collection of agent metrics",
+			Unit:              UnitSeconds,
+			Kind:              KindGauge,
+			PrometheusName:    "agent_metrics_last_success_timestamp_seconds",
+			OpenTelemetryName: "buildkite.agent_metrics.last_success_timestamp",
+		},
+		{
+			Name:              AgentMetricsConsecutiveFailures,
+			Description:       "Number of collections of agent metrics that failed since the last success",
+			Unit:              UnitCount,
+			Kind:              KindGauge,
+			PrometheusName:    "agent_metrics_consecutive_failures",
+			OpenTelemetryName: "buildkite.agent_metrics.consecutive_failures",
+		},
+		{
+			Name:              AgentMetricsCollectionDurationMilliseconds,
+			Description:       "Duration of the last collection of agent metrics",
+			Unit:              UnitMilliseconds,
+			Kind:              KindGauge,
+			PrometheusName:    "agent_metrics_collection_duration_milliseconds",
+			OpenTelemetryName: "buildkite.agent_metrics.collection.duration",
+		},
+		{
+			Name:              AgentMetricsAPIRequestDurationMilliseconds,
+			Description:       "Average duration of the Agent API requests of the last collection",
+			Unit:              UnitMilliseconds,
+			Kind:              KindGauge,
+			PrometheusName:    "agent_metrics_api_request_duration_milliseconds",
+			OpenTelemetryName: "buildkite.agent_metrics.api.request.duration",
+		},
+		{
+			Name:              AgentMetricsPollDurationSeconds,
+			Description:       "Poll duration advertised by the Agent API",
+			Unit:              UnitSeconds,
+			Kind:              KindGauge,
+			PrometheusName:    "agent_metrics_poll_duration_seconds",
+			OpenTelemetryName: "buildkite.agent_metrics.poll_duration",
+		},
+		{
+			Name:              AgentMetricsAPIResponses2xx,
+			Description:       "Number of Agent API responses with a 2xx status",
+			Unit:              UnitCount,
+			Kind:              KindCounter,
+			PrometheusName:    "agent_metrics_api_responses_2xx_total",
+			OpenTelemetryName: "buildkite.agent_metrics.api.responses.2xx",
+		},
+		{
+			Name:              AgentMetricsAPIResponses3xx,
+			Description:       "Number of Agent API responses with a 3xx status",
+			Unit:              UnitCount,
+			Kind:              KindCounter,
+			PrometheusName:    "agent_metrics_api_responses_3xx_total",
+			OpenTelemetryName: "buildkite.agent_metrics.api.responses.3xx",
+		},
+		{
+			Name:              AgentMetricsAPIResponses4xx,
+			Description:       "Number of Agent API responses with a 4xx status",
+			Unit:              UnitCount,
+			Kind:              KindCounter,
+			PrometheusName:    "agent_metrics_api_responses_4xx_total",
+			OpenTelemetryName: "buildkite.agent_metrics.api.responses.4xx",
+		},
+		{
+			Name:              AgentMetricsAPIResponses5xx,
+			Description:       "Number of Agent API responses with a 5xx status",
+			Unit:              UnitCount,
+			Kind:              KindCounter,
+			PrometheusName:    "agent_metrics_api_responses_5xx_total",
+			OpenTelemetryName: "buildkite.agent_metrics.api.responses.5xx",
+		},
+		{
+			Name:              AgentMetricsAPIRequestErrors,
+			Description:       "Number of Agent API requests that failed without a response",
+			Unit:              UnitCount,
+			Kind:              KindCounter,
+			PrometheusName:    "agent_metrics_api_request_errors_total",
+			OpenTelemetryName: "buildkite.agent_metrics.api.request_errors",
+		},
+		{
+			Name:              AgentMetricsDecodeErrors,
+			Description:       "Number of Agent API responses that could not be decoded",
+			Unit:              UnitCount,
+			Kind:              KindCounter,
+			PrometheusName:    "agent_metrics_decode_errors_total",
+			OpenTelemetryName: "buildkite.agent_metrics.decode_errors",
+		},
+		{
+			Name:              AgentMetricsBackendErrors,
+			Description:       "Number of times publishing metrics to the backend failed",
+			Unit:              UnitCount,
+			Kind:              KindCounter,
+			PrometheusName:    "agent_metrics_backend_errors_total",
+			OpenTelemetryName: "buildkite.agent_metrics.backend_errors",
+		},
+	} {
+		RegisterMetric(info)
+	}
+}
+
+// SelfMetrics records metrics about the health of a Collector: how its
+// collections and Agent API requests went. Counters are running totals for
+// the life of the SelfMetrics.
+//
+// The methods of a nil *SelfMetrics do nothing, so a Collector without one
+// doesn't record anything.
+type SelfMetrics struct {
+	mu sync.Mutex
+
+	up                  bool
+	collected           bool // whether any collection has finished
+	lastSuccess         time.Time
+	consecutiveFailures int
+	collectionDuration  time.Duration
+	pollDuration        time.Duration
+	counters            map[string]int
+
+	// Requests of the collection in progress, averaged when it finishes.
+	requests        int
+	requestDuration time.Duration
+	averageRequest  time.Duration
+
+	// org and cluster are those of the last successful collection.
+	org, cluster string
+}
+
+// request records the outcome of a single Agent API request that took d. A
+// status code of 0 means the request failed without a response.
+func (s *SelfMetrics) request(statusCode int, d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	s.requestDuration += d
+
+	switch {
+	case statusCode >= 200 && statusCode <= 299:
+		s.add(AgentMetricsAPIResponses2xx, 1)
+	case statusCode >= 300 && statusCode <= 399:
+		s.add(AgentMetricsAPIResponses3xx, 1)
+	case statusCode >= 400 && statusCode <= 499:
+		s.add(AgentMetricsAPIResponses4xx, 1)
+	case statusCode >= 500 && statusCode <= 599:
+		s.add(AgentMetricsAPIResponses5xx, 1)
+	default:
+		s.add(AgentMetricsAPIRequestErrors, 1)
+	}
+}
+
+// decodeError records an Agent API response that could not be decoded.
+func (s *SelfMetrics) decodeError() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.add(AgentMetricsDecodeErrors, 1)
+}
+
+// BackendError records a failure to publish metrics to a backend.
+func (s *SelfMetrics) BackendError() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.add(AgentMetricsBackendErrors, 1)
+}
+
+// collection records a collection that started at start and finished at end,
+// with result if it succeeded or err if it didn't.
+func (s *SelfMetrics) collection(result *Result, err error, start, end time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.collected = true
+	s.collectionDuration = end.Sub(start)
+	s.averageRequest = 0
+	if s.requests > 0 {
+		s.averageRequest = s.requestDuration / time.Duration(s.requests)
+	}
+	s.requests, s.requestDuration = 0, 0
+
+	if err != nil {
+		s.up = false
+		s.consecutiveFailures++
+		return
+	}
+
+	s.up = true
+	s.consecutiveFailures = 0
+	s.lastSuccess = end
+	s.pollDuration = result.PollDuration
+	s.org, s.cluster = result.Org, result.Cluster
+}
+
+// add adds n to the named counter. The caller must hold s.mu.
+func (s *SelfMetrics) add(name string, n int) {
+	if s.counters == nil {
+		s.counters = make(map[string]int)
+	}
+	s.counters[name] += n
+}
+
+// Metrics returns the current self metrics, keyed by name. Gauges about
+// collections are only included once a collection has finished, and the last
+// success time once one has succeeded.
+func (s *SelfMetrics) Metrics() map[string]int {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	metrics := map[string]int{
+		AgentMetricsAPIResponses2xx:  s.counters[AgentMetricsAPIResponses2xx],
+		AgentMetricsAPIResponses3xx:  s.counters[AgentMetricsAPIResponses3xx],
+		AgentMetricsAPIResponses4xx:  s.counters[AgentMetricsAPIResponses4xx],
+		AgentMetricsAPIResponses5xx:  s.counters[AgentMetricsAPIResponses5xx],
+		AgentMetricsAPIRequestErrors: s.counters[AgentMetricsAPIRequestErrors],
+		AgentMetricsDecodeErrors:     s.counters[AgentMetricsDecodeErrors],
+		AgentMetricsBackendErrors:    s.counters[AgentMetricsBackendErrors],
+	}
+
+	if s.collected {
+		metrics[AgentMetricsUp] = 0
+		if s.up {
+			metrics[AgentMetricsUp] = 1
+		}
+		metrics[AgentMetricsConsecutiveFailures] = s.consecutiveFailures
+		metrics[AgentMetricsCollectionDurationMilliseconds] = int(s.collectionDuration.Milliseconds())
+		metrics[AgentMetricsAPIRequestDurationMilliseconds] = int(s.averageRequest.Milliseconds())
+		metrics[AgentMetricsPollDurationSeconds] = int(s.pollDuration.Seconds())
+	}
+	if !s.lastSuccess.IsZero() {
+		metrics[AgentMetricsLastSuccessTimestampSeconds] = int(s.lastSuccess.Unix())
+	}
+
+	return metrics
+}
+
+// Result returns a Result with only the current self metrics, for the
+// organization and cluster of the last successful collection. It is for
+// publishing the self metrics when a collection fails, so that a broken
+// collector can be noticed.
+func (s *SelfMetrics) Result() *Result {
+	if s == nil {
+		return &Result{}
+	}
+	metrics := s.Metrics()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return &Result{
+		Org:         s.org,
+		Cluster:     s.cluster,
+		SelfMetrics: metrics,
+	}
+}
@@ -0,0 +1,125 @@
+package collector
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCollectorSelfMetrics(t *testing.T) {
+	responses := []func(w http.ResponseWriter){
+		func(w http.ResponseWriter) {
+			w.Header().Set(PollDurationHeader, "20")
+			_, _ = io.WriteString(w, `{"organization": {"slug": "test"}, "cluster": {"name": "default"}}`)
+		},
+		func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = io.WriteString(w, "bad gateway")
+		},
+		func(w http.ResponseWriter) {
+			_, _ = io.WriteString(w, `{"organization": `)
+		},
+	}
+	var calls int
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		responses[calls](w)
+		calls++
+	}))
+	defer s.Close()
+
+	self := &SelfMetrics{}
+	c := &Collector{
+		Client:      s.Client(),
+		Endpoint:    s.URL,
+		Token:       "abc123",
+		Quiet:       true,
+		SelfMetrics: self,
+	}
+
+	before := time.Now().Unix()
+	res, err := c.Collect()
+	if err != nil {
+		t.Fatalf("c.Collect() = %v", err)
+	}
+	got := res.SelfMetrics
+
+	if ts := got[AgentMetricsLastSuccessTimestampSeconds]; ts < int(before) || ts > int(time.Now().Unix()) {
+		t.Errorf("res.SelfMetrics[%s] = %d, want the time of the collection", AgentMetricsLastSuccessTimestampSeconds, ts)
+	}
+	lastSuccess := got[AgentMetricsLastSuccessTimestampSeconds]
+	for _, name := range []string{AgentMetricsLastSuccessTimestampSeconds, AgentMetricsCollectionDurationMilliseconds, AgentMetricsAPIRequestDurationMilliseconds} {
+		if _, ok := got[name]; !ok {
+			t.Errorf("res.SelfMetrics[%s] missing", name)
+		}
+		delete(got, name)
+	}
+
+	want := map[string]int{
+		AgentMetricsUp:                  1,
+		AgentMetricsConsecutiveFailures: 0,
+		AgentMetricsPollDurationSeconds: 20,
+		AgentMetricsAPIResponses2xx:     1,
+		AgentMetricsAPIResponses3xx:     0,
+		AgentMetricsAPIResponses4xx:     0,
+		AgentMetricsAPIResponses5xx:     0,
+		AgentMetricsAPIRequestErrors:    0,
+		AgentMetricsDecodeErrors:        0,
+		AgentMetricsBackendErrors:       0,
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("res.SelfMetrics diff (-got +want):\n%s", diff)
+	}
+
+	// The next two collections fail, with a 502 and then a response that
+	// can't be decoded.
+	for range 2 {
+		if _, err := c.Collect(); err == nil {
+			t.Fatalf("c.Collect() = nil error, want an error")
+		}
+	}
+	self.BackendError()
+
+	failed := self.Result()
+	if !failed.OnlySelfMetrics() {
+		t.Errorf("self.Result().OnlySelfMetrics() = false, want true")
+	}
+	if failed.Org != "test" || failed.Cluster != "default" {
+		t.Errorf("self.Result() org, cluster = %q, %q, want those of the last success", failed.Org, failed.Cluster)
+	}
+	got = failed.SelfMetrics
+	delete(got, AgentMetricsCollectionDurationMilliseconds)
+	delete(got, AgentMetricsAPIRequestDurationMilliseconds)
+
+	want = map[string]int{
+		AgentMetricsUp:                          0,
+		AgentMetricsLastSuccessTimestampSeconds: lastSuccess,
+		AgentMetricsConsecutiveFailures:         2,
+		AgentMetricsPollDurationSeconds:         20,
+		AgentMetricsAPIResponses2xx:             2,
+		AgentMetricsAPIResponses3xx:             0,
+		AgentMetricsAPIResponses4xx:             0,
+		AgentMetricsAPIResponses5xx:             1,
+		AgentMetricsAPIRequestErrors:            0,
+		AgentMetricsDecodeErrors:                1,
+		AgentMetricsBackendErrors:               1,
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("self.Result().SelfMetrics diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestNilSelfMetrics(t *testing.T) {
+	var self *SelfMetrics
+	self.request(http.StatusOK, time.Second)
+	self.decodeError()
+	self.BackendError()
+	self.collection(&Result{}, nil, time.Now(), time.Now())
+
+	if got := self.Metrics(); got != nil {
+		t.Errorf("nil SelfMetrics.Metrics() = %v, want nil", got)
+	}
+}
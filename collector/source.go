@@ -0,0 +1,136 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Source is a producer of metrics. The Agent API Collector and ReaderSource
+// are the ones provided, and others can be used with the same backends and
+// loops.
+type Source interface {
+	Collect() (*Result, error)
+}
+
+// ContextSource is a Source whose collection can be bound to a context, so
+// that cancellation or a deadline aborts any in-flight calls it makes.
+type ContextSource interface {
+	Source
+	CollectContext(ctx context.Context) (*Result, error)
+}
+
+// FailedResulter is a Source with something to publish when collecting from it
+// fails, such as Collector with self metrics or a staleness policy.
+type FailedResulter interface {
+	FailedResult() *Result
+}
+
+// BackendErrorRecorder is a Source that keeps track of failures to publish its
+// results, such as Collector with self metrics.
+type BackendErrorRecorder interface {
+	BackendError()
+}
+
+// CollectContext collects a result from a source, passing ctx through if the
+// source implements ContextSource. Sources that do not accept a context are
+// only called if ctx is not already done.
+func CollectContext(ctx context.Context, s Source) (*Result, error) {
+	if cs, ok := s.(ContextSource); ok {
+		return cs.CollectContext(ctx)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Collect()
+}
+
+// BackendError records a failure to publish a result from c, if c.SelfMetrics
+// is set.
+func (c *Collector) BackendError() {
+	c.SelfMetrics.BackendError()
+}
+
+// SourceFunc is an adapter to allow the use of an ordinary function as a
+// Source.
+type SourceFunc func(ctx context.Context) (*Result, error)
+
+// Collect calls f with context.Background().
+func (f SourceFunc) Collect() (*Result, error) {
+	return f(context.Background())
+}
+
+// CollectContext calls f(ctx).
+func (f SourceFunc) CollectContext(ctx context.Context) (*Result, error) {
+	return f(ctx)
+}
+
+// ErrSourceExhausted is returned by a Source that has no more results, such as
+// a ReaderSource that has read all of its input.
+var ErrSourceExhausted = errors.New("source has no more results")
+
+// ReaderSource is a Source that reads results from JSON values in a stream,
+// such as standard input, one for each collection. Each value is an object
+// like:
+//
+//	{
+//	  "org": "my-org",
+//	  "cluster": "my-cluster",
+//	  "poll_duration_seconds": 15,
+//	  "totals": {"ScheduledJobsCount": 3},
+//	  "queues": {"default": {"ScheduledJobsCount": 3}}
+//	}
+//
+// When the stream ends, Collect returns ErrSourceExhausted.
+type ReaderSource struct {
+	mu  sync.Mutex
+	dec *json.Decoder
+}
+
+// NewReaderSource returns a ReaderSource that reads results from r.
+func NewReaderSource(r io.Reader) *ReaderSource {
+	return &ReaderSource{dec: json.NewDecoder(r)}
+}
+
+// resultJSON is the form of a Result read by ReaderSource.
+type resultJSON struct {
+	Org                 string                    `json:"org"`
+	Cluster             string                    `json:"cluster"`
+	PollDurationSeconds int                       `json:"poll_duration_seconds"`
+	Totals              map[string]int            `json:"totals"`
+	Queues              map[string]map[string]int `json:"queues"`
+}
+
+// Collect reads the next result.
+func (s *ReaderSource) Collect() (*Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var v resultJSON
+	if err := s.dec.Decode(&v); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, ErrSourceExhausted
+		}
+		return nil, fmt.Errorf("reading result: %w", err)
+	}
+
+	result := &Result{
+		Org:          v.Org,
+		Cluster:      v.Cluster,
+		PollDuration: time.Duration(v.PollDurationSeconds) * time.Second,
+		Totals:       v.Totals,
+		Queues:       v.Queues,
+		QueueErrors:  map[string]error{},
+	}
+	if result.Totals == nil {
+		result.Totals = map[string]int{}
+	}
+	if result.Queues == nil {
+		result.Queues = map[string]map[string]int{}
+	}
+	return result, nil
+}
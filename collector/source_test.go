@@ -0,0 +1,98 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// plainSource is a Source that doesn't accept a context.
+type plainSource struct {
+	calls int
+}
+
+func (s *plainSource) Collect() (*Result, error) {
+	s.calls++
+	return &Result{Org: "plain"}, nil
+}
+
+type testContextKey struct{}
+
+func TestCollectContextSource(t *testing.T) {
+	var gotCtx context.Context
+	ctx := context.WithValue(context.Background(), testContextKey{}, "value")
+	fn := SourceFunc(func(ctx context.Context) (*Result, error) {
+		gotCtx = ctx
+		return &Result{Org: "func"}, nil
+	})
+
+	res, err := CollectContext(ctx, fn)
+	if err != nil {
+		t.Fatalf("CollectContext(SourceFunc) = %v", err)
+	}
+	if res.Org != "func" || gotCtx != ctx {
+		t.Errorf("CollectContext(SourceFunc) = %+v with context %v, want the function's result with ctx passed through", res, gotCtx)
+	}
+
+	plain := &plainSource{}
+	if _, err := CollectContext(ctx, plain); err != nil {
+		t.Fatalf("CollectContext(plainSource) = %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := CollectContext(cancelled, plain); !errors.Is(err, context.Canceled) {
+		t.Errorf("CollectContext(cancelled, plainSource) = %v, want context.Canceled", err)
+	}
+	if got, want := plain.calls, 1; got != want {
+		t.Errorf("plainSource calls = %d, want %d", got, want)
+	}
+}
+
+func TestReaderSource(t *testing.T) {
+	src := NewReaderSource(strings.NewReader(`
+		{"org": "test", "cluster": "default", "poll_duration_seconds": 15, "totals": {"ScheduledJobsCount": 3}, "queues": {"deploy": {"ScheduledJobsCount": 3}}}
+		{"org": "test"}
+	`))
+
+	var got []*Result
+	for {
+		res, err := src.Collect()
+		if errors.Is(err, ErrSourceExhausted) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("src.Collect() = %v", err)
+		}
+		got = append(got, res)
+	}
+
+	want := []*Result{
+		{
+			Org:          "test",
+			Cluster:      "default",
+			PollDuration: 15 * time.Second,
+			Totals:       map[string]int{ScheduledJobsCount: 3},
+			Queues:       map[string]map[string]int{"deploy": {ScheduledJobsCount: 3}},
+			QueueErrors:  map[string]error{},
+		},
+		{
+			Org:         "test",
+			Totals:      map[string]int{},
+			Queues:      map[string]map[string]int{},
+			QueueErrors: map[string]error{},
+		},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("src.Collect() results diff (-got +want):\n%s", diff)
+	}
+
+	invalid := NewReaderSource(strings.NewReader(`{"org": `))
+	if _, err := invalid.Collect(); err == nil || errors.Is(err, ErrSourceExhausted) {
+		t.Errorf("invalid.Collect() = %v, want a decoding error", err)
+	}
+}
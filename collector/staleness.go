@@ -0,0 +1,114 @@
+package collector
+
+import (
+	"maps"
+	"sync"
+)
+
+// AgentMetricsStale is published with a value of 1 when the metrics for an
+// organization and cluster are stale, because collecting them has failed too
+// many times in a row, and 0 otherwise. It is found in Result.SelfMetrics when
+// Collector.Staleness is set.
+const AgentMetricsStale = "AgentMetricsStale"
+
+func init() {
+	RegisterMetric(MetricInfo{
+		Name:              AgentMetricsStale,
+		Description:       "Whether the agent metrics are stale because collecting them keeps failing (1) or not (0)",
+		Unit:              UnitCount,
+		Kind:              KindGauge,
+		PrometheusName:    "agent_metrics_stale",
+		OpenTelemetryName: "buildkite.agent_metrics.stale",
+	})
+}
+
+// Staleness is a policy for what to publish when collections fail, so that
+// backends don't keep serving the last metrics indefinitely during an Agent
+// API outage.
+//
+// For the first MaxFailures-1 failures in a row only the self metrics are
+// published, so backends that keep the last metrics, such as Prometheus, go on
+// serving them, and those that send each result, such as CloudWatch, send no
+// agent or job metrics rather than old ones with new timestamps. From the
+// MaxFailures'th, the metrics are stale: a Result with Stale set is published
+// instead, and backends drop the metrics for its organization and cluster, or
+// stop sending them. Either way, AgentMetricsStale says whether they are stale.
+type Staleness struct {
+	// MaxFailures is the number of collections in a row that must fail for
+	// the metrics to be stale. Values below 1 are treated as 1.
+	MaxFailures int
+
+	mu       sync.Mutex
+	failures int
+
+	// org and cluster are those of the last successful collection.
+	org, cluster string
+}
+
+// succeeded records a successful collection of r, and adds AgentMetricsStale
+// to it.
+func (s *Staleness) succeeded(r *Result) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.SelfMetrics == nil {
+		r.SelfMetrics = make(map[string]int)
+	}
+	r.SelfMetrics[AgentMetricsStale] = 0
+
+	s.failures = 0
+	s.org, s.cluster = r.Org, r.Cluster
+}
+
+// failed records a failed collection, and returns the Result to publish for
+// it, with self as its self metrics.
+func (s *Staleness) failed(self *Result) *Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures++
+
+	selfMetrics := maps.Clone(self.SelfMetrics)
+	if selfMetrics == nil {
+		selfMetrics = make(map[string]int)
+	}
+
+	// Without a successful collection, all there is to go on is the
+	// organization and cluster of the self metrics, if any.
+	result := &Result{
+		Org:         self.Org,
+		Cluster:     self.Cluster,
+		SelfMetrics: selfMetrics,
+	}
+	if s.org != "" {
+		result.Org, result.Cluster = s.org, s.cluster
+	}
+
+	if s.failures < s.MaxFailures {
+		result.SelfMetrics[AgentMetricsStale] = 0
+		return result
+	}
+
+	result.Stale = true
+	result.SelfMetrics[AgentMetricsStale] = 1
+	return result
+}
+
+// FailedResult returns the Result to publish after c.CollectContext fails, or
+// nil if there is nothing to publish. It has the self metrics, if
+// c.SelfMetrics is set, and according to c.Staleness, whether the last metrics
+// collected are stale.
+func (c *Collector) FailedResult() *Result {
+	if c.SelfMetrics == nil && c.Staleness == nil {
+		return nil
+	}
+
+	result := c.SelfMetrics.Result()
+	if c.Staleness != nil {
+		result = c.Staleness.failed(result)
+	}
+	return result
+}
@@ -0,0 +1,124 @@
+package collector
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCollectorStaleness(t *testing.T) {
+	var fail bool
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = io.WriteString(w, "unavailable")
+			return
+		}
+		_, _ = io.WriteString(w, `{
+			"organization": {"slug": "test"},
+			"cluster": {"name": "default"},
+			"jobs": {"scheduled": 3, "running": 0, "waiting": 0, "total": 3},
+			"agents": {"idle": 0, "busy": 0, "total": 0}
+		}`)
+	}))
+	defer s.Close()
+
+	c := &Collector{
+		Client:    s.Client(),
+		Endpoint:  s.URL,
+		Token:     "abc123",
+		Quiet:     true,
+		Staleness: &Staleness{MaxFailures: 3},
+	}
+
+	res, err := c.Collect()
+	if err != nil {
+		t.Fatalf("c.Collect() = %v", err)
+	}
+	if got, want := res.SelfMetrics[AgentMetricsStale], 0; got != want {
+		t.Errorf("res.SelfMetrics[AgentMetricsStale] = %d, want %d", got, want)
+	}
+
+	fail = true
+
+	// The first two failures only publish the self metrics, never the last
+	// metrics again.
+	for i := 1; i <= 2; i++ {
+		if _, err := c.Collect(); err == nil {
+			t.Fatalf("c.Collect() = nil error, want an error")
+		}
+		want := &Result{
+			Org:         "test",
+			Cluster:     "default",
+			SelfMetrics: map[string]int{AgentMetricsStale: 0},
+		}
+		failed := c.FailedResult()
+		if diff := cmp.Diff(failed, want); diff != "" {
+			t.Errorf("c.FailedResult() after %d failures diff (-got +want):\n%s", i, diff)
+		}
+		if !failed.OnlySelfMetrics() {
+			t.Errorf("c.FailedResult().OnlySelfMetrics() after %d failures = false, want true", i)
+		}
+	}
+
+	// From the third they are stale.
+	if _, err := c.Collect(); err == nil {
+		t.Fatalf("c.Collect() = nil error, want an error")
+	}
+	want := &Result{
+		Org:         "test",
+		Cluster:     "default",
+		Stale:       true,
+		SelfMetrics: map[string]int{AgentMetricsStale: 1},
+	}
+	if diff := cmp.Diff(c.FailedResult(), want); diff != "" {
+		t.Errorf("c.FailedResult() diff (-got +want):\n%s", diff)
+	}
+
+	// A success makes them fresh again.
+	fail = false
+	res, err = c.Collect()
+	if err != nil {
+		t.Fatalf("c.Collect() = %v", err)
+	}
+	if res.Stale || res.SelfMetrics[AgentMetricsStale] != 0 {
+		t.Errorf("c.Collect() after recovering = stale %t, AgentMetricsStale %d, want fresh", res.Stale, res.SelfMetrics[AgentMetricsStale])
+	}
+}
+
+func TestCollectorStalenessBeforeSuccess(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = io.WriteString(w, "unavailable")
+	}))
+	defer s.Close()
+
+	c := &Collector{
+		Client:    s.Client(),
+		Endpoint:  s.URL,
+		Token:     "abc123",
+		Quiet:     true,
+		Staleness: &Staleness{MaxFailures: 2},
+	}
+
+	// A failure when starting up, before any collection has succeeded, isn't
+	// enough for the metrics to be stale either.
+	if _, err := c.Collect(); err == nil {
+		t.Fatalf("c.Collect() = nil error, want an error")
+	}
+	want := &Result{SelfMetrics: map[string]int{AgentMetricsStale: 0}}
+	if diff := cmp.Diff(c.FailedResult(), want); diff != "" {
+		t.Errorf("c.FailedResult() after 1 failure diff (-got +want):\n%s", diff)
+	}
+
+	if _, err := c.Collect(); err == nil {
+		t.Fatalf("c.Collect() = nil error, want an error")
+	}
+	want = &Result{Stale: true, SelfMetrics: map[string]int{AgentMetricsStale: 1}}
+	if diff := cmp.Diff(c.FailedResult(), want); diff != "" {
+		t.Errorf("c.FailedResult() after 2 failures diff (-got +want):\n%s", diff)
+	}
+}
@@ -0,0 +1,167 @@
+package collector
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Suffixes of the metrics added by a Window, appended to the name of the
+// metric they are computed from. For example, the average of
+// ScheduledJobsCount is ScheduledJobsCountAvg.
+const (
+	WindowAvgSuffix           = "Avg"
+	WindowMaxSuffix           = "Max"
+	WindowMinSuffix           = "Min"
+	WindowRatePerMinuteSuffix = "RatePerMinute"
+)
+
+// Window keeps the values of each metric, for the totals and each queue, over
+// a rolling window of time, and adds statistics about them to each Result it is
+// applied to. It lets backends that only see the latest values, such as StatsD,
+// publish smoothed values and trends.
+//
+// A Window is safe for concurrent use, but should only be applied to the
+// results of one Collector, since it doesn't tell organizations apart.
+type Window struct {
+	// Duration is how far back the window reaches.
+	Duration time.Duration
+
+	// Metrics are the names of the metrics to compute statistics for. If
+	// empty, statistics are computed for every metric in each Result.
+	Metrics []string
+
+	mu     sync.Mutex
+	totals map[string][]windowPoint
+	queues map[string]map[string][]windowPoint
+}
+
+type windowPoint struct {
+	at    time.Time
+	value int
+}
+
+// Apply records the metrics in r as measured at now, and adds the following
+// statistics about each of them over the window, including now, to r:
+//
+//   - the average, suffixed with WindowAvgSuffix
+//   - the maximum, suffixed with WindowMaxSuffix
+//   - the minimum, suffixed with WindowMinSuffix
+//   - the change per minute between the oldest and newest values, suffixed
+//     with WindowRatePerMinuteSuffix, once there are at least two values
+//
+// Averages and rates are rounded to the nearest integer. Queues missing from r,
+// such as those that failed, are left out of the statistics for now.
+func (w *Window) Apply(r *Result, now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.totals == nil {
+		w.totals = make(map[string][]windowPoint)
+		w.queues = make(map[string]map[string][]windowPoint)
+	}
+
+	cutoff := now.Add(-w.Duration)
+	prune(w.totals, cutoff)
+	for queue, points := range w.queues {
+		prune(points, cutoff)
+		if len(points) == 0 {
+			delete(w.queues, queue)
+		}
+	}
+
+	if len(r.Totals) > 0 {
+		w.apply(w.totals, r.Totals, now)
+	}
+	for queue, counts := range r.Queues {
+		points := w.queues[queue]
+		if points == nil {
+			points = make(map[string][]windowPoint)
+			w.queues[queue] = points
+		}
+		w.apply(points, counts, now)
+	}
+}
+
+func (w *Window) apply(points map[string][]windowPoint, counts map[string]int, now time.Time) {
+	// Statistics are added to counts, so find the metrics to compute them for
+	// first.
+	var names []string
+	for name := range counts {
+		if len(w.Metrics) == 0 || slices.Contains(w.Metrics, name) {
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range names {
+		points[name] = append(points[name], windowPoint{at: now, value: counts[name]})
+		registerWindowMetrics(name)
+
+		values := points[name]
+		sum, lo, hi := 0, values[0].value, values[0].value
+		for _, p := range values {
+			sum += p.value
+			lo = min(lo, p.value)
+			hi = max(hi, p.value)
+		}
+
+		counts[name+WindowAvgSuffix] = int(math.Round(float64(sum) / float64(len(values))))
+		counts[name+WindowMaxSuffix] = hi
+		counts[name+WindowMinSuffix] = lo
+
+		first, last := values[0], values[len(values)-1]
+		if elapsed := last.at.Sub(first.at); elapsed > 0 {
+			rate := float64(last.value-first.value) / elapsed.Minutes()
+			counts[name+WindowRatePerMinuteSuffix] = int(math.Round(rate))
+		}
+	}
+}
+
+// prune removes the values recorded before cutoff, and any metrics left
+// without values.
+func prune(points map[string][]windowPoint, cutoff time.Time) {
+	for name, values := range points {
+		i := 0
+		for i < len(values) && values[i].at.Before(cutoff) {
+			i++
+		}
+		if i == len(values) {
+			delete(points, name)
+			continue
+		}
+		points[name] = values[i:]
+	}
+}
+
+var windowSuffixes = []struct {
+	suffix, description, prometheus, opentelemetry string
+}{
+	{WindowAvgSuffix, "average", "_avg", ".avg"},
+	{WindowMaxSuffix, "maximum", "_max", ".max"},
+	{WindowMinSuffix, "minimum", "_min", ".min"},
+	{WindowRatePerMinuteSuffix, "change per minute", "_rate_per_minute", ".rate_per_minute"},
+}
+
+// registerWindowMetrics registers the statistics of the named metric, if it is
+// registered and they aren't yet, so they are published like it.
+func registerWindowMetrics(name string) {
+	if _, ok := LookupMetric(name + WindowAvgSuffix); ok {
+		return
+	}
+	info, ok := LookupMetric(name)
+	if !ok {
+		return
+	}
+
+	for _, s := range windowSuffixes {
+		RegisterMetric(MetricInfo{
+			Name:              info.Name + s.suffix,
+			Description:       info.Description + ", " + s.description + " over the rolling window",
+			Unit:              info.Unit,
+			Kind:              KindGauge,
+			PrometheusName:    info.PrometheusName + s.prometheus,
+			OpenTelemetryName: info.OpenTelemetryName + s.opentelemetry,
+		})
+	}
+}
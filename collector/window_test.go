@@ -0,0 +1,113 @@
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWindowApply(t *testing.T) {
+	w := &Window{Duration: 2 * time.Minute}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var r *Result
+	for i, scheduled := range []int{10, 4, 6, 13} {
+		r = &Result{
+			Totals: map[string]int{ScheduledJobsCount: scheduled},
+			Queues: map[string]map[string]int{
+				"default": {ScheduledJobsCount: scheduled},
+			},
+		}
+		w.Apply(r, start.Add(time.Duration(i)*time.Minute))
+	}
+
+	// The first value, 10, has left the window.
+	want := map[string]int{
+		ScheduledJobsCount:                             13,
+		ScheduledJobsCount + WindowAvgSuffix:           8,
+		ScheduledJobsCount + WindowMaxSuffix:           13,
+		ScheduledJobsCount + WindowMinSuffix:           4,
+		ScheduledJobsCount + WindowRatePerMinuteSuffix: 5,
+	}
+	if diff := cmp.Diff(r.Totals, want); diff != "" {
+		t.Errorf("r.Totals diff (-got +want):\n%s", diff)
+	}
+	if diff := cmp.Diff(r.Queues["default"], want); diff != "" {
+		t.Errorf("r.Queues[default] diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestWindowApplyFirstResult(t *testing.T) {
+	w := &Window{Duration: time.Minute}
+	r := &Result{
+		Totals: map[string]int{RunningJobsCount: 3},
+	}
+	w.Apply(r, time.Now())
+
+	want := map[string]int{
+		RunningJobsCount:                   3,
+		RunningJobsCount + WindowAvgSuffix: 3,
+		RunningJobsCount + WindowMaxSuffix: 3,
+		RunningJobsCount + WindowMinSuffix: 3,
+	}
+	if diff := cmp.Diff(r.Totals, want); diff != "" {
+		t.Errorf("r.Totals diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestWindowApplyMetrics(t *testing.T) {
+	w := &Window{Duration: time.Minute, Metrics: []string{IdleAgentCount}}
+	r := &Result{
+		Totals: map[string]int{IdleAgentCount: 2, BusyAgentCount: 1},
+	}
+	w.Apply(r, time.Now())
+
+	if _, ok := r.Totals[IdleAgentCount+WindowAvgSuffix]; !ok {
+		t.Errorf("r.Totals[%s] missing", IdleAgentCount+WindowAvgSuffix)
+	}
+	if _, ok := r.Totals[BusyAgentCount+WindowAvgSuffix]; ok {
+		t.Errorf("r.Totals[%s] present, want only statistics for %s", BusyAgentCount+WindowAvgSuffix, IdleAgentCount)
+	}
+}
+
+func TestWindowForgetsMissingQueues(t *testing.T) {
+	w := &Window{Duration: time.Minute}
+	start := time.Now()
+
+	w.Apply(&Result{Queues: map[string]map[string]int{"default": {IdleAgentCount: 9}}}, start)
+
+	// The queue is missing while its first value is in the window, then
+	// returns after it has left.
+	w.Apply(&Result{Queues: map[string]map[string]int{}}, start.Add(30*time.Second))
+	r := &Result{Queues: map[string]map[string]int{"default": {IdleAgentCount: 1}}}
+	w.Apply(r, start.Add(2*time.Minute))
+
+	if got, want := r.Queues["default"][IdleAgentCount+WindowMaxSuffix], 1; got != want {
+		t.Errorf("r.Queues[default][%s] = %d, want %d", IdleAgentCount+WindowMaxSuffix, got, want)
+	}
+	if _, ok := r.Queues["default"][IdleAgentCount+WindowRatePerMinuteSuffix]; ok {
+		t.Errorf("r.Queues[default][%s] present after the earlier value left the window", IdleAgentCount+WindowRatePerMinuteSuffix)
+	}
+}
+
+func TestWindowRegistersMetrics(t *testing.T) {
+	w := &Window{Duration: time.Minute}
+	w.Apply(&Result{Totals: map[string]int{BusyAgentPercentage: 50}}, time.Now())
+
+	info, ok := LookupMetric(BusyAgentPercentage + WindowMaxSuffix)
+	if !ok {
+		t.Fatalf("LookupMetric(%q) not registered", BusyAgentPercentage+WindowMaxSuffix)
+	}
+	want := MetricInfo{
+		Name:              "BusyAgentPercentageMax",
+		Description:       "Percentage of busy agents, maximum over the rolling window",
+		Unit:              UnitPercent,
+		Kind:              KindGauge,
+		PrometheusName:    "busy_agent_percentage_max",
+		OpenTelemetryName: "buildkite.agents.busy_percentage.max",
+	}
+	if diff := cmp.Diff(info, want); diff != "" {
+		t.Errorf("LookupMetric(%q) diff (-got +want):\n%s", want.Name, diff)
+	}
+}
@@ -0,0 +1,406 @@
+// Package config loads configuration files for buildkite-agent-metrics, which
+// declare the tokens to collect metrics for, each with its own settings, and
+// the backends to send them to.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the contents of a configuration file. In YAML, it looks like:
+//
+//	interval: 30s
+//	backends:
+//	  prom:
+//	    type: prometheus
+//	    addr: ":8080"
+//	  datadog:
+//	    type: statsd
+//	    host: 127.0.0.1:8125
+//	    tags: true
+//	tokens:
+//	  - alias: ci
+//	    token_env: CI_CLUSTER_TOKEN
+//	    queue_filters: ["deploy-*", "!*-canary"]
+//	    backends: [prom]
+//	  - alias: release
+//	    token_env: RELEASE_CLUSTER_TOKEN
+//	    queues: [release]
+//
+// and the same keys are used in TOML.
+type Config struct {
+	// Interval is how often to collect metrics. Zero collects them once.
+	Interval time.Duration `yaml:"interval" toml:"interval"`
+
+	// Endpoint, Queues and QueueFilters are the defaults for tokens that
+	// don't set their own.
+	Endpoint     string   `yaml:"endpoint" toml:"endpoint"`
+	Queues       []string `yaml:"queues" toml:"queues"`
+	QueueFilters []string `yaml:"queue_filters" toml:"queue_filters"`
+
+	// Backends are the backends metrics can be sent to, by name.
+	Backends map[string]Backend `yaml:"backends" toml:"backends"`
+
+	// Tokens are the tokens to collect metrics for.
+	Tokens []Token `yaml:"tokens" toml:"tokens"`
+}
+
+// Token is the settings for collecting metrics with one token.
+type Token struct {
+	// Alias names the token in logs and errors, rather than the token itself.
+	Alias string `yaml:"alias" toml:"alias"`
+
+	// Token is the Buildkite Agent registration token. TokenEnv is the name
+	// of an environment variable to read it from instead, and TokenFile a
+	// file, which keep it out of this one. A token file is read again if the
+	// token is rejected, so it can be rotated.
+	Token     string `yaml:"token" toml:"token"`
+	TokenEnv  string `yaml:"token_env" toml:"token_env"`
+	TokenFile string `yaml:"token_file" toml:"token_file"`
+
+	// Endpoint, Queues and QueueFilters override the file's defaults.
+	Endpoint     string   `yaml:"endpoint" toml:"endpoint"`
+	Queues       []string `yaml:"queues" toml:"queues"`
+	QueueFilters []string `yaml:"queue_filters" toml:"queue_filters"`
+
+	// Backends are the names of the backends to send this token's metrics
+	// to. If empty, they are sent to all of them.
+	Backends []string `yaml:"backends" toml:"backends"`
+}
+
+// DefaultAlias is the alias of the token at index i of Tokens if it doesn't
+// have one.
+func DefaultAlias(i int) string {
+	return fmt.Sprintf("token %d", i+1)
+}
+
+// Backend is the settings for one backend. Type selects which, and besides
+// Timeout, only the settings for that type can be used.
+type Backend struct {
+	// Type is one of cloudwatch, newrelic, prometheus, stackdriver, statsd
+	// or opentelemetry.
+	Type string `yaml:"type" toml:"type"`
+
+	// Timeout limits how long sending metrics to the backend can take, so
+	// that a slow backend doesn't hold up the others. Zero means no limit.
+	Timeout time.Duration `yaml:"timeout" toml:"timeout"`
+
+	// statsd
+	Host string `yaml:"host" toml:"host"`
+	Tags bool   `yaml:"tags" toml:"tags"`
+
+	// prometheus
+	Addr string `yaml:"addr" toml:"addr"`
+	Path string `yaml:"path" toml:"path"`
+
+	// cloudwatch
+	Region         string `yaml:"region" toml:"region"`
+	Dimensions     string `yaml:"dimensions" toml:"dimensions"`
+	HighResolution bool   `yaml:"high_resolution" toml:"high_resolution"`
+
+	// stackdriver
+	ProjectID string `yaml:"project_id" toml:"project_id"`
+
+	// newrelic
+	AppName    string `yaml:"app_name" toml:"app_name"`
+	LicenseKey string `yaml:"license_key" toml:"license_key"`
+}
+
+// BackendTypes are the supported values of Backend.Type.
+var BackendTypes = []string{"cloudwatch", "newrelic", "prometheus", "stackdriver", "statsd", "opentelemetry"}
+
+// Error is a problem with a configuration file, at a line of it if known.
+type Error struct {
+	File string
+	Line int
+
+	// Path is the setting with the problem, such as tokens[0].backends, if
+	// known.
+	Path string
+
+	Message string
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	b.WriteString(e.File)
+	if e.Line > 0 {
+		fmt.Fprintf(&b, ":%d", e.Line)
+	}
+	b.WriteString(": ")
+	if e.Path != "" {
+		b.WriteString(e.Path + ": ")
+	}
+	b.WriteString(e.Message)
+	return b.String()
+}
+
+// Errors is every problem found with a configuration file, in the order of
+// the file's lines.
+type Errors []*Error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Load reads and validates the configuration file at path, which is YAML if
+// its extension is .yaml or .yml, and TOML if it is .toml. Problems with the
+// file are returned as Errors.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(path, data)
+}
+
+// Parse parses and validates a configuration file named path, which is used
+// to choose the format and in errors.
+func Parse(path string, data []byte) (*Config, error) {
+	var (
+		cfg  *Config
+		errs Errors
+	)
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		cfg, errs = parseYAML(path, data)
+	case ".toml":
+		cfg, errs = parseTOML(path, data)
+	default:
+		return nil, fmt.Errorf("%s: unsupported configuration file extension %q, must be .yaml, .yml or .toml", path, ext)
+	}
+	if len(errs) > 0 {
+		return nil, sortErrors(errs)
+	}
+	return cfg, nil
+}
+
+// lines maps the paths of settings, such as tokens[0].backends[1], to the
+// lines they are on.
+type lines map[string]int
+
+// lookup returns the line of path, or of the closest enclosing setting that
+// has one.
+func (l lines) lookup(path string) int {
+	for path != "" {
+		if line, ok := l[path]; ok {
+			return line
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+	return 0
+}
+
+var yamlErrorLine = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+func parseYAML(file string, data []byte) (*Config, Errors) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, Errors{yamlError(file, err.Error())}
+	}
+
+	cfg := &Config{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil {
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			errs := make(Errors, 0, len(typeErr.Errors))
+			for _, msg := range typeErr.Errors {
+				errs = append(errs, yamlError(file, msg))
+			}
+			return nil, errs
+		}
+		// An empty file has nothing to decode
+		if !errors.Is(err, io.EOF) {
+			return nil, Errors{yamlError(file, err.Error())}
+		}
+	}
+
+	l := lines{}
+	if len(root.Content) > 0 {
+		yamlLines(l, "", root.Content[0])
+	}
+	return cfg, cfg.validate(file, l)
+}
+
+// yamlError turns a yaml.v3 error message, which may start with the line,
+// into an Error.
+func yamlError(file, msg string) *Error {
+	msg = strings.TrimPrefix(msg, "yaml: ")
+	e := &Error{File: file, Message: msg}
+	if m := yamlErrorLine.FindStringSubmatch(msg); m != nil {
+		e.Line, _ = strconv.Atoi(m[1])
+		e.Message = m[2]
+	}
+	return e
+}
+
+// yamlLines records the lines of the settings in node, which is at path.
+func yamlLines(l lines, path string, node *yaml.Node) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			p := key.Value
+			if path != "" {
+				p = path + "." + key.Value
+			}
+			l[p] = key.Line
+			yamlLines(l, p, value)
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			p := fmt.Sprintf("%s[%d]", path, i)
+			l[p] = item.Line
+			yamlLines(l, p, item)
+		}
+	}
+}
+
+var tomlErrorLine = regexp.MustCompile(`^toml: line (\d+)(?: \(last key "[^"]*"\))?: (.*)$`)
+
+func parseTOML(file string, data []byte) (*Config, Errors) {
+	cfg := &Config{}
+	md, err := toml.Decode(string(data), cfg)
+	if err != nil {
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, Errors{{File: file, Line: parseErr.Position.Line, Path: parseErr.LastKey, Message: parseErr.Message}}
+		}
+		e := &Error{File: file, Message: strings.TrimPrefix(err.Error(), "toml: ")}
+		if m := tomlErrorLine.FindStringSubmatch(err.Error()); m != nil {
+			e.Line, _ = strconv.Atoi(m[1])
+			e.Message = m[2]
+		}
+		return nil, Errors{e}
+	}
+
+	l := tomlLines(data)
+
+	var errs Errors
+	for _, key := range md.Undecoded() {
+		path := tomlPath(l, key)
+		errs = append(errs, &Error{File: file, Line: l.lookup(path), Path: path, Message: "unknown setting"})
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return cfg, cfg.validate(file, l)
+}
+
+// tomlLines records the lines of the settings in a TOML file. TOML decoding
+// doesn't report them, so they are found by scanning the file for table
+// headers and keys. Values spanning several lines are skipped over well enough
+// for the lines of the keys that follow to be right.
+func tomlLines(data []byte) lines {
+	l := lines{}
+	tables := map[string]int{} // the number of each array of tables so far
+	prefix := ""
+	for i, line := range strings.Split(string(data), "\n") {
+		n := i + 1
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+
+		case strings.HasPrefix(line, "[["):
+			name := tomlKey(strings.TrimSuffix(strings.TrimPrefix(cutComment(line), "[["), "]]"))
+			prefix = fmt.Sprintf("%s[%d]", name, tables[name])
+			tables[name]++
+			if _, ok := l[name]; !ok {
+				l[name] = n
+			}
+			l[prefix] = n
+
+		case strings.HasPrefix(line, "["):
+			prefix = tomlKey(strings.TrimSuffix(strings.TrimPrefix(cutComment(line), "["), "]"))
+			l[prefix] = n
+
+		default:
+			key, _, ok := strings.Cut(line, "=")
+			if !ok {
+				continue
+			}
+			p := tomlKey(key)
+			if prefix != "" {
+				p = prefix + "." + p
+			}
+			if _, seen := l[p]; !seen {
+				l[p] = n
+			}
+		}
+	}
+	return l
+}
+
+// tomlPath returns the path of key, a key of the decoded file. Keys don't say
+// which of an array of tables they are in, so the first of the tables with the
+// rest of the key is assumed.
+func tomlPath(l lines, key toml.Key) string {
+	path := ""
+	for i, part := range key {
+		if path != "" {
+			path += "."
+		}
+		path += part
+		if _, ok := l[path+"[0]"]; !ok {
+			continue
+		}
+		rest := strings.Join(key[i+1:], ".")
+		indexed := path + "[0]"
+		for n := 0; ; n++ {
+			p := fmt.Sprintf("%s[%d]", path, n)
+			if _, ok := l[p]; !ok {
+				break
+			}
+			if _, ok := l[p+"."+rest]; ok {
+				indexed = p
+				break
+			}
+		}
+		path = indexed
+	}
+	return path
+}
+
+// tomlKey normalises a possibly dotted and quoted TOML key.
+func tomlKey(key string) string {
+	parts := strings.Split(strings.TrimSpace(key), ".")
+	for i, part := range parts {
+		parts[i] = strings.Trim(strings.TrimSpace(part), `"'`)
+	}
+	return strings.Join(parts, ".")
+}
+
+func cutComment(line string) string {
+	line, _, _ = strings.Cut(line, "#")
+	return strings.TrimSpace(line)
+}
+
+func sortErrors(errs Errors) Errors {
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].Line < errs[j].Line
+	})
+	return errs
+}
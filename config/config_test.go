@@ -0,0 +1,242 @@
+package config
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParse(t *testing.T) {
+	want := &Config{
+		Interval: 30 * time.Second,
+		Endpoint: "https://agent.example.com/v3",
+		Backends: map[string]Backend{
+			"prom":    {Type: "prometheus", Addr: ":9090"},
+			"datadog": {Type: "statsd", Timeout: 5 * time.Second, Host: "127.0.0.1:8125", Tags: true},
+		},
+		Tokens: []Token{
+			{Alias: "ci", TokenEnv: "CI_TOKEN", QueueFilters: []string{"deploy-*", "!*-canary"}, Backends: []string{"prom"}},
+			{Alias: "release", Token: "abc123", Queues: []string{"release"}},
+			{Alias: "staging", TokenFile: "/var/run/secrets/staging-token"},
+		},
+	}
+
+	tests := []struct {
+		name string
+		file string
+		data string
+	}{
+		{
+			name: "yaml",
+			file: "config.yaml",
+			data: `
+interval: 30s
+endpoint: https://agent.example.com/v3
+backends:
+  prom:
+    type: prometheus
+    addr: ":9090"
+  datadog:
+    type: statsd
+    timeout: 5s
+    host: 127.0.0.1:8125
+    tags: true
+tokens:
+  - alias: ci
+    token_env: CI_TOKEN
+    queue_filters: ["deploy-*", "!*-canary"]
+    backends: [prom]
+  - alias: release
+    token: abc123
+    queues: [release]
+  - alias: staging
+    token_file: /var/run/secrets/staging-token
+`,
+		},
+		{
+			name: "toml",
+			file: "config.toml",
+			data: `
+interval = "30s"
+endpoint = "https://agent.example.com/v3"
+
+[backends.prom]
+type = "prometheus"
+addr = ":9090"
+
+[backends.datadog]
+type = "statsd"
+timeout = "5s"
+host = "127.0.0.1:8125"
+tags = true
+
+[[tokens]]
+alias = "ci"
+token_env = "CI_TOKEN"
+queue_filters = ["deploy-*", "!*-canary"]
+backends = ["prom"]
+
+[[tokens]]
+alias = "release"
+token = "abc123"
+queues = ["release"]
+
+[[tokens]]
+alias = "staging"
+token_file = "/var/run/secrets/staging-token"
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Parse(test.file, []byte(test.data))
+			if err != nil {
+				t.Fatalf("Parse(%q) = %v", test.file, err)
+			}
+			if diff := cmp.Diff(got, want); diff != "" {
+				t.Errorf("Parse(%q) diff (-got +want):\n%s", test.file, diff)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		data string
+		want []string
+	}{
+		{
+			name: "yaml syntax",
+			file: "config.yaml",
+			data: "interval: 30s\nbackends:\n  prom:\n    type: prometheus\n  addr: [\n",
+			want: []string{"config.yaml:5: did not find expected node content"},
+		},
+		{
+			name: "yaml unknown and mistyped settings",
+			file: "config.yaml",
+			data: "interval: soon\ntokens:\n  - alias: ci\n    token: abc\n    queus: [deploy]\n",
+			want: []string{
+				`config.yaml:1: cannot unmarshal !!str ` + "`soon`" + ` into time.Duration`,
+				"config.yaml:5: field queus not found in type config.Token",
+			},
+		},
+		{
+			name: "yaml schema",
+			file: "config.yaml",
+			data: `
+backends:
+  prom:
+    type: prometheus
+    host: localhost:8125
+  other:
+    type: graphite
+tokens:
+  - alias: ci
+    queues: [deploy]
+    queue_filters: ["/[/"]
+  - alias: ci
+    token: abc
+    endpoint: agent.example.com
+    backends: [prom, missing]
+`,
+			want: []string{
+				"config.yaml:5: backends.prom.host: is not a setting of prometheus backends",
+				`config.yaml:7: backends.other.type: unsupported backend "graphite", must be one of: cloudwatch, newrelic, prometheus, stackdriver, statsd, opentelemetry`,
+				"config.yaml:9: tokens[0]: must have a token, token_env or token_file",
+				"config.yaml:11: tokens[0].queue_filters: must have either queues or queue_filters, not both",
+				"config.yaml:11: tokens[0].queue_filters[0]: invalid queue regular expression \"/[/\": error parsing regexp: missing closing ]: `[`",
+				`config.yaml:12: tokens[1].alias: "ci" is already the alias of tokens[0]`,
+				`config.yaml:14: tokens[1].endpoint: "agent.example.com" is not an http or https URL`,
+				`config.yaml:15: tokens[1].backends[1]: no backend is named "missing"`,
+			},
+		},
+		{
+			name: "yaml default alias",
+			file: "config.yaml",
+			data: "tokens:\n  - token: abc\n  - alias: token 3\n    token: def\n  - token: ghi\n  - alias: token 1\n    token: jkl\n",
+			want: []string{
+				`config.yaml:5: tokens[2]: has no alias, and its default "token 3" is already the alias of tokens[1]`,
+				`config.yaml:6: tokens[3].alias: "token 1" is already the alias of tokens[0]`,
+			},
+		},
+		{
+			name: "toml syntax",
+			file: "config.toml",
+			data: "[[tokens]]\nalias = \"ci\"\ntoken = abc\n",
+			want: []string{`config.toml:3: tokens.token: expected value but found "abc" instead`},
+		},
+		{
+			name: "toml unknown setting",
+			file: "config.toml",
+			data: "[[tokens]]\nalias = \"ci\"\ntoken = \"abc\"\n\n[[tokens]]\nalias = \"release\"\ntoken = \"def\"\nqueus = [\"release\"]\n",
+			want: []string{"config.toml:8: tokens[1].queus: unknown setting"},
+		},
+		{
+			name: "toml schema",
+			file: "config.toml",
+			data: "[backends.a]\ntype = \"prometheus\"\n\n[backends.b]\ntype = \"prometheus\"\n\n[[tokens]]\ntoken = \"abc\"\ntoken_env = \"TOKEN\"\n",
+			want: []string{
+				"config.toml:4: backends.b: only one prometheus backend can be used, and a is already one",
+				"config.toml:7: tokens[0]: must have only one of token, token_env or token_file",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse(test.file, []byte(test.data))
+			var errs Errors
+			if !errors.As(err, &errs) {
+				t.Fatalf("Parse(%q) = %v, want Errors", test.file, err)
+			}
+			got := make([]string, len(errs))
+			for i, e := range errs {
+				got[i] = e.Error()
+			}
+			if diff := cmp.Diff(got, test.want); diff != "" {
+				t.Errorf("Parse(%q) errors diff (-got +want):\n%s", test.file, diff)
+			}
+		})
+	}
+}
+
+func TestWithDefaults(t *testing.T) {
+	c := &Config{
+		Endpoint:     "https://agent.example.com/v3",
+		QueueFilters: []string{"deploy-*"},
+		Backends: map[string]Backend{
+			"b": {Type: "statsd"},
+			"a": {Type: "prometheus"},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		token Token
+		want  Token
+	}{
+		{
+			name:  "defaults",
+			token: Token{Token: "abc"},
+			want:  Token{Token: "abc", Endpoint: "https://agent.example.com/v3", QueueFilters: []string{"deploy-*"}, Backends: []string{"a", "b"}},
+		},
+		{
+			name:  "overrides",
+			token: Token{Token: "abc", Endpoint: "http://localhost", Queues: []string{"release"}, Backends: []string{"b"}},
+			want:  Token{Token: "abc", Endpoint: "http://localhost", Queues: []string{"release"}, Backends: []string{"b"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if diff := cmp.Diff(c.WithDefaults(test.token), test.want); diff != "" {
+				t.Errorf("c.WithDefaults(%+v) diff (-got +want):\n%s", test.token, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// secretSettings are settings whose values Diff doesn't show.
+var secretSettings = map[string]bool{
+	"token":       true,
+	"license_key": true,
+}
+
+// Diff describes the changes from old to new, one per line, for logging when
+// a config file is reloaded. Tokens are matched by alias, or by position if
+// they don't have one, and secrets are only reported as changed.
+func Diff(old, new *Config) []string {
+	var changes []string
+	diff := func(path string, a, b map[string]string) {
+		names := make([]string, 0, len(a)+len(b))
+		for name := range a {
+			names = append(names, name)
+		}
+		for name := range b {
+			if _, ok := a[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			before, after := a[name], b[name]
+			switch {
+			case before == after:
+			case secretSettings[name]:
+				changes = append(changes, fmt.Sprintf("%s%s: changed", path, name))
+			case before == "":
+				changes = append(changes, fmt.Sprintf("%s%s: set to %s", path, name, after))
+			case after == "":
+				changes = append(changes, fmt.Sprintf("%s%s: unset from %s", path, name, before))
+			default:
+				changes = append(changes, fmt.Sprintf("%s%s: changed from %s to %s", path, name, before, after))
+			}
+		}
+	}
+
+	diff("", old.settings(), new.settings())
+
+	names := make([]string, 0, len(old.Backends)+len(new.Backends))
+	for name := range old.Backends {
+		names = append(names, name)
+	}
+	for name := range new.Backends {
+		if _, ok := old.Backends[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := "backends." + name
+		a, inOld := old.Backends[name]
+		b, inNew := new.Backends[name]
+		switch {
+		case !inOld:
+			changes = append(changes, path+": added")
+		case !inNew:
+			changes = append(changes, path+": removed")
+		default:
+			diff(path+".", a.settings(), b.settings())
+		}
+	}
+
+	oldTokens, oldKeys := tokensByKey(old.Tokens)
+	newTokens, newKeys := tokensByKey(new.Tokens)
+	for _, key := range oldKeys {
+		if _, ok := newTokens[key]; !ok {
+			changes = append(changes, key+": removed")
+		}
+	}
+	for _, key := range newKeys {
+		a, ok := oldTokens[key]
+		if !ok {
+			changes = append(changes, key+": added")
+			continue
+		}
+		diff(key+".", a.settings(), newTokens[key].settings())
+	}
+
+	return changes
+}
+
+// tokensByKey returns tokens by the path Diff reports them under, and those
+// paths in order.
+func tokensByKey(tokens []Token) (map[string]Token, []string) {
+	byKey := make(map[string]Token, len(tokens))
+	keys := make([]string, 0, len(tokens))
+	for i, t := range tokens {
+		key := fmt.Sprintf("tokens[%d]", i)
+		if t.Alias != "" {
+			key = "tokens." + t.Alias
+		}
+		byKey[key] = t
+		keys = append(keys, key)
+	}
+	return byKey, keys
+}
+
+// settings returns c's top-level settings that are set, formatted for Diff.
+func (c *Config) settings() map[string]string {
+	return setValues(map[string]string{
+		"interval":      duration(c.Interval),
+		"endpoint":      c.Endpoint,
+		"queues":        list(c.Queues),
+		"queue_filters": list(c.QueueFilters),
+	})
+}
+
+// settings returns b's settings that are set, formatted for Diff.
+func (b Backend) settings() map[string]string {
+	return setValues(map[string]string{
+		"type":            b.Type,
+		"timeout":         duration(b.Timeout),
+		"host":            b.Host,
+		"tags":            boolean(b.Tags),
+		"addr":            b.Addr,
+		"path":            b.Path,
+		"region":          b.Region,
+		"dimensions":      b.Dimensions,
+		"high_resolution": boolean(b.HighResolution),
+		"project_id":      b.ProjectID,
+		"app_name":        b.AppName,
+		"license_key":     b.LicenseKey,
+	})
+}
+
+// settings returns t's settings that are set, formatted for Diff.
+func (t Token) settings() map[string]string {
+	return setValues(map[string]string{
+		"token":         t.Token,
+		"token_env":     t.TokenEnv,
+		"token_file":    t.TokenFile,
+		"endpoint":      t.Endpoint,
+		"queues":        list(t.Queues),
+		"queue_filters": list(t.QueueFilters),
+		"backends":      list(t.Backends),
+	})
+}
+
+func setValues(values map[string]string) map[string]string {
+	for name, v := range values {
+		if v == "" {
+			delete(values, name)
+		}
+	}
+	return values
+}
+
+func duration(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+func boolean(b bool) string {
+	if !b {
+		return ""
+	}
+	return "true"
+}
+
+func list(l []string) string {
+	if len(l) == 0 {
+		return ""
+	}
+	return "[" + strings.Join(l, ", ") + "]"
+}
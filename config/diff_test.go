@@ -0,0 +1,78 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiff(t *testing.T) {
+	old := &Config{
+		Interval: 30 * time.Second,
+		Queues:   []string{"default"},
+		Backends: map[string]Backend{
+			"prom":    {Type: "prometheus"},
+			"datadog": {Type: "statsd", Host: "127.0.0.1:8125"},
+			"nr":      {Type: "newrelic", AppName: "metrics", LicenseKey: "old"},
+		},
+		Tokens: []Token{
+			{Alias: "ci", Token: "abc", Backends: []string{"prom"}},
+			{Alias: "release", TokenEnv: "RELEASE_TOKEN"},
+			{Token: "def"},
+		},
+	}
+
+	tests := []struct {
+		name string
+		new  *Config
+		want []string
+	}{
+		{
+			name: "unchanged",
+			new:  old,
+		},
+		{
+			name: "changed",
+			new: &Config{
+				Interval:     time.Minute,
+				QueueFilters: []string{"deploy-*"},
+				Backends: map[string]Backend{
+					"prom":    {Type: "prometheus"},
+					"datadog": {Type: "statsd", Host: "127.0.0.1:8126", Tags: true, Timeout: 5 * time.Second},
+					"nr":      {Type: "newrelic", AppName: "metrics", LicenseKey: "new"},
+					"cw":      {Type: "cloudwatch"},
+				},
+				Tokens: []Token{
+					{Alias: "ci", Token: "xyz", Backends: []string{"prom", "cw"}},
+					{Token: "def", Queues: []string{"deploy"}},
+					{Alias: "staging", Token: "ghi"},
+				},
+			},
+			want: []string{
+				"interval: changed from 30s to 1m0s",
+				"queue_filters: set to [deploy-*]",
+				"queues: unset from [default]",
+				"backends.cw: added",
+				"backends.datadog.host: changed from 127.0.0.1:8125 to 127.0.0.1:8126",
+				"backends.datadog.tags: set to true",
+				"backends.datadog.timeout: set to 5s",
+				"backends.nr.license_key: changed",
+				"tokens.release: removed",
+				"tokens[2]: removed",
+				"tokens.ci.backends: changed from [prom] to [prom, cw]",
+				"tokens.ci.token: changed",
+				"tokens[1]: added",
+				"tokens.staging: added",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if diff := cmp.Diff(Diff(old, test.new), test.want); diff != "" {
+				t.Errorf("Diff(old, new) diff (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/buildkite/buildkite-agent-metrics/v5/backend"
+	"github.com/buildkite/buildkite-agent-metrics/v5/collector"
+)
+
+// backendSettings are the settings each type of backend can use, besides type
+// and timeout.
+var backendSettings = map[string][]string{
+	"cloudwatch":    {"region", "dimensions", "high_resolution"},
+	"newrelic":      {"app_name", "license_key"},
+	"prometheus":    {"addr", "path"},
+	"stackdriver":   {"project_id"},
+	"statsd":        {"host", "tags"},
+	"opentelemetry": {},
+}
+
+// set returns the settings of b that have been set, besides type and timeout.
+func (b Backend) set() []string {
+	settings := map[string]bool{
+		"host":            b.Host != "",
+		"tags":            b.Tags,
+		"addr":            b.Addr != "",
+		"path":            b.Path != "",
+		"region":          b.Region != "",
+		"dimensions":      b.Dimensions != "",
+		"high_resolution": b.HighResolution,
+		"project_id":      b.ProjectID != "",
+		"app_name":        b.AppName != "",
+		"license_key":     b.LicenseKey != "",
+	}
+	var set []string
+	for name, ok := range settings {
+		if ok {
+			set = append(set, name)
+		}
+	}
+	sort.Strings(set)
+	return set
+}
+
+// validate checks c for problems that decoding it doesn't catch, using l to
+// find the lines they are on.
+func (c *Config) validate(file string, l lines) Errors {
+	var errs Errors
+	addErr := func(path, format string, args ...any) {
+		errs = append(errs, &Error{File: file, Line: l.lookup(path), Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if c.Interval < 0 {
+		addErr("interval", "must be at least 0")
+	}
+	if err := validateEndpoint(c.Endpoint); err != nil {
+		addErr("endpoint", "%v", err)
+	}
+	validateQueues(addErr, "", c.Queues, c.QueueFilters)
+
+	names := make([]string, 0, len(c.Backends))
+	for name := range c.Backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var prometheus []string
+	for _, name := range names {
+		b := c.Backends[name]
+		path := "backends." + name
+		settings, ok := backendSettings[strings.ToLower(b.Type)]
+		switch {
+		case b.Type == "":
+			addErr(path, "must have a type: %s", strings.Join(BackendTypes, ", "))
+			continue
+		case !ok:
+			addErr(path+".type", "unsupported backend %q, must be one of: %s", b.Type, strings.Join(BackendTypes, ", "))
+			continue
+		}
+		for _, s := range b.set() {
+			if !slices.Contains(settings, s) {
+				addErr(path+"."+s, "is not a setting of %s backends", strings.ToLower(b.Type))
+			}
+		}
+		if b.Timeout < 0 {
+			addErr(path+".timeout", "must be at least 0")
+		}
+		if _, err := backend.ParseCloudWatchDimensions(b.Dimensions); err != nil {
+			addErr(path+".dimensions", "%v", err)
+		}
+		if strings.ToLower(b.Type) == "prometheus" {
+			prometheus = append(prometheus, name)
+		}
+	}
+	// Prometheus metrics are registered globally, so two backends would
+	// serve the same metrics
+	if len(prometheus) > 1 {
+		addErr("backends."+prometheus[1], "only one prometheus backend can be used, and %s is already one", prometheus[0])
+	}
+
+	aliases := make(map[string]int)
+	for i, t := range c.Tokens {
+		path := fmt.Sprintf("tokens[%d]", i)
+		sources := 0
+		for _, s := range []string{t.Token, t.TokenEnv, t.TokenFile} {
+			if s != "" {
+				sources++
+			}
+		}
+		switch {
+		case sources == 0:
+			addErr(path, "must have a token, token_env or token_file")
+		case sources > 1:
+			addErr(path, "must have only one of token, token_env or token_file")
+		}
+		// Tokens are told apart by their aliases, including the default ones
+		alias := t.Alias
+		if alias == "" {
+			alias = DefaultAlias(i)
+		}
+		switch j, ok := aliases[alias]; {
+		case ok && t.Alias != "":
+			addErr(path+".alias", "%q is already the alias of tokens[%d]", alias, j)
+		case ok:
+			addErr(path, "has no alias, and its default %q is already the alias of tokens[%d]", alias, j)
+		default:
+			aliases[alias] = i
+		}
+		if err := validateEndpoint(t.Endpoint); err != nil {
+			addErr(path+".endpoint", "%v", err)
+		}
+		validateQueues(addErr, path+".", t.Queues, t.QueueFilters)
+		for j, name := range t.Backends {
+			if _, ok := c.Backends[name]; !ok {
+				addErr(fmt.Sprintf("%s.backends[%d]", path, j), "no backend is named %q", name)
+			}
+		}
+	}
+
+	return errs
+}
+
+func validateEndpoint(endpoint string) error {
+	if endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("%q is not an http or https URL", endpoint)
+	}
+	return nil
+}
+
+func validateQueues(addErr func(path, format string, args ...any), prefix string, queues, filters []string) {
+	if len(queues) > 0 && len(filters) > 0 {
+		addErr(prefix+"queue_filters", "must have either queues or queue_filters, not both")
+	}
+	for i, pattern := range filters {
+		if _, err := collector.ParseQueueFilter([]string{pattern}); err != nil {
+			addErr(fmt.Sprintf("%squeue_filters[%d]", prefix, i), "%v", err)
+		}
+	}
+}
+
+// WithDefaults returns t with the file's defaults for the settings it doesn't
+// set, and the names of all of the file's backends if it doesn't name any.
+func (c *Config) WithDefaults(t Token) Token {
+	if t.Endpoint == "" {
+		t.Endpoint = c.Endpoint
+	}
+	if len(t.Queues) == 0 && len(t.QueueFilters) == 0 {
+		t.Queues = c.Queues
+		t.QueueFilters = c.QueueFilters
+	}
+	if len(t.Backends) == 0 {
+		for name := range c.Backends {
+			t.Backends = append(t.Backends, name)
+		}
+		sort.Strings(t.Backends)
+	}
+	return t
+}
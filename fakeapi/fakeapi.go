@@ -0,0 +1,411 @@
+// Package fakeapi provides a fake Buildkite Agent API, serving the /metrics and
+// /metrics/queue endpoints used by the collector package from an in-memory
+// model of organizations, clusters and queues.
+//
+// It is intended for testing anything that consumes the Agent API, or the
+// metrics published from it, without a Buildkite organization:
+//
+//	api := fakeapi.New()
+//	api.AddToken("abc123", "my-org", "my-cluster")
+//	api.SetQueue("my-org", "my-cluster", "default", fakeapi.Queue{
+//		Agents: fakeapi.Agents{Idle: 2, Busy: 1},
+//		Jobs:   fakeapi.Jobs{Scheduled: 4, Running: 1},
+//	})
+//
+//	srv := httptest.NewServer(api)
+//	defer srv.Close()
+//
+// The model can be changed at any time, including while requests are being
+// served, to script how the metrics change over time.
+package fakeapi
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-metrics/v5/collector"
+)
+
+// Agents are the agents connected to a queue.
+type Agents struct {
+	Idle int
+	Busy int
+
+	// Extra are additional fields to include in the agents object, such as
+	// fields the collector doesn't know about yet.
+	Extra map[string]int
+}
+
+// Total returns the total number of agents.
+func (a Agents) Total() int {
+	return a.Idle + a.Busy
+}
+
+// Jobs are the unfinished jobs of a queue.
+type Jobs struct {
+	Scheduled int
+	Running   int
+	Waiting   int
+
+	// Extra are additional fields to include in the jobs object, such as
+	// fields the collector doesn't know about yet.
+	Extra map[string]int
+}
+
+// Total returns the number of unfinished jobs.
+func (j Jobs) Total() int {
+	return j.Scheduled + j.Running + j.Waiting
+}
+
+// Queue is the state of a queue.
+type Queue struct {
+	Agents Agents
+	Jobs   Jobs
+}
+
+// Fault describes requests to fail or delay.
+type Fault struct {
+	// Path is the endpoint the fault applies to, "/metrics" or
+	// "/metrics/queue". Empty means both.
+	Path string
+
+	// Queue limits the fault to requests to /metrics/queue for the named
+	// queue. Empty means any queue.
+	Queue string
+
+	// Token limits the fault to requests with the given token. Empty means
+	// any token.
+	Token string
+
+	// Latency delays the response, or until the request is cancelled.
+	Latency time.Duration
+
+	// StatusCode, if non-zero, is the status of the response, which has a
+	// JSON body with Message and a Retry-After header if RetryAfter is set.
+	// Otherwise the request is served normally after Latency.
+	StatusCode int
+	Message    string
+	RetryAfter time.Duration
+
+	// Times is how many matching requests the fault applies to before it is
+	// removed. 0 means every matching request.
+	Times int
+}
+
+// Request describes a request made to the API.
+type Request struct {
+	Time  time.Time
+	Token string
+	Path  string
+	Queue string
+}
+
+type scope struct {
+	org, cluster string
+}
+
+// API is a fake Buildkite Agent API. It is an http.Handler, and is safe for
+// concurrent use.
+type API struct {
+	mu           sync.Mutex
+	tokens       map[string]scope
+	queues       map[scope]map[string]Queue
+	pollDuration time.Duration
+	latency      time.Duration
+	faults       []*Fault
+	requests     []Request
+}
+
+// New returns an API with no tokens or queues.
+func New() *API {
+	return &API{
+		tokens: make(map[string]scope),
+		queues: make(map[scope]map[string]Queue),
+	}
+}
+
+// AddToken allows requests with token, scoped to the queues of cluster in org.
+// An empty cluster scopes the token to the org's unclustered queues.
+func (a *API) AddToken(token, org, cluster string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.tokens[token] = scope{org, cluster}
+}
+
+// RemoveToken stops allowing requests with token.
+func (a *API) RemoveToken(token string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.tokens, token)
+}
+
+// SetQueue sets the state of a queue in cluster of org, adding it if needed.
+// An empty cluster is for unclustered queues.
+func (a *API) SetQueue(org, cluster, queue string, q Queue) {
+	a.UpdateQueue(org, cluster, queue, func(existing *Queue) {
+		*existing = q
+	})
+}
+
+// UpdateQueue calls update with the state of a queue in cluster of org, adding
+// the queue if needed, and keeps the changes it makes. update must not call
+// methods of a.
+func (a *API) UpdateQueue(org, cluster, queue string, update func(*Queue)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s := scope{org, cluster}
+	if a.queues[s] == nil {
+		a.queues[s] = make(map[string]Queue)
+	}
+	q := a.queues[s][queue]
+	update(&q)
+	a.queues[s][queue] = q
+}
+
+// RemoveQueue removes a queue from cluster of org. Requests for it then get a
+// 404, as for any queue that was never set.
+func (a *API) RemoveQueue(org, cluster, queue string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.queues[scope{org, cluster}], queue)
+}
+
+// SetPollDuration sets the poll duration sent in the
+// collector.PollDurationHeader of every successful response. 0, the default,
+// omits the header.
+func (a *API) SetPollDuration(d time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.pollDuration = d
+}
+
+// SetLatency delays every response by d, or until the request is cancelled.
+func (a *API) SetLatency(d time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.latency = d
+}
+
+// AddFault adds a fault, which applies to matching requests until it has been
+// applied Times times. When several faults match a request, the first added is
+// applied.
+func (a *API) AddFault(f Fault) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.faults = append(a.faults, &f)
+}
+
+// ClearFaults removes every fault.
+func (a *API) ClearFaults() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.faults = nil
+}
+
+// Requests returns the requests made to the API so far, in the order they were
+// received.
+func (a *API) Requests() []Request {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return append([]Request(nil), a.requests...)
+}
+
+// ServeHTTP serves the /metrics and /metrics/queue endpoints, below any path
+// prefix such as /v3.
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Token ")
+
+	var path string
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/metrics/queue"):
+		path = "/metrics/queue"
+	case strings.HasSuffix(r.URL.Path, "/metrics"):
+		path = "/metrics"
+	default:
+		writeError(w, http.StatusNotFound, "Not Found", 0)
+		return
+	}
+	queue := r.URL.Query().Get("name")
+
+	a.mu.Lock()
+	a.requests = append(a.requests, Request{Time: time.Now(), Token: token, Path: path, Queue: queue})
+	latency := a.latency
+	fault := a.takeFault(token, path, queue)
+	a.mu.Unlock()
+
+	if fault != nil {
+		latency += fault.Latency
+	}
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if fault != nil && fault.StatusCode != 0 {
+		writeError(w, fault.StatusCode, fault.Message, fault.RetryAfter)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed", 0)
+		return
+	}
+
+	a.mu.Lock()
+	s, ok := a.tokens[token]
+	if !ok {
+		a.mu.Unlock()
+		writeError(w, http.StatusUnauthorized, "Invalid token", 0)
+		return
+	}
+
+	var body any
+	if path == "/metrics/queue" {
+		if queue == "" {
+			a.mu.Unlock()
+			writeError(w, http.StatusUnprocessableEntity, "Missing queue name", 0)
+			return
+		}
+		q, ok := a.queues[s][queue]
+		if !ok {
+			a.mu.Unlock()
+			writeError(w, http.StatusNotFound, "No queue found", 0)
+			return
+		}
+		body = a.queueResponse(s, q)
+	} else {
+		body = a.allQueuesResponse(s)
+	}
+	pollDuration := a.pollDuration
+	a.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if pollDuration > 0 {
+		w.Header().Set(collector.PollDurationHeader, strconv.Itoa(int(pollDuration.Seconds())))
+	}
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// takeFault returns the first fault matching the request, if any, and removes
+// it if it has been applied as many times as it should be.
+func (a *API) takeFault(token, path, queue string) *Fault {
+	for i, f := range a.faults {
+		if (f.Path != "" && f.Path != path) ||
+			(f.Queue != "" && (path != "/metrics/queue" || f.Queue != queue)) ||
+			(f.Token != "" && f.Token != token) {
+			continue
+		}
+
+		applied := *f
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				a.faults = append(a.faults[:i:i], a.faults[i+1:]...)
+			}
+		}
+		return &applied
+	}
+	return nil
+}
+
+func (a *API) queueResponse(s scope, q Queue) map[string]any {
+	return a.response(s, agentsObject(q.Agents), jobsObject(q.Jobs))
+}
+
+func (a *API) allQueuesResponse(s scope) map[string]any {
+	var total Queue
+	agentQueues := map[string]any{}
+	jobQueues := map[string]any{}
+	for name, q := range a.queues[s] {
+		total.Agents.Idle += q.Agents.Idle
+		total.Agents.Busy += q.Agents.Busy
+		total.Jobs.Scheduled += q.Jobs.Scheduled
+		total.Jobs.Running += q.Jobs.Running
+		total.Jobs.Waiting += q.Jobs.Waiting
+		total.Agents.Extra = addExtra(total.Agents.Extra, q.Agents.Extra)
+		total.Jobs.Extra = addExtra(total.Jobs.Extra, q.Jobs.Extra)
+
+		agentQueues[name] = agentsObject(q.Agents)
+		jobQueues[name] = jobsObject(q.Jobs)
+	}
+
+	agents := agentsObject(total.Agents)
+	agents["queues"] = agentQueues
+	jobs := jobsObject(total.Jobs)
+	jobs["queues"] = jobQueues
+	return a.response(s, agents, jobs)
+}
+
+func (a *API) response(s scope, agents, jobs map[string]any) map[string]any {
+	res := map[string]any{
+		"agents":       agents,
+		"jobs":         jobs,
+		"organization": map[string]any{"slug": s.org},
+	}
+	if s.cluster != "" {
+		res["cluster"] = map[string]any{"name": s.cluster}
+	}
+	return res
+}
+
+func agentsObject(a Agents) map[string]any {
+	obj := map[string]any{}
+	for k, v := range a.Extra {
+		obj[k] = v
+	}
+	obj["idle"] = a.Idle
+	obj["busy"] = a.Busy
+	obj["total"] = a.Total()
+	return obj
+}
+
+func jobsObject(j Jobs) map[string]any {
+	obj := map[string]any{}
+	for k, v := range j.Extra {
+		obj[k] = v
+	}
+	obj["scheduled"] = j.Scheduled
+	obj["running"] = j.Running
+	obj["waiting"] = j.Waiting
+	obj["total"] = j.Total()
+	return obj
+}
+
+func addExtra(total, extra map[string]int) map[string]int {
+	if len(extra) == 0 {
+		return total
+	}
+	if total == nil {
+		total = make(map[string]int)
+	}
+	for k, v := range extra {
+		total[k] += v
+	}
+	return total
+}
+
+func writeError(w http.ResponseWriter, status int, message string, retryAfter time.Duration) {
+	w.Header().Set("Content-Type", "application/json")
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
@@ -0,0 +1,230 @@
+package fakeapi_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-metrics/v5/collector"
+	"github.com/buildkite/buildkite-agent-metrics/v5/fakeapi"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func newTestAPI(t *testing.T) (*fakeapi.API, *httptest.Server) {
+	t.Helper()
+
+	api := fakeapi.New()
+	api.AddToken("cluster-a-token", "test-org", "cluster-a")
+	api.AddToken("unclustered-token", "test-org", "")
+	api.SetQueue("test-org", "cluster-a", "default", fakeapi.Queue{
+		Agents: fakeapi.Agents{Idle: 2, Busy: 1},
+		Jobs:   fakeapi.Jobs{Scheduled: 4, Running: 1, Waiting: 2},
+	})
+	api.SetQueue("test-org", "cluster-a", "deploy", fakeapi.Queue{
+		Agents: fakeapi.Agents{Busy: 1},
+		Jobs:   fakeapi.Jobs{Running: 1},
+	})
+	api.SetQueue("test-org", "", "legacy", fakeapi.Queue{
+		Agents: fakeapi.Agents{Idle: 5},
+	})
+
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+	return api, srv
+}
+
+func newTestCollector(srv *httptest.Server, token string) *collector.Collector {
+	return &collector.Collector{
+		Client:   srv.Client(),
+		Endpoint: srv.URL + "/v3",
+		Token:    token,
+		Quiet:    true,
+	}
+}
+
+func TestAPIAllQueues(t *testing.T) {
+	_, srv := newTestAPI(t)
+
+	res, err := newTestCollector(srv, "cluster-a-token").Collect()
+	if err != nil {
+		t.Fatalf("Collect() = %v", err)
+	}
+
+	want := &collector.Result{
+		Org:     "test-org",
+		Cluster: "cluster-a",
+		Totals: map[string]int{
+			collector.ScheduledJobsCount:  4,
+			collector.RunningJobsCount:    2,
+			collector.UnfinishedJobsCount: 8,
+			collector.WaitingJobsCount:    2,
+			collector.IdleAgentCount:      2,
+			collector.BusyAgentCount:      2,
+			collector.TotalAgentCount:     4,
+			collector.BusyAgentPercentage: 50,
+		},
+		Queues: map[string]map[string]int{
+			"default": {
+				collector.ScheduledJobsCount:  4,
+				collector.RunningJobsCount:    1,
+				collector.UnfinishedJobsCount: 7,
+				collector.WaitingJobsCount:    2,
+				collector.IdleAgentCount:      2,
+				collector.BusyAgentCount:      1,
+				collector.TotalAgentCount:     3,
+				collector.BusyAgentPercentage: 33,
+			},
+			"deploy": {
+				collector.ScheduledJobsCount:  0,
+				collector.RunningJobsCount:    1,
+				collector.UnfinishedJobsCount: 1,
+				collector.WaitingJobsCount:    0,
+				collector.IdleAgentCount:      0,
+				collector.BusyAgentCount:      1,
+				collector.TotalAgentCount:     1,
+				collector.BusyAgentPercentage: 100,
+			},
+		},
+		QueueErrors: map[string]error{},
+	}
+	if diff := cmp.Diff(res, want); diff != "" {
+		t.Errorf("Collect() diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestAPITokenScoping(t *testing.T) {
+	_, srv := newTestAPI(t)
+
+	res, err := newTestCollector(srv, "unclustered-token").Collect()
+	if err != nil {
+		t.Fatalf("Collect() = %v", err)
+	}
+	if got, want := res.Cluster, ""; got != want {
+		t.Errorf("res.Cluster = %q, want %q", got, want)
+	}
+	if diff := cmp.Diff(res.Queues, map[string]map[string]int{
+		"legacy": {
+			collector.ScheduledJobsCount:  0,
+			collector.RunningJobsCount:    0,
+			collector.UnfinishedJobsCount: 0,
+			collector.WaitingJobsCount:    0,
+			collector.IdleAgentCount:      5,
+			collector.BusyAgentCount:      0,
+			collector.TotalAgentCount:     5,
+			collector.BusyAgentPercentage: 0,
+		},
+	}); diff != "" {
+		t.Errorf("res.Queues diff (-got +want):\n%s", diff)
+	}
+
+	_, err = newTestCollector(srv, "unknown-token").Collect()
+	var httpErr collector.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Collect() with an unknown token = %v, want a 401 HTTPError", err)
+	}
+}
+
+func TestAPIPollDuration(t *testing.T) {
+	api, srv := newTestAPI(t)
+	api.SetPollDuration(20 * time.Second)
+
+	res, err := newTestCollector(srv, "cluster-a-token").Collect()
+	if err != nil {
+		t.Fatalf("Collect() = %v", err)
+	}
+	if got, want := res.PollDuration, 20*time.Second; got != want {
+		t.Errorf("res.PollDuration = %v, want %v", got, want)
+	}
+}
+
+func TestAPIQueue(t *testing.T) {
+	api, srv := newTestAPI(t)
+	api.UpdateQueue("test-org", "cluster-a", "deploy", func(q *fakeapi.Queue) {
+		q.Jobs.Scheduled = 3
+	})
+
+	c := newTestCollector(srv, "cluster-a-token")
+	c.Queues = []string{"deploy"}
+	res, err := c.Collect()
+	if err != nil {
+		t.Fatalf("Collect() = %v", err)
+	}
+	if got, want := res.Queues["deploy"][collector.ScheduledJobsCount], 3; got != want {
+		t.Errorf("res.Queues[deploy][ScheduledJobsCount] = %d, want %d", got, want)
+	}
+
+	want := []fakeapi.Request{{Token: "cluster-a-token", Path: "/metrics/queue", Queue: "deploy"}}
+	if diff := cmp.Diff(api.Requests(), want, cmpopts.IgnoreFields(fakeapi.Request{}, "Time")); diff != "" {
+		t.Errorf("api.Requests() diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestAPIFaults(t *testing.T) {
+	api, srv := newTestAPI(t)
+	api.AddFault(fakeapi.Fault{
+		Queue:      "deploy",
+		StatusCode: http.StatusServiceUnavailable,
+		Message:    "try again",
+		Times:      1,
+	})
+	api.AddFault(fakeapi.Fault{
+		Queue:      "missing",
+		StatusCode: http.StatusNotFound,
+		Message:    "no such queue",
+	})
+
+	c := newTestCollector(srv, "cluster-a-token")
+	c.Queues = []string{"default", "deploy", "missing"}
+	c.Retry = collector.RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	res, err := c.Collect()
+	if err != nil {
+		t.Fatalf("Collect() = %v", err)
+	}
+
+	// deploy succeeds on retry, while missing fails every time.
+	if _, ok := res.Queues["deploy"]; !ok {
+		t.Errorf("res.Queues[deploy] missing, want it collected on retry")
+	}
+	var httpErr collector.HTTPError
+	if err := res.QueueErrors["missing"]; !errors.As(err, &httpErr) || httpErr.Message != "no such queue" {
+		t.Errorf("res.QueueErrors[missing] = %v, want the injected 404", err)
+	}
+}
+
+func TestAPIUnknownQueue(t *testing.T) {
+	_, srv := newTestAPI(t)
+
+	c := newTestCollector(srv, "cluster-a-token")
+	c.Queues = []string{"default", "nope"}
+
+	res, err := c.Collect()
+	if err != nil {
+		t.Fatalf("Collect() = %v", err)
+	}
+
+	if _, ok := res.Queues["default"]; !ok {
+		t.Errorf("res.Queues[default] missing, want it collected")
+	}
+	var httpErr collector.HTTPError
+	if err := res.QueueErrors["nope"]; !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusNotFound {
+		t.Errorf("res.QueueErrors[nope] = %v, want a 404 HTTPError", err)
+	}
+}
+
+func TestAPILatency(t *testing.T) {
+	api, srv := newTestAPI(t)
+	api.AddFault(fakeapi.Fault{Path: "/metrics", Latency: time.Minute})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := newTestCollector(srv, "cluster-a-token").CollectContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("CollectContext() = %v, want context.DeadlineExceeded", err)
+	}
+}
@@ -3,12 +3,13 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
@@ -18,6 +19,7 @@ import (
 
 	"github.com/buildkite/buildkite-agent-metrics/v5/backend"
 	"github.com/buildkite/buildkite-agent-metrics/v5/collector"
+	"github.com/buildkite/buildkite-agent-metrics/v5/logging"
 	"github.com/buildkite/buildkite-agent-metrics/v5/token"
 	"github.com/buildkite/buildkite-agent-metrics/v5/version"
 )
@@ -30,8 +32,11 @@ const (
 	BKAgentTokenSecretsManagerJSONKeyEnvVar  = "BUILDKITE_AGENT_SECRETS_MANAGER_JSON_KEY"
 )
 
+// These persist between invocations in the same Lambda instance. Each token is
+// polled on its own schedule, so that one that is rate-limited doesn't hold up
+// the others.
 var (
-	nextPollTime time.Time
+	schedule     collector.PollSchedule
 	lastPollTime time.Time
 )
 
@@ -39,7 +44,8 @@ func main() {
 	if os.Getenv(`DEBUG`) != "" {
 		_, err := Handler(context.Background(), json.RawMessage([]byte{}))
 		if err != nil {
-			log.Fatal(err)
+			slog.Error("Handler failed", logging.Err(err))
+			os.Exit(1)
 		}
 	} else {
 		lambda.Start(Handler)
@@ -53,6 +59,7 @@ func Handler(ctx context.Context, evt json.RawMessage) (string, error) {
 	awsRegion := os.Getenv("AWS_REGION")
 	backendOpt := os.Getenv("BUILDKITE_BACKEND")
 	queue := os.Getenv("BUILDKITE_QUEUE")
+	queueFilterPatterns := os.Getenv("BUILDKITE_QUEUE_FILTER")
 	clwDimensions := os.Getenv("BUILDKITE_CLOUDWATCH_DIMENSIONS")
 	quietString := os.Getenv("BUILDKITE_QUIET")
 	quiet := quietString == "1" || quietString == "true"
@@ -60,6 +67,20 @@ func Handler(ctx context.Context, evt json.RawMessage) (string, error) {
 	enableHighResolution := enableHighResolutionString == "1" || enableHighResolutionString == "true"
 	timeout := os.Getenv("BUILDKITE_AGENT_METRICS_TIMEOUT")
 	maxIdleConns := os.Getenv("BUILDKITE_AGENT_METRICS_MAX_IDLE_CONNS")
+	queueConcurrency := os.Getenv("BUILDKITE_AGENT_METRICS_QUEUE_CONCURRENCY")
+	retryMaxAttempts := os.Getenv("BUILDKITE_AGENT_METRICS_RETRY_MAX_ATTEMPTS")
+	retryInitialBackoff := os.Getenv("BUILDKITE_AGENT_METRICS_RETRY_INITIAL_BACKOFF")
+	retryMaxBackoff := os.Getenv("BUILDKITE_AGENT_METRICS_RETRY_MAX_BACKOFF")
+	connectTimeout := os.Getenv("BUILDKITE_AGENT_METRICS_CONNECT_TIMEOUT")
+	responseTimeout := os.Getenv("BUILDKITE_AGENT_METRICS_RESPONSE_TIMEOUT")
+
+	passthroughUnknownMetricsEnvVar := os.Getenv("BUILDKITE_AGENT_METRICS_PASSTHROUGH_UNKNOWN_METRICS")
+	passthroughUnknownMetrics := passthroughUnknownMetricsEnvVar == "1" || passthroughUnknownMetricsEnvVar == "true"
+
+	derivedMetricsEnvVar := os.Getenv("BUILDKITE_AGENT_METRICS_DERIVED_METRICS")
+	derivedMetrics := derivedMetricsEnvVar == "1" || derivedMetricsEnvVar == "true"
+	jobsPerAgent := os.Getenv("BUILDKITE_AGENT_METRICS_JOBS_PER_AGENT")
+	spareCapacityPercent := os.Getenv("BUILDKITE_AGENT_METRICS_SPARE_CAPACITY_PERCENT")
 
 	debugEnvVar := os.Getenv("BUILDKITE_AGENT_METRICS_DEBUG")
 	debug := debugEnvVar == "1" || debugEnvVar == "true"
@@ -67,30 +88,43 @@ func Handler(ctx context.Context, evt json.RawMessage) (string, error) {
 	debugHTTPEnvVar := os.Getenv("BUILDKITE_AGENT_METRICS_DEBUG_HTTP")
 	debugHTTP := debugHTTPEnvVar == "1" || debugHTTPEnvVar == "true"
 
-	if quiet {
-		log.SetOutput(io.Discard)
+	// BUILDKITE_QUIET and BUILDKITE_AGENT_METRICS_DEBUG are kept for
+	// compatibility, choosing the level unless it is set
+	level, err := logging.LevelFor(os.Getenv("BUILDKITE_AGENT_METRICS_LOG_LEVEL"), quiet, debug || debugHTTP)
+	if err != nil {
+		return "", err
 	}
+	logger, err := logging.New(os.Stderr, level, os.Getenv("BUILDKITE_AGENT_METRICS_LOG_FORMAT"))
+	if err != nil {
+		return "", err
+	}
+	slog.SetDefault(logger)
 
 	startTime := time.Now()
 
-	if !nextPollTime.IsZero() && nextPollTime.After(startTime) {
-		log.Printf("Skipping polling, next poll time is in %v",
-			nextPollTime.Sub(startTime))
-		return "", nil
-	}
-
 	providers, err := initTokenProvider(ctx, awsRegion)
 	if err != nil {
 		return "", err
 	}
 
-	tokens := make([]string, 0)
-	for _, provider := range providers {
-		bkToken, err := provider.Get()
-		if err != nil {
-			return "", err
+	// Tokens are scheduled by their name, which is their position, so that a
+	// token keeps its schedule when it is rotated
+	var due []int
+	var nextPoll time.Duration
+	for i := range providers {
+		ok, wait := schedule.Due(tokenName(i), startTime)
+		if !ok {
+			if nextPoll == 0 || wait < nextPoll {
+				nextPoll = wait
+			}
+			continue
 		}
-		tokens = append(tokens, bkToken)
+		due = append(due, i)
+	}
+
+	if len(due) == 0 {
+		slog.Info("Skipping polling", "next_poll", nextPoll)
+		return "", nil
 	}
 
 	queues := []string{}
@@ -98,6 +132,15 @@ func Handler(ctx context.Context, evt json.RawMessage) (string, error) {
 		queues = strings.Split(queue, ",")
 	}
 
+	if queue != "" && queueFilterPatterns != "" {
+		return "", fmt.Errorf("BUILDKITE_QUEUE and BUILDKITE_QUEUE_FILTER can't both be set")
+	}
+
+	queueFilter, err := collector.ParseQueueFilter(strings.Split(queueFilterPatterns, ","))
+	if err != nil {
+		return "", err
+	}
+
 	configuredTimeout, err := toIntWithDefault(timeout, 15)
 	if err != nil {
 		return "", err
@@ -108,7 +151,54 @@ func Handler(ctx context.Context, evt json.RawMessage) (string, error) {
 		return "", err
 	}
 
-	httpClient := collector.NewHTTPClient(configuredTimeout, configuredMaxIdleConns)
+	configuredQueueConcurrency, err := toIntWithDefault(queueConcurrency, 1)
+	if err != nil {
+		return "", err
+	}
+
+	var derived *collector.DerivedMetrics
+	if derivedMetrics {
+		derived = &collector.DerivedMetrics{}
+		if derived.JobsPerAgent, err = toFloatWithDefault(jobsPerAgent, 1); err != nil {
+			return "", err
+		}
+		if derived.SpareCapacityPercent, err = toFloatWithDefault(spareCapacityPercent, 0); err != nil {
+			return "", err
+		}
+		if err := derived.Validate(); err != nil {
+			return "", err
+		}
+	}
+
+	networkConfig := collector.HTTPNetworkConfig{
+		CACertFile:     os.Getenv("BUILDKITE_AGENT_METRICS_CA_CERT"),
+		ClientCertFile: os.Getenv("BUILDKITE_AGENT_METRICS_CLIENT_CERT"),
+		ClientKeyFile:  os.Getenv("BUILDKITE_AGENT_METRICS_CLIENT_KEY"),
+		Proxy:          os.Getenv("BUILDKITE_AGENT_METRICS_PROXY"),
+	}
+	if networkConfig.ConnectTimeout, err = toDurationWithDefault(connectTimeout, 0); err != nil {
+		return "", err
+	}
+	if networkConfig.ResponseTimeout, err = toDurationWithDefault(responseTimeout, 0); err != nil {
+		return "", err
+	}
+	httpClientOpts, err := networkConfig.Options()
+	if err != nil {
+		return "", err
+	}
+
+	httpClient := collector.NewHTTPClient(configuredTimeout, configuredMaxIdleConns, httpClientOpts...)
+
+	retryPolicy := collector.DefaultRetryPolicy
+	if retryPolicy.MaxAttempts, err = toIntWithDefault(retryMaxAttempts, retryPolicy.MaxAttempts); err != nil {
+		return "", err
+	}
+	if retryPolicy.InitialBackoff, err = toDurationWithDefault(retryInitialBackoff, retryPolicy.InitialBackoff); err != nil {
+		return "", err
+	}
+	if retryPolicy.MaxBackoff, err = toDurationWithDefault(retryMaxBackoff, retryPolicy.MaxBackoff); err != nil {
+		return "", err
+	}
 
 	userAgent := fmt.Sprintf("buildkite-agent-metrics/%s buildkite-agent-metrics-lambda", version.Version)
 
@@ -118,18 +208,33 @@ func Handler(ctx context.Context, evt json.RawMessage) (string, error) {
 		endpoint = bkAgentEndpoint
 	}
 
-	collectors := make([]*collector.Collector, 0, len(tokens))
-	for _, token := range tokens {
-		collectors = append(collectors, &collector.Collector{
+	sources := make(map[int]collector.Source, len(due))
+	for _, i := range due {
+		bkToken, err := providers[i].Get()
+		if err != nil {
+			return "", err
+		}
+		sources[i] = &collector.Collector{
 			Client:    httpClient,
 			UserAgent: userAgent,
 			Endpoint:  endpoint,
-			Token:     token,
+			Token:     bkToken,
 			Queues:    queues,
 			Quiet:     quiet,
-			Debug:     debug,
 			DebugHttp: debugHTTP,
-		})
+			Logger:    slog.Default().With(logging.TokenKey, tokenName(i)),
+			Retry:     retryPolicy,
+
+			QueueConcurrency: configuredQueueConcurrency,
+			QueueFilter:      queueFilter,
+
+			PassthroughUnknownMetrics: passthroughUnknownMetrics,
+			DerivedMetrics:            derived,
+
+			// A token from SSM or Secrets Manager is fetched again if it is
+			// rejected, in case it has been rotated since
+			TokenProvider: providers[i],
+		}
 	}
 
 	switch strings.ToLower(backendOpt) {
@@ -146,13 +251,13 @@ func Handler(ctx context.Context, evt json.RawMessage) (string, error) {
 		nrLicenseKey := os.Getenv("NEWRELIC_LICENSE_KEY")
 		metricsBackend, err = backend.NewNewRelicBackend(nrAppName, nrLicenseKey)
 		if err != nil {
-			fmt.Printf("Error starting New Relic client: %v\n", err)
+			slog.Error("Error starting New Relic client", logging.Err(err))
 			os.Exit(1)
 		}
 	case "opentelemetry":
 		metricsBackend, err = backend.NewOpenTelemetryBackend()
 		if err != nil {
-			fmt.Printf("Error starting OpenTelemetry backend: %v\n", err)
+			slog.Error("Error starting OpenTelemetry backend", logging.Err(err))
 			os.Exit(1)
 		}
 
@@ -164,41 +269,52 @@ func Handler(ctx context.Context, evt json.RawMessage) (string, error) {
 		metricsBackend = backend.NewCloudWatchBackend(awsRegion, dimensions, int64(time.Since(lastPollTime).Seconds()), enableHighResolution)
 	}
 
-	// minimum res.PollDuration across collectors
-	var pollDuration time.Duration
-
-	for _, c := range collectors {
-		res, err := c.Collect()
-		if err != nil {
-			return "", err
-		}
-
-		if res.PollDuration > pollDuration {
-			pollDuration = res.PollDuration
-		}
+	// Each token is polled at once, and an error with one doesn't stop the
+	// others from being published
+	errs := make([]error, len(due))
+	var wg sync.WaitGroup
+	for j, i := range due {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// The collector logs the metrics it collects, unless it is
+			// quiet
+			res, err := collector.CollectContext(ctx, sources[i])
+			if err != nil {
+				errs[j] = err
+				return
+			}
 
-		res.Dump()
+			if err := backend.CollectContext(ctx, metricsBackend, res); err != nil {
+				errs[j] = err
+				return
+			}
 
-		if err := metricsBackend.Collect(res); err != nil {
-			return "", err
-		}
+			// Store the next acceptable poll time for this token
+			schedule.Polled(tokenName(i), time.Now(), res.PollDuration)
+		}()
 	}
+	wg.Wait()
 
 	original, ok := metricsBackend.(backend.Closer)
 	if ok {
 		err := original.Close()
 		if err != nil {
-			return "", err
+			errs = append(errs, err)
 		}
 	}
 
 	lastPollTime = time.Now()
-	log.Printf("Finished in %s", time.Since(startTime))
+	slog.Info("Finished", "duration", time.Since(startTime))
 
-	// Store the next acceptable poll time in global state
-	nextPollTime = time.Now().Add(pollDuration)
+	return "", errors.Join(errs...)
+}
 
-	return "", nil
+// tokenName names the token from the provider at index i in logs and the poll
+// schedule.
+func tokenName(i int) string {
+	return fmt.Sprintf("token %d", i+1)
 }
 
 func initTokenProvider(ctx context.Context, awsRegion string) ([]token.Provider, error) {
@@ -302,3 +418,19 @@ func toIntWithDefault(val string, defaultVal int) (int, error) {
 
 	return strconv.Atoi(val)
 }
+
+func toFloatWithDefault(val string, defaultVal float64) (float64, error) {
+	if val == "" {
+		return defaultVal, nil
+	}
+
+	return strconv.ParseFloat(val, 64)
+}
+
+func toDurationWithDefault(val string, defaultVal time.Duration) (time.Duration, error) {
+	if val == "" {
+		return defaultVal, nil
+	}
+
+	return time.ParseDuration(val)
+}
@@ -1,6 +1,9 @@
 package main
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func Test_toIntWithDefault(t *testing.T) {
 	type args struct {
@@ -42,3 +45,29 @@ func Test_toIntWithDefault(t *testing.T) {
 		})
 	}
 }
+
+func Test_toDurationWithDefault(t *testing.T) {
+	tests := []struct {
+		name       string
+		val        string
+		defaultVal time.Duration
+		want       time.Duration
+		wantErr    bool
+	}{
+		{name: "empty", val: "", defaultVal: time.Second, want: time.Second},
+		{name: "invalid", val: "5", defaultVal: time.Second, wantErr: true},
+		{name: "valid", val: "250ms", defaultVal: time.Second, want: 250 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := toDurationWithDefault(tt.val, tt.defaultVal)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("toDurationWithDefault(%q, %v) error = %v, wantErr %v", tt.val, tt.defaultVal, err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("toDurationWithDefault(%q, %v) = %v, want %v", tt.val, tt.defaultVal, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+// Package logging sets up the structured logging shared by the command line
+// tool, the Lambda and the Cloud Function, and names the fields that their
+// records have in common, so that log pipelines can index them.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Field names shared by log records.
+const (
+	// OrgKey and ClusterKey are the organization and cluster that metrics
+	// are for.
+	OrgKey     = "org"
+	ClusterKey = "cluster"
+
+	// QueueKey is the queue that metrics are for.
+	QueueKey = "queue"
+
+	// TokenKey is the alias of the token, never the token itself, or its
+	// position if it has no alias.
+	TokenKey = "token"
+
+	// BackendKey is the name of the backend metrics are sent to.
+	BackendKey = "backend"
+
+	// ErrorKey is the error that a record is about.
+	ErrorKey = "error"
+)
+
+// Formats are the formats New can write records in.
+var Formats = []string{"text", "json"}
+
+// ParseLevel parses a level name: debug, info, warn or error.
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("unsupported log level %q, must be one of: debug, info, warn, error", s)
+	}
+	return level, nil
+}
+
+// LevelFor returns the level named by level or, if it is empty, the level that
+// the older quiet and debug settings stand for: error if quiet is set, debug if
+// debug is, and otherwise info.
+func LevelFor(level string, quiet, debug bool) (slog.Level, error) {
+	switch {
+	case level != "":
+		return ParseLevel(level)
+	case quiet:
+		return slog.LevelError, nil
+	case debug:
+		return slog.LevelDebug, nil
+	default:
+		return slog.LevelInfo, nil
+	}
+}
+
+// New returns a logger that writes records at level and above to w, as text
+// (logfmt) or JSON. Durations are written the same way in both, such as 1.5s,
+// rather than as nanoseconds in JSON.
+func New(w io.Writer, level slog.Leveler, format string) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		opts.ReplaceAttr = durationString
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unsupported log format %q, must be one of: %s", format, strings.Join(Formats, ", "))
+	}
+}
+
+// durationString replaces a duration with its string.
+func durationString(_ []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindDuration {
+		return slog.String(a.Key, a.Value.Duration().String())
+	}
+	return a
+}
+
+// Err returns the attribute for err, under ErrorKey.
+func Err(err error) slog.Attr {
+	return slog.Any(ErrorKey, err)
+}
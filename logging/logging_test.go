@@ -0,0 +1,107 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    slog.Level
+		wantErr bool
+	}{
+		{in: "debug", want: slog.LevelDebug},
+		{in: "INFO", want: slog.LevelInfo},
+		{in: "warn", want: slog.LevelWarn},
+		{in: "error", want: slog.LevelError},
+		{in: "loud", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			got, err := ParseLevel(test.in)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseLevel(%q) error = %v, want error %t", test.in, err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("ParseLevel(%q) = %v, want %v", test.in, got, test.want)
+			}
+		})
+	}
+}
+
+func TestLevelFor(t *testing.T) {
+	tests := []struct {
+		name         string
+		level        string
+		quiet, debug bool
+		want         slog.Level
+	}{
+		{name: "default", want: slog.LevelInfo},
+		{name: "quiet", quiet: true, want: slog.LevelError},
+		{name: "debug", debug: true, want: slog.LevelDebug},
+		{name: "level overrides quiet", level: "warn", quiet: true, want: slog.LevelWarn},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := LevelFor(test.level, test.quiet, test.debug)
+			if err != nil {
+				t.Fatalf("LevelFor(%q, %t, %t) = %v", test.level, test.quiet, test.debug, err)
+			}
+			if got != test.want {
+				t.Errorf("LevelFor(%q, %t, %t) = %v, want %v", test.level, test.quiet, test.debug, got, test.want)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, slog.LevelInfo, "json")
+	if err != nil {
+		t.Fatalf("New(json) = %v", err)
+	}
+
+	logger.Debug("hidden")
+	logger.With(TokenKey, "ci").Error("Collecting failed", OrgKey, "test", "wait", 1500*time.Millisecond, Err(errors.New("unavailable")))
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("json.Unmarshal(%q) = %v", buf.String(), err)
+	}
+	delete(got, slog.TimeKey)
+	want := map[string]any{
+		"level": "ERROR",
+		"msg":   "Collecting failed",
+		"token": "ci",
+		"org":   "test",
+		"wait":  "1.5s",
+		"error": "unavailable",
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("logged record diff (-got +want):\n%s", diff)
+	}
+
+	buf.Reset()
+	logger, err = New(&buf, slog.LevelInfo, "text")
+	if err != nil {
+		t.Fatalf("New(text) = %v", err)
+	}
+	logger.Info("Finished", TokenKey, "ci")
+	if got := buf.String(); !strings.Contains(got, "level=INFO msg=Finished token=ci") {
+		t.Errorf("logged record = %q, want text with level, msg and token", got)
+	}
+
+	if _, err := New(&buf, slog.LevelInfo, "xml"); err == nil {
+		t.Errorf("New(xml) = nil error, want an error")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/buildkite-agent-metrics/v5/collector"
+	"github.com/buildkite/buildkite-agent-metrics/v5/config"
+	"github.com/buildkite/buildkite-agent-metrics/v5/fakeapi"
+)
+
+func TestTokenProviderForRotatedToken(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+
+	tests := []struct {
+		name       string
+		token      config.Token
+		wantStatus int
+	}{
+		{
+			name:  "token_file",
+			token: config.Token{Alias: "ci", TokenFile: tokenFile},
+		},
+		{
+			name:       "token",
+			token:      config.Token{Alias: "ci", Token: "old"},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "token_env",
+			token:      config.Token{Alias: "ci", TokenEnv: "CI_TOKEN", Token: "old"},
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The token was "old" when the daemon started, and has since been
+			// rotated to "new"
+			if err := os.WriteFile(tokenFile, []byte("new\n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			api := fakeapi.New()
+			api.AddToken("new", "test", "")
+			srv := httptest.NewServer(api)
+			defer srv.Close()
+
+			provider, err := tokenProviderFor(test.token)
+			if err != nil {
+				t.Fatalf("tokenProviderFor() = %v", err)
+			}
+			c := &collector.Collector{
+				Client:        srv.Client(),
+				Endpoint:      srv.URL + "/v3",
+				Token:         "old",
+				Quiet:         true,
+				TokenProvider: provider,
+			}
+
+			_, err = c.Collect()
+			var httpErr collector.HTTPError
+			switch {
+			case test.wantStatus == 0 && err != nil:
+				t.Errorf("c.Collect() = %v, want the rotated token to be used", err)
+			case test.wantStatus != 0 && (!errors.As(err, &httpErr) || httpErr.StatusCode != test.wantStatus):
+				t.Errorf("c.Collect() error = %v, want HTTPError with status %d", err, test.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-metrics/v5/admin"
+	"github.com/buildkite/buildkite-agent-metrics/v5/backend"
+	"github.com/buildkite/buildkite-agent-metrics/v5/collector"
+	"github.com/buildkite/buildkite-agent-metrics/v5/config"
+	"github.com/buildkite/buildkite-agent-metrics/v5/logging"
+)
+
+// plan is the tokens to collect metrics for and the backends to send them to,
+// once the flags and environment have been applied over the config file.
+type plan struct {
+	// tokens have the config file's defaults applied, their name as their
+	// Alias, and the token itself as their Token, even if it is from
+	// TokenEnv. The stdin source has a single token with no name.
+	tokens []config.Token
+
+	backends map[string]config.Backend
+}
+
+// runner polls a target for each token in a plan until they have all
+// finished. It can switch to a new plan while they are running, leaving the
+// targets and backends that haven't changed running.
+type runner struct {
+	ctx      context.Context
+	stopping <-chan struct{}
+	stop     func()
+	opts     pollOptions
+
+	// backendTimeout is the timeout for backends that don't set their own.
+	backendTimeout time.Duration
+
+	// newTarget returns the target for a token in a plan, with its source.
+	newTarget func(t config.Token) (target, error)
+
+	// admin, if there is one, is told about each target's collections.
+	admin *admin.Server
+
+	// schedule is when each token may next be polled, so that a target that
+	// replaces another still waits for the poll duration it was given.
+	schedule collector.PollSchedule
+	wg       sync.WaitGroup
+
+	codeMu sync.Mutex
+	code   int
+
+	mu         sync.Mutex
+	plan       plan
+	backends   map[string]backend.Backend
+	running    map[string]*runningTarget
+	prometheus *config.Backend
+}
+
+// runningTarget is a target that is being polled.
+type runningTarget struct {
+	token   config.Token
+	target  target
+	removed chan struct{}
+	done    chan struct{}
+
+	// replaces is the target rt replaces, if any, which must finish before
+	// rt starts.
+	replaces *runningTarget
+}
+
+// apply switches r to p. The backends that are new, or whose settings have
+// changed, are started, and then the targets that are new or have changed
+// replace those they are for, once those have finished any collection in
+// progress. Backends that are no longer used are closed once the targets using
+// them have finished. apply doesn't wait for any of that. If a backend or
+// target can't be started, r is left as it was.
+func (r *runner) apply(p plan) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	select {
+	case <-r.stopping:
+		return errors.New("Shutting down")
+	default:
+	}
+
+	backends := make(map[string]backend.Backend)
+	var started []backend.MultiTarget
+	fail := func(err error) error {
+		if closeErr := backend.NewMulti(started...).Close(); closeErr != nil {
+			slog.Error("Error closing metrics backends", logging.Err(closeErr))
+		}
+		return err
+	}
+	for _, t := range p.tokens {
+		for _, name := range t.Backends {
+			if _, ok := backends[name]; ok {
+				continue
+			}
+			settings := p.backends[name]
+			if b, ok := r.backends[name]; ok && sameBackend(r.plan.backends[name], settings) {
+				backends[name] = b
+				continue
+			}
+
+			// The Prometheus backend's server can't be stopped, so it keeps
+			// serving whatever it is named
+			if strings.EqualFold(settings.Type, "prometheus") && r.prometheus != nil {
+				addr, path := prometheusServer(settings)
+				runningAddr, runningPath := prometheusServer(*r.prometheus)
+				if addr != runningAddr || path != runningPath {
+					return fail(fmt.Errorf("The prometheus backend is serving %s on %s, which can't be changed without restarting", runningPath, runningAddr))
+				}
+				backends[name] = backend.NewPrometheusBackend()
+				continue
+			}
+
+			b, err := newBackend(settings, r.opts.interval)
+			if err != nil {
+				return fail(err)
+			}
+			if strings.EqualFold(settings.Type, "prometheus") {
+				r.prometheus = &settings
+			}
+			backends[name] = b
+			started = append(started, backend.MultiTarget{Name: name, Backend: b})
+		}
+	}
+
+	running := make(map[string]*runningTarget)
+	var start []*runningTarget
+	for _, t := range p.tokens {
+		if old, ok := r.running[t.Alias]; ok && reflect.DeepEqual(old.token, t) && r.sameBackends(t.Backends, backends, p) {
+			running[t.Alias] = old
+			continue
+		}
+		target, err := r.newTarget(t)
+		if err != nil {
+			return fail(err)
+		}
+		target.backend = r.backendFor(t.Backends, backends, p)
+		target.schedule = &r.schedule
+		start = append(start, &runningTarget{token: t, target: target})
+	}
+
+	// Targets being replaced are stopped before their replacements start, so
+	// that a token is never polled twice at once. Each replacement waits for
+	// the target it replaces to finish any collection in progress, which can
+	// take minutes if it is retrying, without holding r.mu. Adding the
+	// replacements, and the cleanup below, to the wait group first keeps it
+	// from reaching zero in between.
+	r.wg.Add(len(start) + 1)
+	var stopped []*runningTarget
+	for name, old := range r.running {
+		if running[name] != old {
+			close(old.removed)
+			stopped = append(stopped, old)
+		}
+	}
+
+	for _, rt := range start {
+		if old, ok := r.running[rt.token.Alias]; ok {
+			rt.target.status = old.target.status
+			rt.replaces = old
+		} else {
+			rt.target.status = r.track(rt.token.Alias)
+		}
+		rt.removed = make(chan struct{})
+		rt.done = make(chan struct{})
+		rt.target.removed = rt.removed
+		running[rt.token.Alias] = rt
+		go r.run(rt)
+	}
+
+	// Tokens that are no longer in the plan, and backends that are no longer
+	// used, are cleaned up once the targets that were using them finish
+	var unused []backend.MultiTarget
+	for name, b := range r.backends {
+		if backends[name] != b {
+			unused = append(unused, backend.MultiTarget{Name: name, Backend: b})
+		}
+	}
+	go func() {
+		defer r.wg.Done()
+
+		for _, old := range stopped {
+			<-old.done
+			if _, ok := running[old.token.Alias]; !ok {
+				old.target.status.Remove()
+			}
+		}
+		if err := backend.NewMulti(unused...).Close(); err != nil {
+			slog.Error("Error closing metrics backends that are no longer used", logging.Err(err))
+		}
+	}()
+
+	r.plan = p
+	r.backends = backends
+	r.running = running
+	return nil
+}
+
+// run polls rt until it finishes, keeping the highest exit code of all the
+// targets.
+func (r *runner) run(rt *runningTarget) {
+	defer r.wg.Done()
+	defer close(rt.done)
+
+	// rt starts once the target it replaces has finished, unless it is
+	// shutting down or rt has itself been replaced in the meantime
+	if rt.replaces != nil {
+		select {
+		case <-rt.replaces.done:
+		case <-r.stopping:
+			return
+		}
+	}
+	select {
+	case <-r.stopping:
+		return
+	case <-rt.removed:
+		return
+	default:
+	}
+
+	code := rt.target.poll(r.ctx, r.stopping, r.stop, r.opts)
+
+	r.codeMu.Lock()
+	defer r.codeMu.Unlock()
+	r.code = max(r.code, code)
+}
+
+// wait waits for every target to finish, and returns the exit code for how
+// they did.
+func (r *runner) wait() int {
+	r.wg.Wait()
+
+	r.codeMu.Lock()
+	defer r.codeMu.Unlock()
+	return r.code
+}
+
+// close closes every backend, even if closing another fails.
+func (r *runner) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	targets := make([]backend.MultiTarget, 0, len(r.backends))
+	for name, b := range r.backends {
+		targets = append(targets, backend.MultiTarget{Name: name, Backend: b})
+	}
+	return backend.NewMulti(targets...).Close()
+}
+
+// backendFor returns the backend that sends metrics to each of the named
+// backends at once.
+func (r *runner) backendFor(names []string, backends map[string]backend.Backend, p plan) backend.Backend {
+	targets := make([]backend.MultiTarget, 0, len(names))
+	for _, name := range names {
+		timeout := p.backends[name].Timeout
+		if timeout == 0 {
+			timeout = r.backendTimeout
+		}
+		targets = append(targets, backend.MultiTarget{Name: name, Backend: backends[name], Timeout: timeout})
+	}
+	return backend.NewMulti(targets...)
+}
+
+// sameBackends reports whether the named backends are the ones running, with
+// the same timeouts, so that a target sending metrics to them can be kept.
+func (r *runner) sameBackends(names []string, backends map[string]backend.Backend, p plan) bool {
+	for _, name := range names {
+		if backends[name] != r.backends[name] || p.backends[name].Timeout != r.plan.backends[name].Timeout {
+			return false
+		}
+	}
+	return true
+}
+
+// track returns the tracker for the named target, if there is an admin
+// server.
+func (r *runner) track(name string) *admin.Tracker {
+	if r.admin == nil {
+		return nil
+	}
+	if name == "" {
+		name = "stdin"
+	}
+	return r.admin.Token(name)
+}
+
+// sameBackend reports whether a backend started with settings a can be used
+// for settings b. Timeouts are applied when sending to a backend, so they
+// don't matter.
+func sameBackend(a, b config.Backend) bool {
+	a.Timeout, b.Timeout = 0, 0
+	return a == b
+}
+
+// reloader reloads a config file into a runner.
+type reloader struct {
+	file    string
+	cfg     *config.Config
+	planFor func(*config.Config) (plan, error)
+	runner  *runner
+}
+
+// watch reloads the config file on SIGHUP, and when its contents change if
+// interval is more than zero, until stopping is closed.
+func (rl *reloader) watch(stopping <-chan struct{}, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	last, _ := os.ReadFile(rl.file)
+	for {
+		select {
+		case <-stopping:
+			return
+
+		case <-hup:
+			slog.Info("Received SIGHUP, reloading config", "file", rl.file)
+			data, err := os.ReadFile(rl.file)
+			if err != nil {
+				slog.Error("Error reloading config, keeping the current one", "file", rl.file, logging.Err(err))
+				continue
+			}
+			last = data
+			rl.reload(data)
+
+		case <-tick:
+			// A file that can't be read, such as while it is being
+			// replaced, is checked again next time
+			data, err := os.ReadFile(rl.file)
+			if err != nil || bytes.Equal(data, last) {
+				continue
+			}
+			slog.Info("Config changed, reloading it", "file", rl.file)
+			last = data
+			rl.reload(data)
+		}
+	}
+}
+
+// reload switches the runner to the config in data, logging what changed. If
+// the config is invalid, or can't be switched to, the runner is left as it
+// was.
+func (rl *reloader) reload(data []byte) {
+	cfg, err := config.Parse(rl.file, data)
+	if err != nil {
+		slog.Error("Error reloading config, keeping the current one", "file", rl.file, logging.Err(err))
+		return
+	}
+
+	changes := config.Diff(rl.cfg, cfg)
+	if len(changes) == 0 {
+		slog.Info("Reloaded config, nothing changed", "file", rl.file)
+		return
+	}
+
+	p, err := rl.planFor(cfg)
+	if err == nil {
+		err = rl.runner.apply(p)
+	}
+	if err != nil {
+		slog.Error("Error reloading config, keeping the current one", "file", rl.file, logging.Err(err))
+		return
+	}
+
+	slog.Info("Reloaded config", "file", rl.file, "changes", changes)
+	if cfg.Interval != rl.cfg.Interval {
+		slog.Warn("The interval can't be changed without restarting", "interval", rl.runner.opts.interval)
+	}
+	rl.cfg = cfg
+}
@@ -0,0 +1,31 @@
+package token
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+type fileProvider struct {
+	// The path of the file to read the token from on each Get call.
+	Path string
+}
+
+// NewFile constructs a Buildkite API token provider backed by a file, such as a mounted Kubernetes secret. The file is
+// read on each Get call, so the token can be rotated by replacing it.
+func NewFile(path string) (Provider, error) {
+	return &fileProvider{Path: path}, nil
+}
+
+func (p fileProvider) Get() (string, error) {
+	data, err := os.ReadFile(p.Path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token file '%s': %w", p.Path, err)
+	}
+
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file '%s' is empty", p.Path)
+	}
+	return token, nil
+}
@@ -0,0 +1,54 @@
+package token
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileProvider_Get(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("some-token\n"), 0o600); err != nil {
+		t.Fatalf("failed to write token file: %v", err)
+	}
+
+	provider, err := NewFile(path)
+	if err != nil {
+		t.Fatalf("no errors were expected to be returned by NewFile but got: %v", err)
+	}
+
+	token, err := provider.Get()
+	if err != nil {
+		t.Fatalf("no errors were expected to be returned by FileProvider.Get() but got: %v", err)
+	}
+	if token != "some-token" {
+		t.Fatalf("expecting 'some-token' to be returned by FileProvider.Get() but got: %s", token)
+	}
+
+	// The file is read again on each call, so rotated tokens are picked up
+	if err := os.WriteFile(path, []byte("rotated-token"), 0o600); err != nil {
+		t.Fatalf("failed to write token file: %v", err)
+	}
+	token, err = provider.Get()
+	if err != nil {
+		t.Fatalf("no errors were expected to be returned by FileProvider.Get() but got: %v", err)
+	}
+	if token != "rotated-token" {
+		t.Fatalf("expecting 'rotated-token' to be returned by FileProvider.Get() but got: %s", token)
+	}
+}
+
+func TestFileProvider_GetEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("\n"), 0o600); err != nil {
+		t.Fatalf("failed to write token file: %v", err)
+	}
+
+	provider, err := NewFile(path)
+	if err != nil {
+		t.Fatalf("no errors were expected to be returned by NewFile but got: %v", err)
+	}
+	if _, err := provider.Get(); err == nil {
+		t.Fatalf("expecting an error to be returned by FileProvider.Get() for an empty file")
+	}
+}